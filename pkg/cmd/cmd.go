@@ -40,16 +40,51 @@ func runRouter(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if verbose {
+		cfg.Logging.LogLevel = "debug"
+	}
 	// Create and start the router service
-	svc,err := router.New(cfg)
+	svc, err := router.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create router: %v", err)
+	}
 	if err := svc.Start(); err != nil {
 		log.Fatalf("Failed to start router: %v", err)
 	}
-	// Wait for shutdown signal
+	if verbose {
+		toggleDHCPDebug(svc)
+	}
+	// Wait for shutdown signal, reloading DHCP settings on SIGHUP and
+	// toggling DHCP packet logging on SIGUSR1
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	sig := <-sigCh
-	
+	for sig == syscall.SIGHUP || sig == syscall.SIGUSR1 {
+		if sig == syscall.SIGHUP {
+			reloadDHCP(svc)
+		} else {
+			toggleDHCPDebug(svc)
+		}
+		sig = <-sigCh
+	}
+
 	log.Printf("Received signal %v, shutting down...", sig)
 	svc.Stop()
 }
+
+func reloadDHCP(svc *router.Service) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		log.Printf("Not reloading, failed to load config: %v", err)
+		return
+	}
+	if err := svc.ReloadDHCP(cfg); err != nil {
+		log.Printf("Failed to reload DHCP: %v", err)
+	}
+}
+
+func toggleDHCPDebug(svc *router.Service) {
+	if err := svc.SetDHCPDebug(!svc.DHCPDebug()); err != nil {
+		log.Printf("Failed to toggle DHCP packet logging: %v", err)
+	}
+}
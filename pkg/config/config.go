@@ -2,7 +2,13 @@ package config
 
 import (
         "fmt"
+        "net"
+        "time"
+
+        "github.com/mitchellh/mapstructure"
         "github.com/spf13/viper"
+
+        "github.com/ryanvillarreal/krouter/pkg/utils"
 )
 
 // LocalDomain represents a single domain and its IP mappings
@@ -10,6 +16,101 @@ type LocalDomain struct {
     Name string   `yaml:"name"`
     IPv4 []string `yaml:"ipv4"`
     IPv6 []string `yaml:"ipv6"`
+    // TTL overrides dns.ttl.local for this domain's records
+    TTL  uint32   `yaml:"ttl"`
+}
+
+// TTLRule clamps the TTLs of answers for names under Domain
+type TTLRule struct {
+    Domain string `yaml:"domain"`
+    Min    uint32 `yaml:"min"`
+    Max    uint32 `yaml:"max"`
+}
+
+// FaultRule injects DNS failures into queries matching its selectors.
+// Empty selectors match everything.
+type FaultRule struct {
+    Name        string        `yaml:"name"`
+    Disabled    bool          `yaml:"disabled"`
+    Domains     []string      `yaml:"domains"`
+    Clients     []string      `yaml:"clients"` // IPs or CIDRs
+    QTypes      []string      `yaml:"qtypes"`
+    // Probability that a matching query is affected, 0 means always
+    Probability float64       `yaml:"probability"`
+    Latency     time.Duration `yaml:"latency"`
+    // Drop is the probability of silently discarding the query
+    Drop        float64       `yaml:"drop"`
+    // Rcode forces SERVFAIL, REFUSED or NXDOMAIN
+    Rcode       string        `yaml:"rcode"`
+    Truncate    bool          `yaml:"truncate"`
+    Malformed   bool          `yaml:"malformed"`
+    IDMismatch  bool          `yaml:"id_mismatch"`
+}
+
+// PoisonRule answers multicast/broadcast name lookups from target clients
+// with the given addresses. Clients is required; empty addresses default to
+// the LAN address.
+type PoisonRule struct {
+    Names   []string `yaml:"names"`
+    Clients []string `yaml:"clients"` // IPs or CIDRs, at least one
+    IPv4    string   `yaml:"ipv4"`
+    IPv6    string   `yaml:"ipv6"`
+}
+
+// RewriteRule answers queries for From with the records of To
+type RewriteRule struct {
+    From string `yaml:"from"`
+    To   string `yaml:"to"`
+}
+
+// DHCPOption is a raw option pushed to clients. Type is one of ip, ips,
+// string, hex, bool, uint8, uint16, uint32, domains or routes (RFC 3442,
+// "10.0.0.0/8 192.168.1.1, ...").
+type DHCPOption struct {
+    Code   uint16 `yaml:"code"`
+    Type   string `yaml:"type"`
+    Value  string `yaml:"value"`
+    // Family is v4 (default) or v6
+    Family string `yaml:"family"`
+}
+
+// ClientClass applies options to clients matching every selector set.
+// VendorClass, UserClass and Device are case-insensitive regular
+// expressions; Device matches the fingerprinted device, OS or type.
+type ClientClass struct {
+    Name        string       `yaml:"name"`
+    VendorClass string       `yaml:"vendor_class"`
+    UserClass   string       `yaml:"user_class"`
+    MACPrefix   []string     `yaml:"mac_prefix"`
+    Device      string       `yaml:"device"`
+    Options     []DHCPOption `yaml:"options"`
+}
+
+// Reservation pins a device to fixed addresses, with optional per-host
+// options overriding the pool defaults
+type Reservation struct {
+    MAC        string        `yaml:"mac"`
+    IPv4       string        `yaml:"ipv4"`
+    IPv6       string        `yaml:"ipv6"`
+    // Hostname is handed to the client and published to local DNS
+    Hostname   string        `yaml:"hostname"`
+    LeaseTime  time.Duration `yaml:"lease_time"`
+    Router     string        `yaml:"router"`
+    DNS        []string      `yaml:"dns"`
+    DomainName string        `yaml:"domain_name"`
+    Options    []DHCPOption  `yaml:"options"`
+}
+
+// LeaseHook delivers DHCP lease changes to a script, webhook or JSONL file
+type LeaseHook struct {
+    // Type is script, webhook or jsonl
+    Type    string        `yaml:"type"`
+    // Target is the script path, webhook URL or JSONL file
+    Target  string        `yaml:"target"`
+    // Events limits the hook to new, renewed, released, expired or
+    // declined; empty means all
+    Events  []string      `yaml:"events"`
+    Timeout time.Duration `yaml:"timeout"`
 }
 
 type Config struct {
@@ -27,7 +128,235 @@ type Config struct {
             IPv6 []string `yaml:"ipv6"`
         } `yaml:"upstream"`
         LocalDomains []LocalDomain `yaml:"local_domains"`
+        TTL struct {
+            // Local is the TTL handed out with spoofed/local records
+            Local      uint32    `yaml:"local"`
+            // Min and Max clamp every answer; zero leaves that bound open
+            Min        uint32    `yaml:"min"`
+            Max        uint32    `yaml:"max"`
+            // LowTTLMode rewrites all answers to LowTTL so clients re-query quickly
+            LowTTLMode bool      `yaml:"low_ttl_mode"`
+            LowTTL     uint32    `yaml:"low_ttl"`
+            Rules      []TTLRule `yaml:"rules"`
+        } `yaml:"ttl"`
+        Faults struct {
+            Enabled bool        `yaml:"enabled"`
+            Rules   []FaultRule `yaml:"rules"`
+        } `yaml:"faults"`
+        Archive struct {
+            // Mode is off, record or replay
+            Mode         string `yaml:"mode"`
+            Path         string `yaml:"path"`
+            // Miss decides replay misses: nxdomain, sinkhole or wildcard
+            Miss         string `yaml:"miss"`
+            SinkholeIPv4 string `yaml:"sinkhole_ipv4"`
+            SinkholeIPv6 string `yaml:"sinkhole_ipv6"`
+        } `yaml:"archive"`
+        Responders struct {
+            LLMNR  bool         `yaml:"llmnr"`
+            NBNS   bool         `yaml:"nbns"`
+            MDNS   bool         `yaml:"mdns"`
+            TTL    uint32       `yaml:"ttl"`
+            Poison []PoisonRule `yaml:"poison"`
+        } `yaml:"responders"`
+        Stats struct {
+            Enabled   bool          `yaml:"enabled"`
+            // Bucket is the aggregation granularity, Retention how far back we keep
+            Bucket    time.Duration `yaml:"bucket"`
+            Retention time.Duration `yaml:"retention"`
+        } `yaml:"stats"`
+        // Chain orders the stages every query passes through
+        Chain []string `yaml:"chain"`
+        Cache struct {
+            Enabled bool `yaml:"enabled"`
+            Size    int  `yaml:"size"`
+        } `yaml:"cache"`
+        Blocklist struct {
+            Domains      []string `yaml:"domains"`
+            // Files hold one pattern per line, hosts-file lines are accepted
+            Files        []string `yaml:"files"`
+            // Action is nxdomain, refused or sinkhole
+            Action       string   `yaml:"action"`
+            SinkholeIPv4 string   `yaml:"sinkhole_ipv4"`
+            SinkholeIPv6 string   `yaml:"sinkhole_ipv6"`
+        } `yaml:"blocklist"`
+        Rewrites []RewriteRule `yaml:"rewrites"`
+        DNSSEC struct {
+            // Mode is off, preserve (pass DO/RRSIGs through) or validate
+            Mode         string   `yaml:"mode"`
+            // TrustAnchors are DS or DNSKEY records in zone-file syntax,
+            // the root KSKs when empty
+            TrustAnchors []string `yaml:"trust_anchors"`
+            // ExemptLocal serves spoofed local answers without validation
+            ExemptLocal  bool     `yaml:"exempt_local"`
+            // Exempt lists names never validated
+            Exempt       []string `yaml:"exempt"`
+        } `yaml:"dnssec"`
     } `yaml:"dns"`
+    DHCP struct {
+        // Mode is server, answering clients itself, relay, forwarding
+        // them to the servers in Relay over the WAN, or race, answering
+        // only the clients in Race ahead of another server on the LAN
+        Mode      string        `yaml:"mode"`
+        // PoolStart and PoolEnd bound the v4 range, derived from the LAN
+        // CIDR when empty
+        PoolStart string        `yaml:"pool_start"`
+        PoolEnd   string        `yaml:"pool_end"`
+        LeaseTime time.Duration `yaml:"lease_time"`
+        // Netmask handed to clients, the LAN CIDR's mask when empty
+        Netmask   string        `yaml:"netmask"`
+        Reservations []Reservation `yaml:"reservations"`
+        // Options go to every client; class and reservation options
+        // override them, in that order
+        Options []DHCPOption  `yaml:"options"`
+        Classes []ClientClass `yaml:"classes"`
+        Leases struct {
+            // Store is file (SQLite on disk) or memory for diskless running
+            Store    string `yaml:"store"`
+            // File is the lease database used by the file store
+            File     string `yaml:"file"`
+            // Snapshot is loaded at start and written on shutdown by the
+            // memory store; empty keeps leases purely in memory
+            Snapshot string `yaml:"snapshot"`
+            // Database is an SQLite file recording every DHCP message and
+            // binding seen on the LAN; empty disables lease history
+            Database string `yaml:"database"`
+        } `yaml:"leases"`
+        // Hooks consume lease changes; they need the lease database
+        Hooks []LeaseHook `yaml:"hooks"`
+        // Fingerprints is a JSON file of extra client fingerprints checked
+        // ahead of the built-in database
+        Fingerprints string `yaml:"fingerprints"`
+        // V6 is stateful DHCPv6, served when the LAN has an IPv6 prefix
+        V6 struct {
+            // PoolStart and PoolEnd bound the IA_NA range, ::1000-::1fff
+            // of the LAN prefix when empty
+            PoolStart string        `yaml:"pool_start"`
+            PoolEnd   string        `yaml:"pool_end"`
+            // LeaseTime is the valid lifetime, dhcp.lease_time when zero
+            LeaseTime time.Duration `yaml:"lease_time"`
+            // PrefixDelegation hands Length-sized prefixes out of Pool to
+            // downstream routers; an empty pool disables IA_PD
+            PrefixDelegation struct {
+                Pool   string `yaml:"pool"`
+                Length int    `yaml:"length"`
+            } `yaml:"prefix_delegation"`
+        } `yaml:"v6"`
+        // Rogue watches the LAN for other DHCP servers
+        Rogue struct {
+            Enabled  bool          `yaml:"enabled"`
+            // Interval between DISCOVER/SOLICIT probes; zero only listens
+            Interval time.Duration `yaml:"interval"`
+            // Allow lists MACs or IPs of servers that belong on the LAN
+            Allow    []string      `yaml:"allow"`
+        } `yaml:"rogue"`
+        // Guard protects the pool from starvation by abusive clients
+        Guard struct {
+            Enabled      bool          `yaml:"enabled"`
+            // Rate and Burst limit requests per second from each client
+            // (MAC or DHCPv6 DUID), which is quarantined for going over,
+            // and from each relay port (option 82 circuit id) or, without
+            // one, MACs sharing their first PrefixLength bytes, whose
+            // requests are only dropped
+            Rate         float64       `yaml:"rate"`
+            Burst        int           `yaml:"burst"`
+            PrefixLength int           `yaml:"prefix_length"`
+            // MaxLeases caps the MACs one client identifier may hold
+            // leases for, and the DHCPv6 identity associations one DUID
+            // may hold; zero means no cap
+            MaxLeases    int           `yaml:"max_leases"`
+            // Quarantine is how long an offending client is ignored
+            Quarantine   time.Duration `yaml:"quarantine"`
+            // Alarm raises an error once the pool is this percent used;
+            // zero disables it
+            Alarm        int           `yaml:"alarm"`
+        } `yaml:"guard"`
+        // Conflict probes addresses with ARP or neighbour solicitation
+        // before they are offered, skipping any a device already uses.
+        // Only the memory lease store can step around such an address, so
+        // enabling it with the default file store is a startup error.
+        Conflict struct {
+            Enabled bool          `yaml:"enabled"`
+            // Timeout is how long to wait for an answer to a probe
+            Timeout time.Duration `yaml:"timeout"`
+            // Hold is how long a conflicting address stays unused
+            Hold    time.Duration `yaml:"hold"`
+        } `yaml:"conflict"`
+        // Relay lists the upstream servers used in relay mode
+        Relay struct {
+            // Servers and Servers6 are DHCPv4 and DHCPv6 server addresses
+            Servers   []string `yaml:"servers"`
+            Servers6  []string `yaml:"servers6"`
+            // CircuitID and RemoteID go in option 82, and CircuitID in the
+            // DHCPv6 Interface-ID; CircuitID defaults to the LAN interface
+            // and an empty RemoteID is left out
+            CircuitID string   `yaml:"circuit_id"`
+            RemoteID  string   `yaml:"remote_id"`
+        } `yaml:"relay"`
+        // Race scopes race mode, for authorized assessments
+        Race struct {
+            // Targets are the MACs answered; every other client is left to
+            // the other server
+            Targets []string `yaml:"targets"`
+            // Mirror hands targets the other server's subnet parameters,
+            // learned from its replies, so they keep working on the LAN
+            Mirror  bool     `yaml:"mirror"`
+        } `yaml:"race"`
+    } `yaml:"dhcp"`
+    // WPAD serves a PAC file from the LAN IPv4 address, which it needs
+    WPAD struct {
+        Enabled  bool     `yaml:"enabled"`
+        // Domain limits DNS answers to wpad.<domain>; empty answers any wpad.* name
+        Domain   string   `yaml:"domain"`
+        // Proxy is the host:port browsers are steered to, default <lan ip>:8080
+        Proxy    string   `yaml:"proxy"`
+        // Bypass lists host patterns or CIDRs that go DIRECT
+        Bypass   []string `yaml:"bypass"`
+        // Template is a text/template PAC file, the built-in one when empty
+        Template string   `yaml:"template"`
+        Port     int      `yaml:"port"`
+    } `yaml:"wpad"`
+    // RA is the IPv6 router advertisement sender on the LAN
+    RA struct {
+        Enabled    bool          `yaml:"enabled"`
+        // Interval is the longest gap between unsolicited advertisements
+        Interval   time.Duration `yaml:"interval"`
+        // Lifetime is how long clients keep krouter as default router
+        Lifetime   time.Duration `yaml:"lifetime"`
+        // Managed and Other set the M and O flags, sending clients to
+        // DHCPv6 for addresses and for other configuration
+        Managed    bool          `yaml:"managed"`
+        Other      bool          `yaml:"other"`
+        // Autonomous sets the prefix A flag so clients may use SLAAC
+        Autonomous bool          `yaml:"autonomous"`
+        // DNSSL lists search domains advertised alongside krouter as
+        // resolver
+        DNSSL      []string      `yaml:"dnssl"`
+        // MTU is advertised when set
+        MTU        int           `yaml:"mtu"`
+    } `yaml:"ra"`
+    // PXE netboots LAN clients from Root over TFTP and HTTP
+    PXE struct {
+        Enabled  bool   `yaml:"enabled"`
+        // Root is the directory served, read-only
+        Root     string `yaml:"root"`
+        // TFTPPort must stay 69 when DHCP hands out the boot files, as
+        // PXE firmware has no way to learn another port
+        TFTPPort int    `yaml:"tftp_port"`
+        HTTPPort int    `yaml:"http_port"`
+        // Boot files under Root by client firmware; an empty one leaves
+        // those clients alone
+        BIOS     string `yaml:"bios"`
+        UEFI     string `yaml:"uefi"`   // x86-64
+        UEFI32   string `yaml:"uefi32"` // IA32
+        ARM64    string `yaml:"arm64"`
+        // IPXE goes to clients already running iPXE so they fetch a
+        // script instead of chainloading iPXE again; a file under Root or
+        // a full URL
+        IPXE     string `yaml:"ipxe"`
+    } `yaml:"pxe"`
+    // Logging configures the structured logger services write to
+    Logging utils.Config `yaml:"logging"`
 }
 
 func Load(configPath string) (*Config, error) {
@@ -50,13 +379,24 @@ func Load(configPath string) (*Config, error) {
         }
 
         var config Config
-        if err := v.Unmarshal(&config); err != nil {
+        // decode using the yaml tags so multi-word keys like local_domains map
+        if err := v.Unmarshal(&config, func(dc *mapstructure.DecoderConfig) {
+                dc.TagName = "yaml"
+        }); err != nil {
                 return nil, fmt.Errorf("parsing config: %w", err)
         }
 
         return &config, nil
 }
 
+// DefaultDNSChain returns the query pipeline used when dns.chain is unset
+func DefaultDNSChain() []string {
+        return []string{
+                "stats", "faults", "ttl", "dnssec", "local", "blocklist",
+                "rewrite", "cache", "replay", "forward",
+        }
+}
+
 func setDefaults(v *viper.Viper) {
         v.SetDefault("interfaces.lan.iface", "eth0")
         v.SetDefault("interfaces.wan", "eth1")
@@ -78,6 +418,83 @@ func setDefaults(v *viper.Viper) {
                         "ipv6": []string{"fd00::2"},
                 },
         })
+
+        // Answer TTLs
+        v.SetDefault("dns.ttl.local", 300)
+        v.SetDefault("dns.ttl.low_ttl", 5)
+
+        // Record/replay archive
+        v.SetDefault("dns.archive.mode", "off")
+        v.SetDefault("dns.archive.path", "dns-archive.jsonl")
+        v.SetDefault("dns.archive.miss", "nxdomain")
+
+        // LAN name responders
+        v.SetDefault("dns.responders.ttl", 30)
+
+        // Query statistics
+        v.SetDefault("dns.stats.enabled", true)
+        v.SetDefault("dns.stats.bucket", "1m")
+        v.SetDefault("dns.stats.retention", "24h")
+
+        // Query pipeline
+        v.SetDefault("dns.chain", DefaultDNSChain())
+        v.SetDefault("dns.cache.enabled", true)
+        v.SetDefault("dns.cache.size", 10000)
+        v.SetDefault("dns.blocklist.action", "nxdomain")
+
+        // DNSSEC
+        v.SetDefault("dns.dnssec.mode", "preserve")
+        v.SetDefault("dns.dnssec.exempt_local", true)
+
+        // DHCP pool; addresses default to the LAN subnet
+        v.SetDefault("dhcp.mode", "server")
+        v.SetDefault("dhcp.lease_time", "1h")
+        v.SetDefault("dhcp.leases.store", "file")
+        v.SetDefault("dhcp.leases.file", "leases4.txt")
+        v.SetDefault("dhcp.v6.prefix_delegation.length", 56)
+        v.SetDefault("dhcp.rogue.enabled", true)
+        v.SetDefault("dhcp.rogue.interval", "5m")
+        v.SetDefault("dhcp.guard.enabled", true)
+        v.SetDefault("dhcp.guard.rate", 5)
+        v.SetDefault("dhcp.guard.burst", 20)
+        v.SetDefault("dhcp.guard.prefix_length", 3)
+        v.SetDefault("dhcp.guard.max_leases", 4)
+        v.SetDefault("dhcp.guard.quarantine", "10m")
+        v.SetDefault("dhcp.guard.alarm", 90)
+        v.SetDefault("dhcp.conflict.enabled", false)
+        v.SetDefault("dhcp.conflict.timeout", "500ms")
+        v.SetDefault("dhcp.conflict.hold", "1h")
+        v.SetDefault("dhcp.race.mirror", true)
+
+        // WPAD auto-proxy discovery
+        v.SetDefault("wpad.port", 80)
+        v.SetDefault("wpad.bypass", []string{"localhost", "127.0.0.1"})
+
+        // router advertisements, sent when the LAN has an IPv6 prefix
+        v.SetDefault("ra.enabled", true)
+        v.SetDefault("ra.interval", "200s")
+        v.SetDefault("ra.lifetime", "30m")
+        v.SetDefault("ra.managed", true)
+        v.SetDefault("ra.other", true)
+        v.SetDefault("ra.autonomous", true)
+
+        // PXE netboot
+        v.SetDefault("pxe.root", "/srv/tftp")
+        v.SetDefault("pxe.tftp_port", 69)
+        v.SetDefault("pxe.http_port", 8069)
+        v.SetDefault("pxe.bios", "undionly.kpxe")
+        v.SetDefault("pxe.uefi", "ipxe.efi")
+        v.SetDefault("pxe.ipxe", "boot.ipxe")
+
+        // structured logging
+        logging := utils.DefaultConfig()
+        v.SetDefault("logging.level", logging.LogLevel)
+        v.SetDefault("logging.outputs", logging.Outputs)
+        v.SetDefault("logging.file_location", logging.FileLocation)
+        v.SetDefault("logging.max_size", logging.MaxSize)
+        v.SetDefault("logging.max_backups", logging.MaxBackups)
+        v.SetDefault("logging.max_age", logging.MaxAge)
+        v.SetDefault("logging.compress", logging.Compress)
 }
 
 func (c *Config) Display() {
@@ -98,4 +515,107 @@ func (c *Config) Display() {
                 fmt.Printf("      IPv4: %v\n", domain.IPv4)
                 fmt.Printf("      IPv6: %v\n", domain.IPv6)
         }
+
+        fmt.Println("  TTL Policy:")
+        fmt.Printf("    Local: %d\n", c.DNS.TTL.Local)
+        fmt.Printf("    Min/Max: %d/%d\n", c.DNS.TTL.Min, c.DNS.TTL.Max)
+        fmt.Printf("    Low TTL Mode: %v (%d)\n", c.DNS.TTL.LowTTLMode, c.DNS.TTL.LowTTL)
+
+        fmt.Printf("  Fault Injection: %v\n", c.DNS.Faults.Enabled)
+        for _, rule := range c.DNS.Faults.Rules {
+                fmt.Printf("    %s: domains=%v clients=%v disabled=%v\n",
+                        rule.Name, rule.Domains, rule.Clients, rule.Disabled)
+        }
+
+        fmt.Printf("  Archive: %s (%s, miss=%s)\n",
+                c.DNS.Archive.Mode, c.DNS.Archive.Path, c.DNS.Archive.Miss)
+
+        fmt.Printf("  Responders: llmnr=%v nbns=%v mdns=%v poison rules=%d\n",
+                c.DNS.Responders.LLMNR, c.DNS.Responders.NBNS, c.DNS.Responders.MDNS,
+                len(c.DNS.Responders.Poison))
+
+        fmt.Printf("  Stats: %v (bucket=%v retention=%v)\n",
+                c.DNS.Stats.Enabled, c.DNS.Stats.Bucket, c.DNS.Stats.Retention)
+        fmt.Printf("  Chain: %v\n", c.DNS.Chain)
+        fmt.Printf("  Cache: %v (size=%d)\n", c.DNS.Cache.Enabled, c.DNS.Cache.Size)
+        fmt.Printf("  Blocklist: %d domains, %d files (%s)\n",
+                len(c.DNS.Blocklist.Domains), len(c.DNS.Blocklist.Files), c.DNS.Blocklist.Action)
+        fmt.Printf("  DNSSEC: %s (exempt local=%v)\n", c.DNS.DNSSEC.Mode, c.DNS.DNSSEC.ExemptLocal)
+        for _, rw := range c.DNS.Rewrites {
+                fmt.Printf("  Rewrite: %s -> %s\n", rw.From, rw.To)
+        }
+
+        fmt.Println("\nDHCP:")
+        fmt.Printf("  Mode: %s\n", c.DHCP.Mode)
+        if c.DHCP.Mode == "relay" {
+                fmt.Printf("  Relay: v4 %v, v6 %v, circuit id %s\n",
+                        c.DHCP.Relay.Servers, c.DHCP.Relay.Servers6, displayOr(c.DHCP.Relay.CircuitID, c.Interfaces.LAN.Iface))
+        }
+        if c.DHCP.Mode == "race" {
+                fmt.Printf("  Race: targets %v, mirror %v\n", c.DHCP.Race.Targets, c.DHCP.Race.Mirror)
+        }
+        fmt.Printf("  Pool: %s - %s\n", displayOr(c.DHCP.PoolStart, "auto"), displayOr(c.DHCP.PoolEnd, "auto"))
+        fmt.Printf("  Netmask: %s\n", displayOr(c.DHCP.Netmask, "auto"))
+        fmt.Printf("  Lease Time: %v\n", c.DHCP.LeaseTime)
+        fmt.Printf("  Lease Store: %s (file=%s snapshot=%s)\n",
+                c.DHCP.Leases.Store, c.DHCP.Leases.File, displayOr(c.DHCP.Leases.Snapshot, "none"))
+        fmt.Printf("  Lease History: %s\n", displayOr(c.DHCP.Leases.Database, "disabled"))
+        fmt.Printf("  Options: %d pool, %d classes\n", len(c.DHCP.Options), len(c.DHCP.Classes))
+        fmt.Printf("  Fingerprints: %s\n", displayOr(c.DHCP.Fingerprints, "built-in"))
+        fmt.Printf("  IPv6 Pool: %s - %s\n", displayOr(c.DHCP.V6.PoolStart, "auto"), displayOr(c.DHCP.V6.PoolEnd, "auto"))
+        if c.DHCP.V6.PrefixDelegation.Pool != "" {
+                fmt.Printf("  Prefix Delegation: /%d from %s\n",
+                        c.DHCP.V6.PrefixDelegation.Length, c.DHCP.V6.PrefixDelegation.Pool)
+        }
+        fmt.Printf("  Rogue Detection: %v (probe every %v, allow %v)\n",
+                c.DHCP.Rogue.Enabled, c.DHCP.Rogue.Interval, c.DHCP.Rogue.Allow)
+        if g := c.DHCP.Guard; g.Enabled {
+                fmt.Printf("  Guard: %.1f req/s burst %d per /%d MAC prefix, %d leases per client id, quarantine %v, alarm at %d%%\n",
+                        g.Rate, g.Burst, g.PrefixLength*8, g.MaxLeases, g.Quarantine, g.Alarm)
+        }
+        fmt.Printf("  Conflict Probing: %v (timeout %v, hold %v)\n",
+                c.DHCP.Conflict.Enabled, c.DHCP.Conflict.Timeout, c.DHCP.Conflict.Hold)
+        for _, h := range c.DHCP.Hooks {
+                fmt.Printf("  Lease Hook: %s %s %v\n", h.Type, h.Target, h.Events)
+        }
+        for _, r := range c.DHCP.Reservations {
+                fmt.Printf("  Reservation: %s -> %s %s (%s)\n", r.MAC, r.IPv4, r.IPv6, r.Hostname)
+        }
+
+        fmt.Println("\nWPAD:")
+        fmt.Printf("  Enabled: %v\n", c.WPAD.Enabled)
+        fmt.Printf("  Proxy: %s\n", c.WPAD.Proxy)
+        fmt.Printf("  Bypass: %v\n", c.WPAD.Bypass)
+
+        fmt.Println("\nRouter Advertisements:")
+        fmt.Printf("  Enabled: %v (every %v, lifetime %v)\n", c.RA.Enabled, c.RA.Interval, c.RA.Lifetime)
+        fmt.Printf("  Flags: managed=%v other=%v autonomous=%v\n", c.RA.Managed, c.RA.Other, c.RA.Autonomous)
+        fmt.Printf("  DNSSL: %v\n", c.RA.DNSSL)
+
+        fmt.Println("\nPXE:")
+        fmt.Printf("  Enabled: %v (root %s, tftp port %d, http port %d)\n",
+                c.PXE.Enabled, c.PXE.Root, c.PXE.TFTPPort, c.PXE.HTTPPort)
+        fmt.Printf("  Boot Files: bios=%s uefi=%s uefi32=%s arm64=%s ipxe=%s\n",
+                displayOr(c.PXE.BIOS, "none"), displayOr(c.PXE.UEFI, "none"), displayOr(c.PXE.UEFI32, "none"),
+                displayOr(c.PXE.ARM64, "none"), displayOr(c.PXE.IPXE, "none"))
+
+        fmt.Println("\nLogging:")
+        fmt.Printf("  Level: %s, outputs %v (file %s)\n", c.Logging.LogLevel, c.Logging.Outputs, c.Logging.FileLocation)
+}
+
+// HostIP parses an address that may carry a prefix length, as the
+// interface addresses do, returning nil when it is not an address
+func HostIP(addr string) net.IP {
+        if ip, _, err := net.ParseCIDR(addr); err == nil {
+                return ip
+        }
+        return net.ParseIP(addr)
+}
+
+// displayOr shows def for unset values
+func displayOr(v, def string) string {
+        if v == "" {
+                return def
+        }
+        return v
 }
@@ -0,0 +1,239 @@
+package dhcp
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+    "time"
+
+    "golang.org/x/sys/unix"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// maxConflictProbes bounds how many candidates one request may probe, so a
+// LAN full of static hosts cannot stall the server
+const maxConflictProbes = 3
+
+// conflict is an address found in use by a device without a lease
+type conflict struct {
+    mac   net.HardwareAddr
+    until time.Time
+}
+
+// prober checks addresses are free on the LAN before they are handed out,
+// with an RFC 5227 ARP probe for IPv4 and a DAD-style neighbour
+// solicitation for IPv6. Only krouter's own allocators use it, since they
+// can move on to another address when one is taken.
+type prober struct {
+    iface   *net.Interface
+    timeout time.Duration
+    hold    time.Duration
+
+    mu        sync.Mutex
+    conflicts map[string]conflict // IP -> holder
+}
+
+func newProber(cfg *krouter.Config) (*prober, error) {
+    cc := cfg.DHCP.Conflict
+    if cc.Timeout <= 0 || cc.Timeout > 5*time.Second {
+        return nil, fmt.Errorf("conflict probe timeout %v must be between 0s and 5s", cc.Timeout)
+    }
+    if cc.Hold < 0 {
+        return nil, fmt.Errorf("conflict hold %v cannot be negative", cc.Hold)
+    }
+    iface, err := net.InterfaceByName(cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get interface: %w", err)
+    }
+    return &prober{
+        iface:     iface,
+        timeout:   cc.Timeout,
+        hold:      cc.Hold,
+        conflicts: make(map[string]conflict),
+    }, nil
+}
+
+// adopt keeps prev's conflicts still on hold
+func (p *prober) adopt(prev *prober) {
+    prev.mu.Lock()
+    defer prev.mu.Unlock()
+    now := time.Now()
+    for ip, c := range prev.conflicts {
+        if now.Before(c.until) {
+            p.conflicts[ip] = c
+        }
+    }
+}
+
+// held reports whether ip is still on hold from an earlier conflict
+func (p *prober) held(ip net.IP, now time.Time) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    c, ok := p.conflicts[ip.String()]
+    if ok && now.After(c.until) {
+        delete(p.conflicts, ip.String())
+        return false
+    }
+    return ok
+}
+
+// usable probes ip, answering false when a device other than owner, the
+// client it is meant for, already uses it. A probe that cannot be sent
+// counts as no answer, so a broken probe never empties the pool.
+func (p *prober) usable(ip net.IP, owner net.HardwareAddr) bool {
+    now := time.Now()
+    if p.held(ip, now) {
+        return false
+    }
+
+    var mac net.HardwareAddr
+    var err error
+    if ip4 := ip.To4(); ip4 != nil {
+        mac, err = p.arp(ip4, owner)
+    } else {
+        mac, err = p.solicit(ip, owner)
+    }
+    if err != nil {
+        log.Warnw("conflict probe failed", "ip", ip, "error", err)
+        return true
+    }
+    if mac == nil {
+        return true
+    }
+
+    p.mu.Lock()
+    p.conflicts[ip.String()] = conflict{mac: mac, until: now.Add(p.hold)}
+    p.mu.Unlock()
+    log.Warnw("address already in use, holding it back", "ip", ip, "mac", mac, "hold", p.hold)
+    return false
+}
+
+// arp sends an ARP probe for ip and returns the MAC of whoever claims it
+func (p *prober) arp(ip net.IP, owner net.HardwareAddr) (net.HardwareAddr, error) {
+    fd, err := p.open(unix.ETH_P_ARP)
+    if err != nil {
+        return nil, err
+    }
+    defer unix.Close(fd)
+
+    // a probe has a zero sender address so no neighbour cache learns it
+    req := make([]byte, 28)
+    binary.BigEndian.PutUint16(req[0:], 1) // Ethernet
+    binary.BigEndian.PutUint16(req[2:], unix.ETH_P_IP)
+    req[4], req[5] = 6, 4
+    binary.BigEndian.PutUint16(req[6:], 1) // request
+    copy(req[8:14], p.iface.HardwareAddr)
+    copy(req[24:28], ip)
+    if err := p.send(fd, req, unix.ETH_P_ARP, broadcastMAC); err != nil {
+        return nil, fmt.Errorf("sending ARP probe: %w", err)
+    }
+
+    return p.await(fd, owner, func(b []byte, _ net.HardwareAddr) net.HardwareAddr {
+        // a reply, or a request from a host announcing the address
+        if len(b) < 28 || binary.BigEndian.Uint16(b[2:]) != unix.ETH_P_IP || !net.IP(b[14:18]).Equal(ip) {
+            return nil
+        }
+        return net.HardwareAddr(append([]byte{}, b[8:14]...))
+    })
+}
+
+// solicit sends a neighbour solicitation for ip from the unspecified
+// address, as duplicate address detection does, and returns the MAC of
+// whoever advertises it
+func (p *prober) solicit(ip net.IP, owner net.HardwareAddr) (net.HardwareAddr, error) {
+    fd, err := p.open(unix.ETH_P_IPV6)
+    if err != nil {
+        return nil, err
+    }
+    defer unix.Close(fd)
+
+    ip16 := ip.To16()
+    group := net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, ip16[13], ip16[14], ip16[15]}
+    groupMAC := net.HardwareAddr{0x33, 0x33, 0xff, ip16[13], ip16[14], ip16[15]}
+
+    ns := make([]byte, 24)
+    ns[0] = 135 // neighbour solicitation
+    copy(ns[8:], ip16)
+    frame := ip6Frame(net.IPv6unspecified, group, unix.IPPROTO_ICMPV6, 255, ns, 2)
+    if err := p.send(fd, frame, unix.ETH_P_IPV6, groupMAC); err != nil {
+        return nil, fmt.Errorf("sending neighbour solicitation: %w", err)
+    }
+
+    return p.await(fd, owner, func(b []byte, src net.HardwareAddr) net.HardwareAddr {
+        // a neighbour advertisement for the target
+        if len(b) < 64 || b[6] != unix.IPPROTO_ICMPV6 || b[40] != 136 || !net.IP(b[48:64]).Equal(ip16) {
+            return nil
+        }
+        return src
+    })
+}
+
+// open returns a packet socket for proto bound to the LAN interface
+func (p *prober) open(proto uint16) (int, error) {
+    fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(proto)))
+    if err != nil {
+        return -1, fmt.Errorf("failed to open probe socket: %w", err)
+    }
+    sll := &unix.SockaddrLinklayer{Protocol: htons(proto), Ifindex: p.iface.Index}
+    if err := unix.Bind(fd, sll); err != nil {
+        unix.Close(fd)
+        return -1, fmt.Errorf("failed to bind probe socket to %s: %w", p.iface.Name, err)
+    }
+    return fd, nil
+}
+
+func (p *prober) send(fd int, frame []byte, proto uint16, dst net.HardwareAddr) error {
+    sll := &unix.SockaddrLinklayer{
+        Protocol: htons(proto),
+        Ifindex:  p.iface.Index,
+        Halen:    uint8(len(dst)),
+    }
+    copy(sll.Addr[:], dst)
+    return unix.Sendto(fd, frame, 0, sll)
+}
+
+// await reads packets until match, given each one and its link-layer
+// source, names a MAC other than ours or owner's, or the probe times out
+func (p *prober) await(fd int, owner net.HardwareAddr, match func([]byte, net.HardwareAddr) net.HardwareAddr) (net.HardwareAddr, error) {
+    buf := make([]byte, 1500)
+    deadline := time.Now().Add(p.timeout)
+    for {
+        left := time.Until(deadline)
+        if left <= 0 {
+            return nil, nil
+        }
+        fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+        n, err := unix.Poll(fds, int(left/time.Millisecond)+1)
+        if errors.Is(err, unix.EINTR) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        if n == 0 {
+            return nil, nil
+        }
+        n, from, err := unix.Recvfrom(fd, buf, unix.MSG_DONTWAIT)
+        if err != nil {
+            if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+                continue
+            }
+            return nil, err
+        }
+        sll, ok := from.(*unix.SockaddrLinklayer)
+        if !ok || sll.Pkttype == unix.PACKET_OUTGOING {
+            continue
+        }
+        mac := match(buf[:n], net.HardwareAddr(sll.Addr[:sll.Halen]))
+        if mac == nil {
+            continue
+        }
+        if mac.String() == owner.String() || mac.String() == p.iface.HardwareAddr.String() {
+            continue
+        }
+        return mac, nil
+    }
+}
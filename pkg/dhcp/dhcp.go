@@ -1,10 +1,9 @@
 package dhcp
 
-//TODO - overload the coredhcp logging to use our own
 import (
     "context"
-    "strings"
-    "log"
+    "errors"
+    "time"
     "fmt"
     "sync"
     "net"
@@ -30,6 +29,9 @@ import (
 
 
     krouter "github.com/ryanvillarreal/krouter/pkg/config"
+    "github.com/ryanvillarreal/krouter/pkg/pxe"
+    "github.com/ryanvillarreal/krouter/pkg/utils"
+    "github.com/ryanvillarreal/krouter/pkg/wpad"
 )
 
 var desiredPlugins = []*plugins.Plugin{
@@ -48,6 +50,35 @@ var desiredPlugins = []*plugins.Plugin{
 	&pl_serverid.Plugin,
 	&pl_sleep.Plugin,
 	&pl_staticroute.Plugin,
+	&wpadPlugin,
+	&reservationsPlugin,
+	&leasesPlugin,
+	&fingerprintPlugin,
+	&optionsPlugin,
+	&leases6Plugin,
+	&guardPlugin,
+	&pxePlugin,
+	&racePlugin,
+}
+
+var (
+    registerOnce sync.Once
+    registerErr  error
+)
+
+// registerPlugins hands desiredPlugins to coredhcp. Its registry is
+// process-wide and rejects a second registration, so this runs once no
+// matter how often services start.
+func registerPlugins() error {
+    registerOnce.Do(func() {
+        for _, plugin := range desiredPlugins {
+            if err := plugins.RegisterPlugin(plugin); err != nil {
+                registerErr = fmt.Errorf("failed to register plugin '%s': %w", plugin.Name, err)
+                return
+            }
+        }
+    })
+    return registerErr
 }
 
 type Service struct {
@@ -59,32 +90,49 @@ type Service struct {
     // coredhcp server
     servers  *cd_server.Servers
     errChan  chan error
+    // instance ids handed to krouter plugins, by plugin name
+    instances map[string]string
+    // in-memory lease table, memory store only
+    leases   *leaseStore
+    // DHCPv6 bindings, nil without a LAN IPv6 prefix
+    leases6  *leaseStore6
+    // stateMu guards the state a Start publishes and Stop retires, which
+    // the accessors read from other goroutines: devices through history
+    stateMu  sync.RWMutex
+    // client fingerprints
+    devices  *fingerprinter
+    // other DHCP servers seen on the LAN
+    rogues   *rogueDetector
+    // starvation protection, nil when disabled
+    guard    *guard
+    // conflict detection, nil when disabled
+    probe    *prober
+    // upstream forwarding, set instead of servers in relay mode
+    relay    *relay
+    // target scoping and capture records, race mode only
+    race     *racer
+    // lease history, fed by sniffing the LAN, and its change stream
+    history  *leaseDB
+    changes  *leaseBroker
+    // per-packet logging, kept across restarts
+    debugMu   sync.Mutex
+    debug     bool
+    stopDebug context.CancelFunc
 }
 
-func NewDHCPService(cfg *krouter.Config) *Service {
-    ctx, cancel := context.WithCancel(context.Background())
+// NewDHCPService creates the DHCP service. Its logs, and coredhcp's, go to
+// logger tagged subsystem=dhcp; a nil logger keeps the default one.
+func NewDHCPService(cfg *krouter.Config, logger *utils.Logger) *Service {
+    if logger != nil {
+        setLogger(logger)
+    }
     return &Service{
-        ctx:     ctx,
-        cancel:  cancel,
         cfg:     cfg,
         errChan: make(chan error, 1),
+        changes: newLeaseBroker(),
     }
 }
 
-// formatDNSAddress formats an IP address for DNS configuration
-func formatDNSAddress(addr string) string {
-    ip := stripNetmask(addr)
-    return fmt.Sprintf("%s:53", ip)
-}
-
-// stripNetmask removes CIDR notation from IP address
-func stripNetmask(addr string) string {
-    if idx := strings.Index(addr, "/"); idx != -1 {
-        return addr[:idx]
-    }
-    return addr
-}
-
 
 func getMACAddress(ifaceName string) (string, error) {
     iface, err := net.InterfaceByName(ifaceName)
@@ -94,29 +142,21 @@ func getMACAddress(ifaceName string) (string, error) {
     return iface.HardwareAddr.String(), nil
 }
 
-func (s *Service) buildCoreDHCPConfig() *cd_config.Config {
+func (s *Service) buildCoreDHCPConfig(pool *pool4) (*cd_config.Config, error) {
     
     mac, err := getMACAddress(s.cfg.Interfaces.LAN.Iface)
     if err != nil {
-        return nil
+        return nil, fmt.Errorf("LAN interface %s: %w", s.cfg.Interfaces.LAN.Iface, err)
     }
 
     conf := cd_config.New()
     
     // Configure DHCPv6 Server
-    fmt.Println("Configuring dhcpv6 server")
-
-    // Format DNS addresses
-    dnsv6 := formatDNSAddress(s.cfg.Interfaces.LAN.IPv6)
-    dnsv4 := formatDNSAddress(s.cfg.Interfaces.LAN.IPv4)
-
-    fmt.Println(dnsv4)
-    // register plugins
-	  for _, plugin := range desiredPlugins {
-		  if err := plugins.RegisterPlugin(plugin); err != nil {
-			  log.Fatalf("Failed to register plugin '%s': %v", plugin.Name, err)
-		  }
-	  }
+    log.Debugw("configuring DHCPv6 server")
+
+    // we are the resolver
+    dnsv6 := krouter.HostIP(s.cfg.Interfaces.LAN.IPv6).String()
+
     conf.Server6 = &cd_config.ServerConfig{
         Addresses: []net.UDPAddr{{
             IP:   net.IPv6unspecified,
@@ -136,7 +176,7 @@ func (s *Service) buildCoreDHCPConfig() *cd_config.Config {
         },
     }
     
-    fmt.Println("Configuring dhcpv4 server")
+    log.Debugw("configuring DHCPv4 server")
     // Configure DHCPv4 Server
     conf.Server4 = &cd_config.ServerConfig{
         Addresses: []net.UDPAddr{{
@@ -145,54 +185,358 @@ func (s *Service) buildCoreDHCPConfig() *cd_config.Config {
             Zone: s.cfg.Interfaces.LAN.Iface,
         }},
         Plugins: []cd_config.PluginConfig{
+            {
+                // early, so every request is seen before anything answers
+                Name: "fingerprint",
+                Args: []string{s.instances["fingerprint"]},
+            },
             {
                 Name: "lease_time",
-                Args: []string{"3600s"},
+                Args: []string{pool.leaseTime.String()},
             },
             {
                 Name: "server_id",
-                Args: []string{stripNetmask(s.cfg.Interfaces.LAN.IPv4)},
+                Args: []string{krouter.HostIP(s.cfg.Interfaces.LAN.IPv4).String()},
             },
             {
                 Name: "dns",
-                Args: []string{stripNetmask(s.cfg.Interfaces.LAN.IPv4)},
+                Args: []string{krouter.HostIP(s.cfg.Interfaces.LAN.IPv4).String()},
             },
             {
                 Name: "router",
-                Args: []string{stripNetmask(s.cfg.Interfaces.LAN.IPv4)},
+                Args: []string{pool.router.String()},
             },
             {
                 Name: "netmask",
-                Args: []string{"255.255.255.0"},
-            },
-            {
-                Name: "range",
-                Args: []string{
-                    "leases4.txt",
-                    "192.168.52.10",
-                    "192.168.52.250",
-                    "3600s",
-                },
+                Args: []string{pool.netmask.String()},
             },
         },
     }
-    return conf
+    if id, ok := s.instances["race"]; ok {
+        // after the parameters the rival's replace, ahead of everything
+        // that adds to them; non-targets go no further
+        conf.Server4.Plugins = append(conf.Server4.Plugins, cd_config.PluginConfig{
+            Name: "race",
+            Args: []string{id},
+        })
+    }
+    if id, ok := s.instances["guard"]; ok {
+        // ahead of everything, so dropped floods leave no trace
+        guard := cd_config.PluginConfig{Name: "guard", Args: []string{id}}
+        conf.Server4.Plugins = append([]cd_config.PluginConfig{guard}, conf.Server4.Plugins...)
+        conf.Server6.Plugins = append([]cd_config.PluginConfig{guard}, conf.Server6.Plugins...)
+    }
+
+    // range fills in its own address and lease time, so anything that
+    // sets options or pins addresses goes ahead of it
+    if s.cfg.WPAD.Enabled {
+        url, err := wpad.URL(s.cfg)
+        if err != nil {
+            return nil, err
+        }
+        conf.Server4.Plugins = append(conf.Server4.Plugins, cd_config.PluginConfig{
+            Name: "wpad",
+            Args: []string{url},
+        })
+    }
+    if id, ok := s.instances["pxe"]; ok {
+        // ahead of options, so class and reservation options can point a
+        // client elsewhere
+        conf.Server4.Plugins = append(conf.Server4.Plugins, cd_config.PluginConfig{
+            Name: "pxe",
+            Args: []string{id},
+        })
+    }
+    if id, ok := s.instances["options"]; ok {
+        options := cd_config.PluginConfig{Name: "options", Args: []string{id}}
+        conf.Server4.Plugins = append(conf.Server4.Plugins, options)
+        conf.Server6.Plugins = append(conf.Server6.Plugins, options)
+    }
+    if len(s.cfg.DHCP.Reservations) > 0 {
+        var args []string
+        for _, r := range s.cfg.DHCP.Reservations {
+            args = append(args, reservationArg(r))
+        }
+        reservations := cd_config.PluginConfig{Name: "reservations", Args: args}
+        conf.Server4.Plugins = append(conf.Server4.Plugins, reservations)
+        conf.Server6.Plugins = append(conf.Server6.Plugins, reservations)
+    }
+    if id, ok := s.instances["leases6"]; ok {
+        conf.Server6.Plugins = append(conf.Server6.Plugins, cd_config.PluginConfig{
+            Name: "leases6",
+            Args: []string{id},
+        })
+    }
+    if s.cfg.PXE.Enabled && s.cfg.PXE.UEFI != "" && s.cfg.Interfaces.LAN.IPv6 != "" {
+        // DHCPv6 netboot is UEFI only. nbp ends the chain, so it goes last.
+        conf.Server6.Plugins = append(conf.Server6.Plugins, cd_config.PluginConfig{
+            Name: "nbp",
+            Args: []string{pxe.TFTPURL6(s.cfg, s.cfg.PXE.UEFI)},
+        })
+    }
+    if id, ok := s.instances["race"]; ok && s.cfg.DHCP.Race.Mirror {
+        // reservations still win, but the rival's address for a target
+        // beats one from the pool
+        conf.Server4.Plugins = append(conf.Server4.Plugins, cd_config.PluginConfig{
+            Name: "race",
+            Args: []string{id, "pin"},
+        })
+    }
+    if id, ok := s.instances["leases"]; ok {
+        conf.Server4.Plugins = append(conf.Server4.Plugins, cd_config.PluginConfig{
+            Name: "leases",
+            Args: []string{id},
+        })
+    } else {
+        conf.Server4.Plugins = append(conf.Server4.Plugins, cd_config.PluginConfig{
+            Name: "range",
+            Args: []string{
+                s.cfg.DHCP.Leases.File,
+                pool.start.String(),
+                pool.end.String(),
+                pool.leaseTime.String(),
+            },
+        })
+    }
+    switch {
+    case s.cfg.Interfaces.LAN.IPv6 == "":
+        // no address to offer as the resolver, and nothing to lease
+        conf.Server6 = nil
+    case s.cfg.DHCP.Mode == modeRace:
+        // DHCPv6 clients are not scoped to targets, so v6 stays quiet
+        conf.Server6 = nil
+    }
+    return conf, nil
+}
+
+// setup is everything Start derives from a config before it touches the
+// network, so a bad config is caught while the old one still runs
+type setup struct {
+    pool    *pool4
+    pool6   *pool6
+    devices *fingerprinter
+    options *optionSet
+    hooks   []*leaseHook
+    guard   *guard
+    probe   *prober
+    boot    *bootMenu
+    race    *racer
+    // relay is set in relay mode, which needs nothing else but devices
+    // and hooks
+    relay   *relay
+}
+
+func newSetup(cfg *krouter.Config) (*setup, error) {
+    st := &setup{}
+    var err error
+    if st.devices, err = newFingerprinter(cfg.DHCP.Fingerprints); err != nil {
+        return nil, fmt.Errorf("failed to load DHCP fingerprints: %w", err)
+    }
+    if len(cfg.DHCP.Hooks) > 0 && cfg.DHCP.Leases.Database == "" {
+        return nil, errors.New("DHCP lease hooks need dhcp.leases.database")
+    }
+    for _, hc := range cfg.DHCP.Hooks {
+        h, err := newLeaseHook(hc)
+        if err != nil {
+            return nil, err
+        }
+        st.hooks = append(st.hooks, h)
+    }
+    switch cfg.DHCP.Mode {
+    case modeRelay:
+        if st.relay, err = newRelay(cfg); err != nil {
+            return nil, fmt.Errorf("invalid DHCP relay: %w", err)
+        }
+        return st, nil
+    case modeRace:
+        if st.race, err = newRacer(cfg); err != nil {
+            return nil, fmt.Errorf("invalid DHCP race mode: %w", err)
+        }
+    case "", modeServer:
+    default:
+        return nil, fmt.Errorf("unknown DHCP mode %q", cfg.DHCP.Mode)
+    }
+
+    if st.pool, err = newPool4(cfg); err != nil {
+        return nil, fmt.Errorf("invalid DHCP pool: %w", err)
+    }
+    if err := validateReservations(st.pool, cfg.DHCP.Reservations); err != nil {
+        return nil, fmt.Errorf("invalid DHCP reservation: %w", err)
+    }
+    if st.race == nil {
+        if st.pool6, err = newPool6(cfg); err != nil {
+            return nil, fmt.Errorf("invalid DHCPv6 pool: %w", err)
+        }
+    }
+    if st.options, err = newOptionSet(cfg, st.devices); err != nil {
+        return nil, fmt.Errorf("invalid DHCP options: %w", err)
+    }
+    switch cfg.DHCP.Leases.Store {
+    case "", leaseStoreFile, leaseStoreMemory:
+    default:
+        return nil, fmt.Errorf("unknown DHCP lease store %q", cfg.DHCP.Leases.Store)
+    }
+    if cfg.DHCP.Guard.Enabled {
+        if st.guard, err = newGuard(cfg, st.pool); err != nil {
+            return nil, fmt.Errorf("invalid DHCP guard: %w", err)
+        }
+    }
+    // probing costs the race the time it is won in
+    if cfg.DHCP.Conflict.Enabled && st.race == nil {
+        // coredhcp's range plugin keeps handing a client the same address,
+        // so it cannot step around one found in use
+        if cfg.DHCP.Leases.Store != leaseStoreMemory {
+            return nil, errors.New("conflict detection needs dhcp.leases.store: memory")
+        }
+        if st.probe, err = newProber(cfg); err != nil {
+            return nil, fmt.Errorf("invalid conflict detection: %w", err)
+        }
+    }
+    if cfg.PXE.Enabled {
+        if st.boot, err = newBootMenu(cfg); err != nil {
+            return nil, fmt.Errorf("invalid PXE boot files: %w", err)
+        }
+    }
+    return st, nil
+}
+
+// running reports whether the service is serving or relaying
+func (s *Service) running() bool {
+    return s.servers != nil || s.relay != nil
 }
 
+// Start serves DHCP on the LAN, or relays it in relay mode. A service may
+// be started again after Stop; leases held in memory, DHCPv6 bindings and
+// known devices carry over to the new run.
 func (s *Service) Start() error {
-    dhcpConfig := s.buildCoreDHCPConfig()
-    fmt.Println("launching dhcp server")
+    if s.running() {
+        return errors.New("DHCP service is already running")
+    }
+    if err := registerPlugins(); err != nil {
+        return err
+    }
+    st, err := newSetup(s.cfg)
+    if err != nil {
+        return err
+    }
+    if st.relay != nil {
+        return s.startRelay(st)
+    }
+    pool := st.pool
+    log.Infow("DHCPv4 pool", "start", pool.start, "end", pool.end,
+        "netmask", pool.netmask, "router", pool.router, "lease", pool.leaseTime)
+
+    // state is only swapped in once the servers run, so a failed start
+    // leaves the previous run's state for the next attempt
+    devices := st.devices
+    if s.devices != nil {
+        devices.adopt(s.devices)
+    }
+    s.register("fingerprint", devices)
+    if !st.options.empty() {
+        s.register("options", st.options)
+    }
+    if st.guard != nil {
+        if s.guard != nil {
+            st.guard.adopt(s.guard)
+        }
+        s.register("guard", st.guard)
+    }
+    if st.boot != nil {
+        s.register("pxe", st.boot)
+    }
+    if st.probe != nil && s.probe != nil {
+        st.probe.adopt(s.probe)
+    }
+    if st.race != nil {
+        if s.race != nil {
+            st.race.adopt(s.race)
+        }
+        s.register("race", st.race)
+    }
+
+    var leases6 *leaseStore6
+    if pool6 := st.pool6; pool6 != nil {
+        if leases6, err = newLeaseStore6(pool6, s.cfg.Interfaces.LAN.Iface, s.leases6, st.probe); err != nil {
+            s.unregisterAll()
+            return fmt.Errorf("failed to create DHCPv6 lease store: %w", err)
+        }
+        s.register("leases6", leases6)
+        log.Infow("DHCPv6 pool", "start", pool6.start, "end", pool6.end, "lease", pool6.leaseTime)
+        if pool6.pd != nil {
+            log.Infow("DHCPv6 prefix delegation", "pool", pool6.pd, "length", pool6.pdLength)
+        }
+    }
+
+    var leases *leaseStore
+    if s.cfg.DHCP.Leases.Store == leaseStoreMemory {
+        if leases, err = newLeaseStore(pool, s.cfg.DHCP.Leases.Snapshot, s.leases, st.probe); err != nil {
+            s.unregisterAll()
+            return fmt.Errorf("failed to create lease store: %w", err)
+        }
+        s.register("leases", leases)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    s.ctx, s.cancel = ctx, cancel
+
+    // undo unwinds a failed start
+    undo := func() {
+        cancel()
+        s.wg.Wait()
+        s.closeHistory()
+        if leases6 != nil {
+            leases6.close()
+        }
+        s.unregisterAll()
+    }
+
+    dhcpConfig, err := s.buildCoreDHCPConfig(pool)
+    if err != nil {
+        undo()
+        return fmt.Errorf("failed to configure DHCP server: %w", err)
+    }
+    log.Debugw("launching DHCP server")
     servers, err := cd_server.Start(dhcpConfig)
     if err != nil {
+        undo()
         return fmt.Errorf("failed to start DHCP server: %w", err)
     }
-    fmt.Println("successful")
+    log.Infow("DHCP server started")
+
+    if err := s.startHistory(pool.router, st.hooks); err != nil {
+        servers.Close()
+        undo()
+        return err
+    }
+    if s.cfg.DHCP.Rogue.Enabled {
+        if err := s.startRogueDetector(); err != nil {
+            servers.Close()
+            undo()
+            return err
+        }
+    }
+    if st.race != nil {
+        if err := s.startRace(st.race); err != nil {
+            servers.Close()
+            undo()
+            return err
+        }
+    }
     s.servers = servers
+    s.stateMu.Lock()
+    s.devices, s.leases, s.leases6 = devices, leases, leases6
+    s.guard, s.probe, s.race = st.guard, st.probe, st.race
+    s.stateMu.Unlock()
+    if st.guard != nil {
+        s.startGuard(pool, st.guard)
+    }
 
     s.wg.Add(1)
     go func() {
         defer s.wg.Done()
-        if err := servers.Wait(); err != nil {
+        // closing the servers on Stop ends Wait with an error too
+        if err := servers.Wait(); err != nil && ctx.Err() == nil {
             select {
             case s.errChan <- err:
             default:
@@ -200,15 +544,448 @@ func (s *Service) Start() error {
         }
     }()
 
+    if leases6 != nil {
+        s.wg.Add(1)
+        go func() {
+            defer s.wg.Done()
+            ticker := time.NewTicker(leaseSweepInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ctx.Done():
+                    return
+                case now := <-ticker.C:
+                    leases6.expire(now)
+                }
+            }
+        }()
+    }
+    s.resumePacketLog()
+
     return nil
 }
 
+// Stop shuts the servers down. In-memory state is kept for a later Start.
 func (s *Service) Stop() {
+    if s.cancel != nil {
+        s.cancel()
+    }
+    s.stopPacketLog()
     if s.servers != nil {
         s.servers.Close()
+        s.servers = nil
+    }
+    if s.relay != nil {
+        s.relay.close()
+        s.relay = nil
     }
-    s.cancel()
     s.wg.Wait()
+
+    if err := s.closeHistory(); err != nil {
+        log.Errorw("failed to close lease database", "error", err)
+    }
+    if s.leases6 != nil {
+        s.leases6.close()
+    }
+    if s.leases != nil {
+        if err := s.leases.save(); err != nil {
+            log.Errorw("failed to save leases", "error", err)
+        }
+    }
+    s.unregisterAll()
+}
+
+// Reload switches a running service to cfg, so a new pool, options or
+// reservations apply without restarting krouter. An invalid cfg is
+// rejected before anything stops, and the previous config is brought back
+// if the new servers fail to start.
+func (s *Service) Reload(cfg *krouter.Config) error {
+    if _, err := newSetup(cfg); err != nil {
+        return err
+    }
+    if !s.running() {
+        s.cfg = cfg
+        return nil
+    }
+
+    prev := s.cfg
+    s.Stop()
+    s.cfg = cfg
+    if err := s.Start(); err != nil {
+        s.cfg = prev
+        if rerr := s.Start(); rerr != nil {
+            return fmt.Errorf("%w; restarting with the previous config also failed: %v", err, rerr)
+        }
+        return err
+    }
+    log.Infow("DHCP service reloaded")
+    return nil
+}
+
+// register hands v to the named krouter plugin
+func (s *Service) register(plugin string, v interface{}) {
+    if s.instances == nil {
+        s.instances = make(map[string]string)
+    }
+    s.instances[plugin] = registerInstance(v)
+}
+
+// closeHistory closes the lease database once no accessor is reading it
+func (s *Service) closeHistory() error {
+    s.stateMu.Lock()
+    defer s.stateMu.Unlock()
+    if s.history == nil {
+        return nil
+    }
+    err := s.history.close()
+    s.history = nil
+    return err
+}
+
+func (s *Service) unregisterAll() {
+    for plugin, id := range s.instances {
+        unregisterInstance(id)
+        delete(s.instances, plugin)
+    }
+}
+
+// Device returns what is known about the client behind mac
+func (s *Service) Device(mac net.HardwareAddr) (Device, bool) {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.devices == nil {
+        return Device{}, false
+    }
+    return s.devices.device(mac)
+}
+
+// Devices returns every client seen since start, ordered by MAC
+func (s *Service) Devices() []Device {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.devices == nil {
+        return nil
+    }
+    return s.devices.all()
+}
+
+// leaseSweepInterval is how often lapsed leases are reported as expired
+const leaseSweepInterval = 30 * time.Second
+
+// startHistory opens the lease database and starts sniffing the LAN into
+// it, feeding hooks from the change stream. Only ACKs from serverID make
+// bindings, or from any server when it is nil.
+func (s *Service) startHistory(serverID net.IP, hooks []*leaseHook) error {
+    path := s.cfg.DHCP.Leases.Database
+    if path == "" {
+        return nil
+    }
+
+    history, err := openLeaseDB(path, serverID, s.changes)
+    if err != nil {
+        return err
+    }
+    sn, err := newSniffer(s.cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        history.close()
+        return fmt.Errorf("failed to start DHCP sniffer: %w", err)
+    }
+    s.stateMu.Lock()
+    s.history = history
+    s.stateMu.Unlock()
+
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        defer sn.close()
+        if err := sn.run(s.ctx, history.observe); err != nil {
+            select {
+            case s.errChan <- err:
+            default:
+            }
+        }
+    }()
+
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        ticker := time.NewTicker(leaseSweepInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.ctx.Done():
+                return
+            case now := <-ticker.C:
+                if err := history.expire(now); err != nil {
+                    log.Errorw("failed to expire leases", "error", err)
+                }
+            }
+        }
+    }()
+
+    for _, h := range hooks {
+        changes, unsubscribe := s.changes.subscribe()
+        s.wg.Add(1)
+        go func(h *leaseHook) {
+            defer s.wg.Done()
+            defer unsubscribe()
+            h.run(s.ctx, changes)
+        }(h)
+    }
+    return nil
+}
+
+// startRelay forwards clients to the upstream servers instead of answering
+// them. Fingerprinting, lease history and rogue detection run as they do
+// for the server.
+func (s *Service) startRelay(st *setup) error {
+    r := st.relay
+    devices := st.devices
+    if s.devices != nil {
+        devices.adopt(s.devices)
+    }
+    r.devices = devices
+    if err := r.open(); err != nil {
+        return fmt.Errorf("failed to start DHCP relay: %w", err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    s.ctx, s.cancel = ctx, cancel
+    undo := func() {
+        cancel()
+        r.close()
+        s.wg.Wait()
+        s.closeHistory()
+    }
+
+    // the upstream servers' ACKs are the bindings worth recording
+    if err := s.startHistory(nil, st.hooks); err != nil {
+        undo()
+        return err
+    }
+    if s.cfg.DHCP.Rogue.Enabled {
+        if err := s.startRogueDetector(); err != nil {
+            undo()
+            return err
+        }
+    }
+    s.stateMu.Lock()
+    s.relay, s.devices = r, devices
+    s.stateMu.Unlock()
+    r.start(&s.wg, func(err error) {
+        select {
+        case s.errChan <- err:
+        default:
+        }
+    })
+    s.resumePacketLog()
+    return nil
+}
+
+// startRogueDetector sniffs the LAN for other DHCP servers' replies and,
+// when an interval is set, probes for them
+func (s *Service) startRogueDetector() error {
+    report := func(err error) {
+        select {
+        case s.errChan <- err:
+        default:
+        }
+    }
+    d, err := newRogueDetector(s.cfg, report)
+    if err != nil {
+        return fmt.Errorf("failed to start rogue DHCP detection: %w", err)
+    }
+    sn, err := newSniffer(s.cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        d.close()
+        return fmt.Errorf("failed to start rogue DHCP detection: %w", err)
+    }
+    if s.rogues != nil {
+        d.adopt(s.rogues)
+    }
+    s.stateMu.Lock()
+    s.rogues = d
+    s.stateMu.Unlock()
+
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        defer sn.close()
+        if err := sn.run(s.ctx, d.observe); err != nil {
+            report(err)
+        }
+    }()
+
+    interval := s.cfg.DHCP.Rogue.Interval
+    if interval <= 0 {
+        return nil
+    }
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        defer d.close()
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            if err := d.probe(); err != nil {
+                log.Warnw("rogue DHCP probe failed", "error", err)
+            }
+            select {
+            case <-s.ctx.Done():
+                return
+            case <-ticker.C:
+            }
+        }
+    }()
+    return nil
+}
+
+// startRace sniffs the LAN so the racer learns the rival's parameters and
+// sees the ACKs that capture targets
+func (s *Service) startRace(r *racer) error {
+    sn, err := newSniffer(s.cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        return fmt.Errorf("failed to start DHCP race mode: %w", err)
+    }
+    log.Infow("race mode answering targets only", "targets", len(r.targets), "mirror", r.mirror)
+
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        defer sn.close()
+        if err := sn.run(s.ctx, r.observe); err != nil {
+            select {
+            case s.errChan <- err:
+            default:
+            }
+        }
+    }()
+    return nil
+}
+
+// startGuard keeps the guard's tables trim and watches pool utilisation
+func (s *Service) startGuard(pool *pool4, g *guard) {
+    usage := &utilisation{pool: pool, alarm: s.cfg.DHCP.Guard.Alarm}
+    leases := s.leases
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        ticker := time.NewTicker(leaseSweepInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.ctx.Done():
+                return
+            case now := <-ticker.C:
+                g.sweep(now)
+                if usage.alarm == 0 {
+                    continue
+                }
+                used, ok := s.poolUsage(pool, leases, now)
+                if !ok {
+                    continue
+                }
+                if err := usage.check(used); err != nil {
+                    log.Warnw("pool utilisation alarm", "error", err)
+                    select {
+                    case s.errChan <- err:
+                    default:
+                    }
+                }
+            }
+        }
+    }()
+}
+
+// poolUsage counts pool addresses held by clients, from the memory store
+// or else the lease history; false when neither is available
+func (s *Service) poolUsage(pool *pool4, leases *leaseStore, now time.Time) (int, bool) {
+    if leases != nil {
+        return leases.held(now), true
+    }
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.history == nil {
+        return 0, false
+    }
+    active, err := s.history.active()
+    if err != nil {
+        log.Errorw("failed to read active leases", "error", err)
+        return 0, false
+    }
+    start, end := ip4ToUint(pool.start), ip4ToUint(pool.end)
+    used := 0
+    for _, l := range active {
+        if ip := l.IP.To4(); ip != nil && ip4ToUint(ip) >= start && ip4ToUint(ip) <= end {
+            used++
+        }
+    }
+    return used, true
+}
+
+// Quarantined returns the MACs, and "duid <hex>" DHCPv6 clients, the guard
+// is ignoring and until when
+func (s *Service) Quarantined() map[string]time.Time {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.guard == nil {
+        return nil
+    }
+    return s.guard.quarantinedMACs()
+}
+
+// Captured returns the targets race mode has captured, first captured
+// first
+func (s *Service) Captured() []Capture {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.race == nil {
+        return nil
+    }
+    return s.race.all()
+}
+
+// RogueServers returns the other DHCP servers seen on the LAN, oldest
+// first
+func (s *Service) RogueServers() []RogueServer {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.rogues == nil {
+        return nil
+    }
+    return s.rogues.all()
+}
+
+// Subscribe returns a channel of lease changes and a function that ends
+// the subscription. Changes are dropped, never queued without bound, when
+// the subscriber falls behind. The lease database is what notices changes,
+// so without one there is nothing to subscribe to.
+func (s *Service) Subscribe() (<-chan LeaseChange, func(), error) {
+    if s.cfg.DHCP.Leases.Database == "" {
+        return nil, nil, ErrLeaseDBDisabled
+    }
+    changes, unsubscribe := s.changes.subscribe()
+    return changes, unsubscribe, nil
+}
+
+// ActiveLeases returns the DHCPv4 bindings currently held by clients
+func (s *Service) ActiveLeases() ([]Lease, error) {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.history == nil {
+        return nil, ErrLeaseDBDisabled
+    }
+    return s.history.active()
+}
+
+// LeaseHistory returns every DHCPv4 message seen for mac, oldest first
+func (s *Service) LeaseHistory(mac net.HardwareAddr) ([]LeaseEvent, error) {
+    s.stateMu.RLock()
+    defer s.stateMu.RUnlock()
+    if s.history == nil {
+        return nil, ErrLeaseDBDisabled
+    }
+    return s.history.history(mac)
 }
 
 func (s *Service) Errors() <-chan error {
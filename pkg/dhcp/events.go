@@ -0,0 +1,69 @@
+package dhcp
+
+import (
+    "sync"
+    "time"
+)
+
+// LeaseChangeKind says what happened to a lease
+type LeaseChangeKind string
+
+const (
+    LeaseNew      LeaseChangeKind = "new"
+    LeaseRenewed  LeaseChangeKind = "renewed"
+    LeaseReleased LeaseChangeKind = "released"
+    LeaseExpired  LeaseChangeKind = "expired"
+    LeaseDeclined LeaseChangeKind = "declined"
+)
+
+// LeaseChange is published whenever a client's binding changes
+type LeaseChange struct {
+    Kind  LeaseChangeKind
+    Time  time.Time
+    Lease Lease
+}
+
+// subscriberBuffer is how many changes a slow subscriber may fall behind
+// before changes are dropped for it
+const subscriberBuffer = 64
+
+// leaseBroker fans lease changes out to subscribers without ever blocking
+// the sniffer that produces them
+type leaseBroker struct {
+    mu   sync.Mutex
+    subs map[chan LeaseChange]struct{}
+}
+
+func newLeaseBroker() *leaseBroker {
+    return &leaseBroker{subs: make(map[chan LeaseChange]struct{})}
+}
+
+func (b *leaseBroker) subscribe() (<-chan LeaseChange, func()) {
+    ch := make(chan LeaseChange, subscriberBuffer)
+    b.mu.Lock()
+    b.subs[ch] = struct{}{}
+    b.mu.Unlock()
+
+    var once sync.Once
+    return ch, func() {
+        once.Do(func() {
+            b.mu.Lock()
+            delete(b.subs, ch)
+            b.mu.Unlock()
+            close(ch)
+        })
+    }
+}
+
+func (b *leaseBroker) publish(c LeaseChange) {
+    log.Infow("lease changed", "event", c.Kind, "mac", c.Lease.MAC, "ip", c.Lease.IP, "hostname", c.Lease.Hostname)
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for ch := range b.subs {
+        select {
+        case ch <- c:
+        default:
+            log.Warnw("dropping lease event, subscriber is full", "event", c.Kind, "mac", c.Lease.MAC)
+        }
+    }
+}
@@ -0,0 +1,263 @@
+package dhcp
+
+import (
+    _ "embed"
+    "encoding/json"
+    "fmt"
+    "net"
+    "os"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+//go:embed fingerprints.json
+var embeddedFingerprints []byte
+
+// fingerprintPlugin classifies DHCPv4 clients from what they ask for. It
+// never answers on its own. Its argument is the id of a registered
+// *fingerprinter.
+var fingerprintPlugin = plugins.Plugin{
+    Name:   "fingerprint",
+    Setup4: setupFingerprint4,
+}
+
+// Device is krouter's best guess at what a client is
+type Device struct {
+    MAC         net.HardwareAddr
+    Hostname    string
+    VendorClass string
+    // ParamList is the option 55 parameter request list, in client order
+    ParamList   []uint8
+    // Device, OS and Type come from the best matching fingerprint and are
+    // empty when nothing matched
+    Device      string
+    OS          string
+    Type        string
+    FirstSeen   time.Time
+    LastSeen    time.Time
+}
+
+// fingerprint is one database entry. Every field set must match; the
+// parameter list is compared exactly, vendor class and hostname are
+// case-insensitive regular expressions.
+type fingerprint struct {
+    Device   string `json:"device"`
+    OS       string `json:"os"`
+    Type     string `json:"type"`
+    PRL      string `json:"prl"`
+    Vendor   string `json:"vendor"`
+    Hostname string `json:"hostname"`
+
+    vendor   *regexp.Regexp
+    hostname *regexp.Regexp
+}
+
+// a parameter list is far more specific than a vendor class, which beats a
+// hostname pattern
+const (
+    scorePRL      = 4
+    scoreVendor   = 2
+    scoreHostname = 1
+)
+
+func (f *fingerprint) score(prl, vendor, hostname string) int {
+    score := 0
+    if f.PRL != "" {
+        if f.PRL != prl {
+            return 0
+        }
+        score += scorePRL
+    }
+    if f.vendor != nil {
+        if !f.vendor.MatchString(vendor) {
+            return 0
+        }
+        score += scoreVendor
+    }
+    if f.hostname != nil {
+        if !f.hostname.MatchString(hostname) {
+            return 0
+        }
+        score += scoreHostname
+    }
+    return score
+}
+
+// parseFingerprints loads a JSON fingerprint list
+func parseFingerprints(data []byte, source string) ([]*fingerprint, error) {
+    var fps []*fingerprint
+    if err := json.Unmarshal(data, &fps); err != nil {
+        return nil, fmt.Errorf("parsing fingerprints %s: %w", source, err)
+    }
+    for i, f := range fps {
+        if f.PRL == "" && f.Vendor == "" && f.Hostname == "" {
+            return nil, fmt.Errorf("fingerprint %d in %s matches nothing", i, source)
+        }
+        f.PRL = normalizePRL(f.PRL)
+        var err error
+        if f.Vendor != "" {
+            if f.vendor, err = regexp.Compile("(?i)" + f.Vendor); err != nil {
+                return nil, fmt.Errorf("fingerprint %d in %s: %w", i, source, err)
+            }
+        }
+        if f.Hostname != "" {
+            if f.hostname, err = regexp.Compile("(?i)" + f.Hostname); err != nil {
+                return nil, fmt.Errorf("fingerprint %d in %s: %w", i, source, err)
+            }
+        }
+    }
+    return fps, nil
+}
+
+func normalizePRL(s string) string {
+    var codes []string
+    for _, part := range strings.Split(s, ",") {
+        if part = strings.TrimSpace(part); part != "" {
+            codes = append(codes, part)
+        }
+    }
+    return strings.Join(codes, ",")
+}
+
+// fingerprinter keeps the device seen behind every MAC
+type fingerprinter struct {
+    db      []*fingerprint
+    mu      sync.RWMutex
+    devices map[string]*Device
+}
+
+// newFingerprinter loads the embedded database, with entries from path, if
+// given, taking precedence on equal scores
+func newFingerprinter(path string) (*fingerprinter, error) {
+    db, err := parseFingerprints(embeddedFingerprints, "(embedded)")
+    if err != nil {
+        return nil, err
+    }
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("reading fingerprints: %w", err)
+        }
+        local, err := parseFingerprints(data, path)
+        if err != nil {
+            return nil, err
+        }
+        db = append(local, db...)
+    }
+    return &fingerprinter{db: db, devices: make(map[string]*Device)}, nil
+}
+
+// classify returns the best matching fingerprint, or nil
+func (fp *fingerprinter) classify(prl []uint8, vendor, hostname string) *fingerprint {
+    codes := make([]string, len(prl))
+    for i, c := range prl {
+        codes[i] = strconv.Itoa(int(c))
+    }
+    key := strings.Join(codes, ",")
+
+    var best *fingerprint
+    bestScore := 0
+    for _, f := range fp.db {
+        if score := f.score(key, vendor, hostname); score > bestScore {
+            best, bestScore = f, score
+        }
+    }
+    return best
+}
+
+// observe4 records the client behind a DHCPv4 request
+func (fp *fingerprinter) observe4(req *dhcpv4.DHCPv4) {
+    var prl []uint8
+    for _, code := range req.ParameterRequestList() {
+        prl = append(prl, code.Code())
+    }
+    hostname, vendor := req.HostName(), req.ClassIdentifier()
+    match := fp.classify(prl, vendor, hostname)
+
+    mac := req.ClientHWAddr.String()
+    now := time.Now()
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+
+    d, ok := fp.devices[mac]
+    if !ok {
+        d = &Device{MAC: append(net.HardwareAddr{}, req.ClientHWAddr...), FirstSeen: now}
+        fp.devices[mac] = d
+    }
+    d.LastSeen = now
+    if hostname != "" {
+        d.Hostname = hostname
+    }
+    if vendor != "" {
+        d.VendorClass = vendor
+    }
+    if len(prl) > 0 {
+        d.ParamList = prl
+    }
+
+    if match != nil && match.Device != d.Device {
+        log.Infow("fingerprinted client", "mac", mac, "hostname", d.Hostname,
+            "device", match.Device, "os", match.OS, "type", match.Type)
+        d.Device, d.OS, d.Type = match.Device, match.OS, match.Type
+    } else if match == nil && !ok {
+        log.Infow("unknown fingerprint", "mac", mac, "hostname", hostname,
+            "prl", prl, "vendor", vendor)
+    }
+}
+
+// adopt takes over the devices prev has seen, so a reload keeps them
+func (fp *fingerprinter) adopt(prev *fingerprinter) {
+    prev.mu.RLock()
+    defer prev.mu.RUnlock()
+    fp.mu.Lock()
+    defer fp.mu.Unlock()
+    for mac, d := range prev.devices {
+        fp.devices[mac] = d
+    }
+}
+
+func (fp *fingerprinter) device(mac net.HardwareAddr) (Device, bool) {
+    fp.mu.RLock()
+    defer fp.mu.RUnlock()
+    d, ok := fp.devices[mac.String()]
+    if !ok {
+        return Device{}, false
+    }
+    return *d, true
+}
+
+func (fp *fingerprinter) all() []Device {
+    fp.mu.RLock()
+    devices := make([]Device, 0, len(fp.devices))
+    for _, d := range fp.devices {
+        devices = append(devices, *d)
+    }
+    fp.mu.RUnlock()
+    sort.Slice(devices, func(i, j int) bool {
+        return devices[i].MAC.String() < devices[j].MAC.String()
+    })
+    return devices
+}
+
+func setupFingerprint4(args ...string) (handler.Handler4, error) {
+    v, err := lookupInstance("fingerprint", args)
+    if err != nil {
+        return nil, err
+    }
+    fp, ok := v.(*fingerprinter)
+    if !ok {
+        return nil, fmt.Errorf("fingerprint: instance %q is not a fingerprinter", args[0])
+    }
+    return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+        fp.observe4(req)
+        return resp, false
+    }, nil
+}
@@ -0,0 +1,369 @@
+package dhcp
+
+import (
+    "fmt"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// guardPlugin drops DHCPv4 and DHCPv6 requests from clients flooding the
+// server or hoarding leases. Its argument is the id of a registered *guard.
+var guardPlugin = plugins.Plugin{
+    Name:   "guard",
+    Setup4: setupGuard4,
+    Setup6: setupGuard6,
+}
+
+// alarmHysteresis is how far, in percent, utilisation must fall below the
+// alarm level before the alarm clears, so a pool hovering at the
+// threshold does not flap
+const alarmHysteresis = 5
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+type guard struct {
+    rate       float64
+    burst      float64
+    prefixLen  int
+    maxLeases  int
+    quarantine time.Duration
+    // window is how long a MAC counts against its client identifier
+    window     time.Duration
+    // exempt holds reserved MACs, never limited
+    exempt     map[string]bool
+
+    mu          sync.Mutex
+    buckets     map[string]*tokenBucket       // client, port or MAC prefix
+    clientIDs   map[string]map[string]time.Time // client id -> MAC -> last request
+    ias         map[string]map[string]time.Time // DUID -> IA -> last request
+    quarantined map[string]time.Time          // MAC or DUID -> until
+}
+
+func newGuard(cfg *krouter.Config, pool *pool4) (*guard, error) {
+    gc := cfg.DHCP.Guard
+    if gc.Rate <= 0 || gc.Burst < 1 {
+        return nil, fmt.Errorf("guard rate %v and burst %d must be positive", gc.Rate, gc.Burst)
+    }
+    if gc.PrefixLength < 1 || gc.PrefixLength > 6 {
+        return nil, fmt.Errorf("guard prefix_length %d must be 1 to 6 bytes", gc.PrefixLength)
+    }
+    if gc.MaxLeases < 0 || gc.Quarantine < 0 {
+        return nil, fmt.Errorf("guard max_leases and quarantine cannot be negative")
+    }
+    if gc.Alarm < 0 || gc.Alarm > 100 {
+        return nil, fmt.Errorf("guard alarm %d is not a percentage", gc.Alarm)
+    }
+
+    g := &guard{
+        rate:        gc.Rate,
+        burst:       float64(gc.Burst),
+        prefixLen:   gc.PrefixLength,
+        maxLeases:   gc.MaxLeases,
+        quarantine:  gc.Quarantine,
+        window:      pool.leaseTime,
+        exempt:      make(map[string]bool),
+        buckets:     make(map[string]*tokenBucket),
+        clientIDs:   make(map[string]map[string]time.Time),
+        ias:         make(map[string]map[string]time.Time),
+        quarantined: make(map[string]time.Time),
+    }
+    for _, r := range cfg.DHCP.Reservations {
+        if mac, err := net.ParseMAC(r.MAC); err == nil {
+            g.exempt[mac.String()] = true
+        }
+    }
+    return g, nil
+}
+
+// adopt keeps prev's quarantines, so a reload is no way out of one
+func (g *guard) adopt(prev *guard) {
+    prev.mu.Lock()
+    defer prev.mu.Unlock()
+    for mac, until := range prev.quarantined {
+        g.quarantined[mac] = until
+    }
+}
+
+// limitKey groups requests by the relay port they came in on or, failing
+// that, by MAC prefix
+func (g *guard) limitKey(req *dhcpv4.DHCPv4) string {
+    if rai := req.RelayAgentInfo(); rai != nil {
+        if circuit := rai.Get(dhcpv4.AgentCircuitIDSubOption); len(circuit) > 0 {
+            return fmt.Sprintf("port %q", circuit)
+        }
+    }
+    mac := req.ClientHWAddr
+    if len(mac) > g.prefixLen {
+        mac = mac[:g.prefixLen]
+    }
+    return "prefix " + mac.String()
+}
+
+// allow decides whether req is served, quarantining its MAC when it breaks
+// a limit of its own
+func (g *guard) allow(req *dhcpv4.DHCPv4, now time.Time) bool {
+    mac := req.ClientHWAddr.String()
+    if g.exempt[mac] {
+        return true
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    if g.isQuarantined(mac, now) || !g.take(mac, g.limitKey(req), now) {
+        return false
+    }
+
+    if cid := req.Options.Get(dhcpv4.OptionClientIdentifier); g.maxLeases > 0 && len(cid) > 0 {
+        macs, ok := g.clientIDs[string(cid)]
+        if !ok {
+            macs = make(map[string]time.Time)
+            g.clientIDs[string(cid)] = macs
+        }
+        for m, seen := range macs {
+            if now.Sub(seen) > g.window {
+                delete(macs, m)
+            }
+        }
+        if _, ok := macs[mac]; !ok && len(macs) >= g.maxLeases {
+            g.quarantineMAC(mac, now, fmt.Sprintf("client id %x already holds %d leases", cid, len(macs)))
+            return false
+        }
+        macs[mac] = now
+    }
+    return true
+}
+
+// isQuarantined reports whether client is still being ignored
+func (g *guard) isQuarantined(client string, now time.Time) bool {
+    until, ok := g.quarantined[client]
+    if !ok {
+        return false
+    }
+    if now.Before(until) {
+        return true
+    }
+    delete(g.quarantined, client)
+    return false
+}
+
+// take spends a token from client's own bucket and from the one it shares
+// with its port or MAC prefix. Emptying its own bucket gets the client
+// quarantined; an empty shared bucket only drops the request, since the
+// client asking is as likely a neighbour as the one flooding.
+func (g *guard) take(client, shared string, now time.Time) bool {
+    own := g.bucket("client "+client, now)
+    if own.tokens < 1 {
+        g.quarantineMAC(client, now, "rate limit exceeded")
+        return false
+    }
+    group := g.bucket(shared, now)
+    if group.tokens < 1 {
+        return false
+    }
+    own.tokens--
+    group.tokens--
+    return true
+}
+
+// bucket returns key's bucket refilled up to now
+func (g *guard) bucket(key string, now time.Time) *tokenBucket {
+    b, ok := g.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: g.burst, last: now}
+        g.buckets[key] = b
+    }
+    b.tokens += now.Sub(b.last).Seconds() * g.rate
+    if b.tokens > g.burst {
+        b.tokens = g.burst
+    }
+    b.last = now
+    return b
+}
+
+// allow6 is allow for DHCPv6, where the client is its DUID. A DUID may
+// hold at most maxLeases identity associations, so rotating IAIDs cannot
+// drain the address or prefix pool.
+func (g *guard) allow6(req dhcpv6.DHCPv6, now time.Time) bool {
+    msg, err := req.GetInnerMessage()
+    if err != nil {
+        return true
+    }
+    cid := msg.Options.ClientID()
+    if cid == nil {
+        return true
+    }
+    mac, _ := dhcpv6.ExtractMAC(req)
+    if mac != nil && g.exempt[mac.String()] {
+        return true
+    }
+    client := fmt.Sprintf("duid %x", cid.ToBytes())
+    shared := "dhcpv6"
+    if mac != nil {
+        if len(mac) > g.prefixLen {
+            mac = mac[:g.prefixLen]
+        }
+        shared = "prefix " + mac.String()
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    if g.isQuarantined(client, now) || !g.take(client, shared, now) {
+        return false
+    }
+
+    switch msg.MessageType {
+    case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest,
+        dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+    default:
+        return true
+    }
+    if g.maxLeases == 0 {
+        return true
+    }
+    held, ok := g.ias[client]
+    if !ok {
+        held = make(map[string]time.Time)
+        g.ias[client] = held
+    }
+    for ia, seen := range held {
+        if now.Sub(seen) > g.window {
+            delete(held, ia)
+        }
+    }
+    var asked []string
+    for _, ia := range msg.Options.IANA() {
+        asked = append(asked, fmt.Sprintf("na %x", ia.IaId))
+    }
+    for _, ia := range msg.Options.IAPD() {
+        asked = append(asked, fmt.Sprintf("pd %x", ia.IaId))
+    }
+    for _, ia := range asked {
+        if _, ok := held[ia]; !ok && len(held) >= g.maxLeases {
+            g.quarantineMAC(client, now, fmt.Sprintf("already holds %d identity associations", len(held)))
+            return false
+        }
+        held[ia] = now
+    }
+    return true
+}
+
+func (g *guard) quarantineMAC(mac string, now time.Time, reason string) {
+    if g.quarantine <= 0 {
+        return
+    }
+    g.quarantined[mac] = now.Add(g.quarantine)
+    log.Warnw("quarantining client", "mac", mac, "for", g.quarantine, "reason", reason)
+}
+
+// sweep forgets full buckets, lapsed quarantines and stale client ids
+func (g *guard) sweep(now time.Time) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    idle := time.Duration(g.burst / g.rate * float64(time.Second))
+    for key, b := range g.buckets {
+        if now.Sub(b.last) > idle {
+            delete(g.buckets, key)
+        }
+    }
+    for mac, until := range g.quarantined {
+        if now.After(until) {
+            delete(g.quarantined, mac)
+            log.Infow("client released from quarantine", "mac", mac)
+        }
+    }
+    for _, seen := range []map[string]map[string]time.Time{g.clientIDs, g.ias} {
+        for client, held := range seen {
+            for m, last := range held {
+                if now.Sub(last) > g.window {
+                    delete(held, m)
+                }
+            }
+            if len(held) == 0 {
+                delete(seen, client)
+            }
+        }
+    }
+}
+
+// quarantinedMACs returns the MACs, and DHCPv6 DUIDs, currently ignored
+// and until when
+func (g *guard) quarantinedMACs() map[string]time.Time {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    out := make(map[string]time.Time, len(g.quarantined))
+    for mac, until := range g.quarantined {
+        out[mac] = until
+    }
+    return out
+}
+
+func setupGuard4(args ...string) (handler.Handler4, error) {
+    v, err := lookupInstance("guard", args)
+    if err != nil {
+        return nil, err
+    }
+    g, ok := v.(*guard)
+    if !ok {
+        return nil, fmt.Errorf("guard: instance %q is not a guard", args[0])
+    }
+    return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+        if !g.allow(req, time.Now()) {
+            return nil, true
+        }
+        return resp, false
+    }, nil
+}
+
+func setupGuard6(args ...string) (handler.Handler6, error) {
+    v, err := lookupInstance("guard", args)
+    if err != nil {
+        return nil, err
+    }
+    g, ok := v.(*guard)
+    if !ok {
+        return nil, fmt.Errorf("guard: instance %q is not a guard", args[0])
+    }
+    return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+        if !g.allow6(req, time.Now()) {
+            return nil, true
+        }
+        return resp, false
+    }, nil
+}
+
+// utilisation tracks pool usage against the alarm level
+type utilisation struct {
+    pool    *pool4
+    alarm   int
+    alarmed bool
+}
+
+// check compares used addresses against the alarm level, returning an
+// error when the alarm goes off
+func (u *utilisation) check(used int) error {
+    size := int(ip4ToUint(u.pool.end) - ip4ToUint(u.pool.start) + 1)
+    pct := used * 100 / size
+    switch {
+    case !u.alarmed && pct >= u.alarm:
+        u.alarmed = true
+        return fmt.Errorf("DHCP pool %d%% used (%d of %d addresses)", pct, used, size)
+    case u.alarmed && pct < u.alarm-alarmHysteresis:
+        u.alarmed = false
+        log.Infow("pool utilisation back to normal", "percent", pct, "used", used, "size", size)
+    }
+    return nil
+}
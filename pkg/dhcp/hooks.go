@@ -0,0 +1,181 @@
+package dhcp
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "os/exec"
+    "time"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+const (
+    hookScript  = "script"
+    hookWebhook = "webhook"
+    hookJSONL   = "jsonl"
+
+    defaultHookTimeout = 10 * time.Second
+)
+
+// leaseChangeJSON is the payload sent to webhooks and JSONL files
+type leaseChangeJSON struct {
+    Event       LeaseChangeKind `json:"event"`
+    Time        time.Time       `json:"time"`
+    MAC         string          `json:"mac"`
+    IP          string          `json:"ip"`
+    Hostname    string          `json:"hostname,omitempty"`
+    VendorClass string          `json:"vendor_class,omitempty"`
+    Start       time.Time       `json:"start"`
+    Expires     time.Time       `json:"expires"`
+}
+
+func changeJSON(c LeaseChange) leaseChangeJSON {
+    return leaseChangeJSON{
+        Event:       c.Kind,
+        Time:        c.Time,
+        MAC:         c.Lease.MAC.String(),
+        IP:          ipString(c.Lease.IP),
+        Hostname:    c.Lease.Hostname,
+        VendorClass: c.Lease.VendorClass,
+        Start:       c.Lease.Start,
+        Expires:     c.Lease.Expires,
+    }
+}
+
+// leaseHook delivers lease changes to one configured consumer
+type leaseHook struct {
+    cfg     krouter.LeaseHook
+    events  map[LeaseChangeKind]bool // empty means every kind
+    timeout time.Duration
+    client  *http.Client
+}
+
+func newLeaseHook(cfg krouter.LeaseHook) (*leaseHook, error) {
+    switch cfg.Type {
+    case hookScript, hookWebhook, hookJSONL:
+    default:
+        return nil, fmt.Errorf("unknown lease hook type %q", cfg.Type)
+    }
+    if cfg.Target == "" {
+        return nil, fmt.Errorf("%s lease hook needs a target", cfg.Type)
+    }
+
+    h := &leaseHook{
+        cfg:     cfg,
+        events:  make(map[LeaseChangeKind]bool),
+        timeout: cfg.Timeout,
+    }
+    if h.timeout <= 0 {
+        h.timeout = defaultHookTimeout
+    }
+    for _, e := range cfg.Events {
+        switch kind := LeaseChangeKind(e); kind {
+        case LeaseNew, LeaseRenewed, LeaseReleased, LeaseExpired, LeaseDeclined:
+            h.events[kind] = true
+        default:
+            return nil, fmt.Errorf("%s lease hook: unknown event %q", cfg.Type, e)
+        }
+    }
+    if cfg.Type == hookWebhook {
+        h.client = &http.Client{Timeout: h.timeout}
+    }
+    return h, nil
+}
+
+// run consumes changes one at a time, so deliveries stay ordered, until
+// the subscription closes or ctx is done
+func (h *leaseHook) run(ctx context.Context, changes <-chan LeaseChange) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case c, ok := <-changes:
+            if !ok {
+                return
+            }
+            if len(h.events) > 0 && !h.events[c.Kind] {
+                continue
+            }
+            if err := h.deliver(ctx, c); err != nil {
+                log.Warnw("lease hook failed", "hook", h.cfg.Type, "target", h.cfg.Target,
+                    "event", c.Kind, "mac", c.Lease.MAC, "error", err)
+            }
+        }
+    }
+}
+
+func (h *leaseHook) deliver(ctx context.Context, c LeaseChange) error {
+    switch h.cfg.Type {
+    case hookScript:
+        return h.runScript(ctx, c)
+    case hookWebhook:
+        return h.post(ctx, c)
+    default:
+        return h.appendJSONL(c)
+    }
+}
+
+// runScript executes the target as "<script> <event> <mac> <ip> <hostname>"
+// with the lease also described in KROUTER_* environment variables
+func (h *leaseHook) runScript(ctx context.Context, c LeaseChange) error {
+    ctx, cancel := context.WithTimeout(ctx, h.timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, h.cfg.Target,
+        string(c.Kind), c.Lease.MAC.String(), ipString(c.Lease.IP), c.Lease.Hostname)
+    cmd.Env = append(os.Environ(),
+        "KROUTER_EVENT="+string(c.Kind),
+        "KROUTER_TIME="+c.Time.Format(time.RFC3339),
+        "KROUTER_MAC="+c.Lease.MAC.String(),
+        "KROUTER_IP="+ipString(c.Lease.IP),
+        "KROUTER_HOSTNAME="+c.Lease.Hostname,
+        "KROUTER_VENDOR_CLASS="+c.Lease.VendorClass,
+        "KROUTER_LEASE_START="+c.Lease.Start.Format(time.RFC3339),
+        "KROUTER_LEASE_EXPIRES="+c.Lease.Expires.Format(time.RFC3339),
+    )
+    if out, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+    }
+    return nil
+}
+
+func (h *leaseHook) post(ctx context.Context, c LeaseChange) error {
+    body, err := json.Marshal(changeJSON(c))
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.Target, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := h.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook returned %s", resp.Status)
+    }
+    return nil
+}
+
+func (h *leaseHook) appendJSONL(c LeaseChange) error {
+    line, err := json.Marshal(changeJSON(c))
+    if err != nil {
+        return err
+    }
+    f, err := os.OpenFile(h.cfg.Target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(append(line, '\n')); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
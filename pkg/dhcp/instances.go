@@ -0,0 +1,46 @@
+package dhcp
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+)
+
+// coredhcp builds plugins from string arguments only, so state owned by a
+// Service is handed over by registering it here and passing the id.
+var (
+    instancesMu sync.Mutex
+    instances   = make(map[string]interface{})
+    instanceSeq atomic.Uint64
+)
+
+// registerInstance stores v and returns the id plugins look it up by
+func registerInstance(v interface{}) string {
+    id := fmt.Sprintf("krouter-%d", instanceSeq.Add(1))
+    instancesMu.Lock()
+    instances[id] = v
+    instancesMu.Unlock()
+    return id
+}
+
+// unregisterInstance drops an instance once its server is stopped
+func unregisterInstance(id string) {
+    instancesMu.Lock()
+    delete(instances, id)
+    instancesMu.Unlock()
+}
+
+// lookupInstance returns the instance registered under the plugin's
+// single id argument
+func lookupInstance(plugin string, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, fmt.Errorf("%s: need exactly one argument, the instance id", plugin)
+    }
+    instancesMu.Lock()
+    defer instancesMu.Unlock()
+    v, ok := instances[args[0]]
+    if !ok {
+        return nil, fmt.Errorf("%s: unknown instance %q", plugin, args[0])
+    }
+    return v, nil
+}
@@ -0,0 +1,390 @@
+package dhcp
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// ErrLeaseDBDisabled is returned by the lease queries and Subscribe when no
+// dhcp.leases.database is configured
+var ErrLeaseDBDisabled = errors.New("lease database disabled")
+
+// Lease is a DHCPv4 binding as recorded in the lease database
+type Lease struct {
+    MAC         net.HardwareAddr
+    IP          net.IP
+    Hostname    string
+    VendorClass string
+    Start       time.Time
+    Expires     time.Time
+}
+
+// LeaseEvent is one DHCPv4 message seen for a client
+type LeaseEvent struct {
+    Time             time.Time
+    Type             string // DISCOVER, OFFER, REQUEST, ACK, NAK, RELEASE, ...
+    MAC              net.HardwareAddr
+    IP               net.IP
+    Server           net.IP        // server identifier, set on replies
+    LeaseTime        time.Duration // granted lease, set on replies
+    Hostname         string
+    VendorClass      string
+    RequestedOptions []uint8
+}
+
+const leaseSchema = `
+CREATE TABLE IF NOT EXISTS events (
+    time              INTEGER NOT NULL,
+    mac               TEXT NOT NULL,
+    type              TEXT NOT NULL,
+    ip                TEXT,
+    server            TEXT,
+    lease_time        INTEGER,
+    hostname          TEXT,
+    vendor_class      TEXT,
+    requested_options TEXT
+);
+CREATE INDEX IF NOT EXISTS events_mac_time ON events (mac, time);
+CREATE TABLE IF NOT EXISTS leases (
+    mac          TEXT PRIMARY KEY,
+    ip           TEXT NOT NULL,
+    hostname     TEXT,
+    vendor_class TEXT,
+    start        INTEGER NOT NULL,
+    expires      INTEGER NOT NULL,
+    ended        INTEGER NOT NULL DEFAULT 0
+);`
+
+// leaseDB records every DHCPv4 message seen on the LAN and keeps the
+// resulting bindings, fed by the sniffer so releases and our own ACKs are
+// seen as well.
+type leaseDB struct {
+    db       *sql.DB
+    serverID net.IP
+    changes  *leaseBroker
+    mu       sync.Mutex
+    // last client message per MAC, describing the lease an ACK confirms
+    clients  map[string]*LeaseEvent
+}
+
+func openLeaseDB(path string, serverID net.IP, changes *leaseBroker) (*leaseDB, error) {
+    db, err := sql.Open("sqlite3", path)
+    if err != nil {
+        return nil, fmt.Errorf("opening lease database: %w", err)
+    }
+    // sqlite serialises writers anyway; one connection avoids SQLITE_BUSY
+    db.SetMaxOpenConns(1)
+    if _, err := db.Exec(leaseSchema); err != nil {
+        db.Close()
+        return nil, fmt.Errorf("creating lease database %s: %w", path, err)
+    }
+    return &leaseDB{
+        db:       db,
+        serverID: serverID,
+        changes:  changes,
+        clients:  make(map[string]*LeaseEvent),
+    }, nil
+}
+
+func (l *leaseDB) close() error {
+    return l.db.Close()
+}
+
+// observe records a sniffed DHCPv4 packet
+func (l *leaseDB) observe(pkt *sniffedPacket) {
+    if pkt.srcPort != portServer4 && pkt.srcPort != portClient4 {
+        return
+    }
+    msg, err := dhcpv4.FromBytes(pkt.payload)
+    if err != nil {
+        return
+    }
+    ev := eventFromMessage(pkt.time, msg)
+    if err := l.record(ev); err != nil {
+        log.Errorw("failed to record lease history", "type", ev.Type, "mac", ev.MAC, "error", err)
+    }
+}
+
+func eventFromMessage(t time.Time, msg *dhcpv4.DHCPv4) *LeaseEvent {
+    ev := &LeaseEvent{
+        Time: t,
+        Type: msg.MessageType().String(),
+        MAC:  msg.ClientHWAddr,
+    }
+    if msg.OpCode == dhcpv4.OpcodeBootRequest {
+        ev.IP = msg.RequestedIPAddress()
+        if ev.IP == nil && !msg.ClientIPAddr.IsUnspecified() {
+            ev.IP = msg.ClientIPAddr
+        }
+        ev.Hostname = msg.HostName()
+        ev.VendorClass = msg.ClassIdentifier()
+        for _, code := range msg.ParameterRequestList() {
+            ev.RequestedOptions = append(ev.RequestedOptions, code.Code())
+        }
+    } else {
+        if !msg.YourIPAddr.IsUnspecified() {
+            ev.IP = msg.YourIPAddr
+        }
+        ev.Server = msg.ServerIdentifier()
+        ev.LeaseTime = msg.IPAddressLeaseTime(0)
+    }
+    return ev
+}
+
+// record stores the event and applies it to the lease table
+func (l *leaseDB) record(ev *LeaseEvent) error {
+    mac := ev.MAC.String()
+    _, err := l.db.Exec(`INSERT INTO events
+        (time, mac, type, ip, server, lease_time, hostname, vendor_class, requested_options)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        ev.Time.UnixNano(), mac, ev.Type, ipString(ev.IP), ipString(ev.Server),
+        int64(ev.LeaseTime), ev.Hostname, ev.VendorClass, joinOptions(ev.RequestedOptions))
+    if err != nil {
+        return err
+    }
+
+    switch ev.Type {
+    case dhcpv4.MessageTypeDiscover.String(), dhcpv4.MessageTypeRequest.String(),
+        dhcpv4.MessageTypeInform.String():
+        l.mu.Lock()
+        l.clients[mac] = ev
+        l.mu.Unlock()
+
+    case dhcpv4.MessageTypeAck.String():
+        // only our own bindings, or any server's when relaying; INFORM ACKs carry no address
+        if ev.IP == nil || (l.serverID != nil && ev.Server != nil && !ev.Server.Equal(l.serverID)) {
+            return nil
+        }
+        return l.bind(ev)
+
+    case dhcpv4.MessageTypeRelease.String():
+        return l.end(ev, LeaseReleased)
+    case dhcpv4.MessageTypeDecline.String():
+        return l.end(ev, LeaseDeclined)
+    }
+    return nil
+}
+
+// lookup returns the client's binding and whether it is still held
+func (l *leaseDB) lookup(mac string, at time.Time) (*Lease, bool, error) {
+    row := l.db.QueryRow(`SELECT mac, ip, hostname, vendor_class, start, expires, ended
+        FROM leases WHERE mac = ?`, mac)
+    lease, ended, err := scanLease(row)
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, false, nil
+    }
+    if err != nil {
+        return nil, false, err
+    }
+    return lease, !ended && lease.Expires.After(at), nil
+}
+
+// end closes the client's binding early on RELEASE or DECLINE
+func (l *leaseDB) end(ev *LeaseEvent, kind LeaseChangeKind) error {
+    mac := ev.MAC.String()
+    lease, held, err := l.lookup(mac, ev.Time)
+    if err != nil || !held {
+        return err
+    }
+    if _, err := l.db.Exec(`UPDATE leases SET expires = ?, ended = 1 WHERE mac = ?`,
+        ev.Time.UnixNano(), mac); err != nil {
+        return err
+    }
+    lease.Expires = ev.Time
+    l.publish(kind, ev.Time, lease)
+    return nil
+}
+
+// expire ends bindings whose lease ran out without a release
+func (l *leaseDB) expire(now time.Time) error {
+    rows, err := l.db.Query(`SELECT mac, ip, hostname, vendor_class, start, expires, ended
+        FROM leases WHERE ended = 0 AND expires <= ?`, now.UnixNano())
+    if err != nil {
+        return err
+    }
+    var expired []*Lease
+    for rows.Next() {
+        lease, _, err := scanLease(rows)
+        if err != nil {
+            rows.Close()
+            return err
+        }
+        expired = append(expired, lease)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for _, lease := range expired {
+        if _, err := l.db.Exec(`UPDATE leases SET ended = 1 WHERE mac = ? AND ended = 0`,
+            lease.MAC.String()); err != nil {
+            return err
+        }
+        l.publish(LeaseExpired, now, lease)
+    }
+    return nil
+}
+
+func (l *leaseDB) publish(kind LeaseChangeKind, at time.Time, lease *Lease) {
+    if l.changes != nil {
+        l.changes.publish(LeaseChange{Kind: kind, Time: at, Lease: *lease})
+    }
+}
+
+// bind upserts the lease confirmed by an ACK, taking hostname and vendor
+// class from the client's last message. A renewal of the same address
+// keeps the original start time.
+func (l *leaseDB) bind(ev *LeaseEvent) error {
+    l.mu.Lock()
+    client := l.clients[ev.MAC.String()]
+    l.mu.Unlock()
+
+    hostname, vendor := "", ""
+    if client != nil {
+        hostname, vendor = client.Hostname, client.VendorClass
+    }
+
+    mac := ev.MAC.String()
+    prev, held, err := l.lookup(mac, ev.Time)
+    if err != nil {
+        return err
+    }
+    kind := LeaseNew
+    if held && prev.IP.Equal(ev.IP) {
+        kind = LeaseRenewed
+    }
+
+    expires := ev.Time.Add(ev.LeaseTime)
+    _, err = l.db.Exec(`INSERT INTO leases (mac, ip, hostname, vendor_class, start, expires)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT (mac) DO UPDATE SET
+            start = CASE WHEN leases.ip = excluded.ip AND leases.ended = 0
+                AND leases.expires > excluded.start THEN leases.start ELSE excluded.start END,
+            ip = excluded.ip,
+            hostname = COALESCE(NULLIF(excluded.hostname, ''), leases.hostname),
+            vendor_class = COALESCE(NULLIF(excluded.vendor_class, ''), leases.vendor_class),
+            expires = excluded.expires,
+            ended = 0`,
+        mac, ev.IP.String(), hostname, vendor,
+        ev.Time.UnixNano(), expires.UnixNano())
+    if err != nil {
+        return err
+    }
+
+    lease, _, err := l.lookup(mac, ev.Time)
+    if err != nil {
+        return err
+    }
+    l.publish(kind, ev.Time, lease)
+    return nil
+}
+
+// active returns bindings that have not expired or been released
+func (l *leaseDB) active() ([]Lease, error) {
+    rows, err := l.db.Query(`SELECT mac, ip, hostname, vendor_class, start, expires, ended
+        FROM leases WHERE ended = 0 AND expires > ? ORDER BY ip`, time.Now().UnixNano())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var leases []Lease
+    for rows.Next() {
+        lease, _, err := scanLease(rows)
+        if err != nil {
+            return nil, err
+        }
+        leases = append(leases, *lease)
+    }
+    return leases, rows.Err()
+}
+
+// scanLease reads one leases row in the column order used above
+func scanLease(row interface{ Scan(...interface{}) error }) (*Lease, bool, error) {
+    var (
+        mac, ip, hostname, vendor sql.NullString
+        start, expires            int64
+        ended                     bool
+    )
+    if err := row.Scan(&mac, &ip, &hostname, &vendor, &start, &expires, &ended); err != nil {
+        return nil, false, err
+    }
+    hw, _ := net.ParseMAC(mac.String)
+    return &Lease{
+        MAC:         hw,
+        IP:          net.ParseIP(ip.String),
+        Hostname:    hostname.String,
+        VendorClass: vendor.String,
+        Start:       time.Unix(0, start),
+        Expires:     time.Unix(0, expires),
+    }, ended, nil
+}
+
+// history returns every event seen for mac, oldest first
+func (l *leaseDB) history(mac net.HardwareAddr) ([]LeaseEvent, error) {
+    rows, err := l.db.Query(`SELECT time, type, ip, server, lease_time, hostname,
+        vendor_class, requested_options FROM events WHERE mac = ? ORDER BY time`, mac.String())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var events []LeaseEvent
+    for rows.Next() {
+        var (
+            t, leaseTime                          int64
+            typ                                   string
+            ip, server, hostname, vendor, options sql.NullString
+        )
+        if err := rows.Scan(&t, &typ, &ip, &server, &leaseTime, &hostname, &vendor, &options); err != nil {
+            return nil, err
+        }
+        events = append(events, LeaseEvent{
+            Time:             time.Unix(0, t),
+            Type:             typ,
+            MAC:              mac,
+            IP:               net.ParseIP(ip.String),
+            Server:           net.ParseIP(server.String),
+            LeaseTime:        time.Duration(leaseTime),
+            Hostname:         hostname.String,
+            VendorClass:      vendor.String,
+            RequestedOptions: splitOptions(options.String),
+        })
+    }
+    return events, rows.Err()
+}
+
+func ipString(ip net.IP) string {
+    if ip == nil {
+        return ""
+    }
+    return ip.String()
+}
+
+func joinOptions(codes []uint8) string {
+    parts := make([]string, len(codes))
+    for i, c := range codes {
+        parts[i] = strconv.Itoa(int(c))
+    }
+    return strings.Join(parts, ",")
+}
+
+func splitOptions(s string) []uint8 {
+    var codes []uint8
+    for _, part := range strings.Split(s, ",") {
+        if c, err := strconv.Atoi(part); err == nil {
+            codes = append(codes, uint8(c))
+        }
+    }
+    return codes
+}
@@ -0,0 +1,309 @@
+package dhcp
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/coredhcp/coredhcp/plugins/allocators"
+    "github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+    leaseStoreFile   = "file"
+    leaseStoreMemory = "memory"
+)
+
+// leasesPlugin allocates from the pool with leases held in memory, for
+// diskless operation. Its argument is the id of a registered *leaseStore.
+var leasesPlugin = plugins.Plugin{
+    Name:   "leases",
+    Setup4: setupLeases4,
+}
+
+// lease is one client binding, also the snapshot file format
+type lease struct {
+    MAC      string    `json:"mac"`
+    IP       net.IP    `json:"ip"`
+    Hostname string    `json:"hostname,omitempty"`
+    Expires  time.Time `json:"expires"`
+}
+
+// leaseStore is an in-memory DHCPv4 lease table over the pool
+type leaseStore struct {
+    mu        sync.Mutex
+    leases    map[string]*lease // MAC -> lease
+    allocator allocators.Allocator
+    leaseTime time.Duration
+    snapshot  string
+    // probe checks new addresses are free on the LAN, nil when off
+    probe     *prober
+    // parked holds addresses found in use, kept allocated until then
+    parked    map[string]time.Time
+}
+
+// newLeaseStore builds a store for the pool. It takes over prev's leases
+// when given, as on a reload, and otherwise loads the snapshot when one is
+// configured and present.
+func newLeaseStore(pool *pool4, snapshot string, prev *leaseStore, probe *prober) (*leaseStore, error) {
+    alloc, err := bitmap.NewIPv4Allocator(pool.start, pool.end)
+    if err != nil {
+        return nil, fmt.Errorf("could not create an allocator: %w", err)
+    }
+    ls := &leaseStore{
+        leases:    make(map[string]*lease),
+        allocator: alloc,
+        leaseTime: pool.leaseTime,
+        snapshot:  snapshot,
+        probe:     probe,
+        parked:    make(map[string]time.Time),
+    }
+    if prev != nil {
+        prev.mu.Lock()
+        held := make([]*lease, 0, len(prev.leases))
+        for _, l := range prev.leases {
+            c := *l
+            held = append(held, &c)
+        }
+        prev.mu.Unlock()
+        ls.restore(held, "previous pool")
+    } else if snapshot != "" {
+        if err := ls.load(); err != nil {
+            return nil, err
+        }
+    }
+    return ls, nil
+}
+
+// load reads the snapshot back into the store
+func (ls *leaseStore) load() error {
+    data, err := os.ReadFile(ls.snapshot)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("reading lease snapshot: %w", err)
+    }
+    var saved []*lease
+    if err := json.Unmarshal(data, &saved); err != nil {
+        return fmt.Errorf("parsing lease snapshot %s: %w", ls.snapshot, err)
+    }
+    ls.restore(saved, ls.snapshot)
+    return nil
+}
+
+// restore adopts unexpired leases that still fit the pool
+func (ls *leaseStore) restore(saved []*lease, source string) {
+    now := time.Now()
+    for _, l := range saved {
+        if now.After(l.Expires) {
+            continue
+        }
+        got, err := ls.allocator.Allocate(net.IPNet{IP: l.IP})
+        if err != nil || !got.IP.Equal(l.IP) {
+            if err == nil {
+                ls.allocator.Free(got)
+            }
+            log.Warnw("dropping lease outside the current pool", "ip", l.IP, "mac", l.MAC, "source", source)
+            continue
+        }
+        ls.leases[l.MAC] = l
+    }
+    log.Infow("loaded DHCPv4 leases", "count", len(ls.leases), "source", source)
+}
+
+// save writes the lease table to the snapshot path, if any
+func (ls *leaseStore) save() error {
+    if ls.snapshot == "" {
+        return nil
+    }
+    ls.mu.Lock()
+    saved := make([]*lease, 0, len(ls.leases))
+    for _, l := range ls.leases {
+        saved = append(saved, l)
+    }
+    data, err := json.MarshalIndent(saved, "", "  ")
+    ls.mu.Unlock()
+    if err != nil {
+        return err
+    }
+
+    // write-then-rename so a crash never leaves half a snapshot
+    tmp, err := os.CreateTemp(filepath.Dir(ls.snapshot), ".leases-*")
+    if err != nil {
+        return fmt.Errorf("writing lease snapshot: %w", err)
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return fmt.Errorf("writing lease snapshot: %w", err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("writing lease snapshot: %w", err)
+    }
+    if err := os.Rename(tmp.Name(), ls.snapshot); err != nil {
+        return fmt.Errorf("writing lease snapshot: %w", err)
+    }
+    log.Infow("saved DHCPv4 leases", "count", len(saved), "file", ls.snapshot)
+    return nil
+}
+
+// allocate returns the client's lease, creating one when needed. The
+// requested address is honoured when it is free.
+func (ls *leaseStore) allocate(hw net.HardwareAddr, requested net.IP, hostname string) (*lease, error) {
+    mac := hw.String()
+    if l, ok := ls.leases[mac]; ok {
+        l.Expires = time.Now().Add(ls.leaseTime)
+        if hostname != "" {
+            l.Hostname = hostname
+        }
+        return l, nil
+    }
+
+    ip, err := ls.pick(hw, requested)
+    if err != nil {
+        return nil, err
+    }
+    if l, ok := ls.leases[mac]; ok {
+        // another request from the client was answered while this one
+        // probed
+        if err := ls.allocator.Free(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+            log.Errorw("failed to free unused address", "ip", ip, "error", err)
+        }
+        return l, nil
+    }
+    l := &lease{
+        MAC:      mac,
+        IP:       ip,
+        Hostname: hostname,
+        Expires:  time.Now().Add(ls.leaseTime),
+    }
+    ls.leases[mac] = l
+    return l, nil
+}
+
+// pick allocates an address for hw, probing candidates when conflict
+// detection is on. One found in use stays allocated, parked, until its hold
+// runs out so the allocator moves past it. It is called with ls.mu held and
+// drops it for each probe; the candidate stays allocated meanwhile, so no
+// other client is offered it.
+func (ls *leaseStore) pick(hw net.HardwareAddr, requested net.IP) (net.IP, error) {
+    ls.unpark(time.Now())
+    for probes := 0; ; probes++ {
+        ip, err := ls.allocator.Allocate(net.IPNet{IP: requested})
+        if errors.Is(err, allocators.ErrNoAddrAvail) && ls.reclaim() > 0 {
+            ip, err = ls.allocator.Allocate(net.IPNet{IP: requested})
+        }
+        if err != nil {
+            return nil, err
+        }
+        if ls.probe == nil {
+            return ip.IP.To4(), nil
+        }
+        ls.mu.Unlock()
+        usable := ls.probe.usable(ip.IP, hw)
+        ls.mu.Lock()
+        if usable {
+            return ip.IP.To4(), nil
+        }
+        ls.parked[ip.IP.String()] = time.Now().Add(ls.probe.hold)
+        if probes+1 >= maxConflictProbes {
+            return nil, fmt.Errorf("the last %d addresses tried are in use", maxConflictProbes)
+        }
+        requested = nil
+    }
+}
+
+// unpark returns addresses whose conflict hold has run out to the pool
+func (ls *leaseStore) unpark(now time.Time) {
+    for ip, until := range ls.parked {
+        if now.Before(until) {
+            continue
+        }
+        if err := ls.allocator.Free(net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)}); err != nil {
+            log.Errorw("failed to free conflicting address", "ip", ip, "error", err)
+        }
+        delete(ls.parked, ip)
+    }
+}
+
+// held counts the leases still valid at now
+func (ls *leaseStore) held(now time.Time) int {
+    ls.mu.Lock()
+    defer ls.mu.Unlock()
+    n := 0
+    for _, l := range ls.leases {
+        if now.Before(l.Expires) {
+            n++
+        }
+    }
+    return n
+}
+
+// reclaim frees expired leases, returning how many were released
+func (ls *leaseStore) reclaim() int {
+    now := time.Now()
+    n := 0
+    for mac, l := range ls.leases {
+        if now.Before(l.Expires) {
+            continue
+        }
+        if err := ls.allocator.Free(net.IPNet{IP: l.IP, Mask: net.CIDRMask(32, 32)}); err != nil {
+            log.Errorw("failed to free expired lease", "ip", l.IP, "error", err)
+        }
+        delete(ls.leases, mac)
+        n++
+    }
+    return n
+}
+
+// handle4 serves DISCOVER and REQUEST from the lease table
+func (ls *leaseStore) handle4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+    ls.mu.Lock()
+    defer ls.mu.Unlock()
+
+    mac := req.ClientHWAddr.String()
+    requested := req.RequestedIPAddress()
+    if requested == nil && !req.ClientIPAddr.IsUnspecified() {
+        requested = req.ClientIPAddr
+    }
+
+    // a client asking for an address it does not hold gets a NAK so it
+    // restarts from DISCOVER
+    if req.MessageType() == dhcpv4.MessageTypeRequest && requested != nil {
+        if l, ok := ls.leases[mac]; !ok || !l.IP.Equal(requested) {
+            resp.YourIPAddr = net.IPv4zero
+            resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+            return resp, true
+        }
+    }
+
+    l, err := ls.allocate(req.ClientHWAddr, requested, req.HostName())
+    if err != nil {
+        log.Errorw("could not allocate IPv4 address", "mac", mac, "error", err)
+        return nil, true
+    }
+    resp.YourIPAddr = l.IP
+    resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(ls.leaseTime.Round(time.Second)))
+    return resp, false
+}
+
+func setupLeases4(args ...string) (handler.Handler4, error) {
+    v, err := lookupInstance("leases", args)
+    if err != nil {
+        return nil, err
+    }
+    ls, ok := v.(*leaseStore)
+    if !ok {
+        return nil, fmt.Errorf("leases: instance %q is not a lease store", args[0])
+    }
+    return ls.handle4, nil
+}
@@ -0,0 +1,492 @@
+package dhcp
+
+import (
+    "errors"
+    "fmt"
+    "hash/fnv"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/coredhcp/coredhcp/plugins/allocators"
+    "github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+    "github.com/insomniacslk/dhcp/iana"
+    "github.com/vishvananda/netlink"
+    "golang.org/x/sys/unix"
+)
+
+// leases6Plugin assigns IA_NA addresses and IA_PD prefixes from the v6
+// pool, with bindings held in memory. Its argument is the id of a
+// registered *leaseStore6.
+var leases6Plugin = plugins.Plugin{
+    Name:   "leases6",
+    Setup6: setupLeases6,
+}
+
+// offerHold is how long an address or prefix advertised to a soliciting
+// client stays reserved for it before a Request commits it
+const offerHold = time.Minute
+
+// binding6 is one identity association's address or delegated prefix
+type binding6 struct {
+    duid    string
+    iaid    [4]byte
+    mac     net.HardwareAddr
+    prefix  net.IPNet // a /128 for addresses
+    expires time.Time
+    // via is the next hop a delegated prefix is routed through, nil while
+    // no route is installed
+    via     net.IP
+    // routed marks prefixes krouter routes, so a reload puts them back
+    routed  bool
+}
+
+// leaseStore6 is the DHCPv6 binding table over a pool6
+type leaseStore6 struct {
+    mu       sync.Mutex
+    pool     *pool6
+    addrs    map[string]*binding6 // DUID+IAID -> address
+    inUse    map[uint64]bool      // interface ids of bound addresses
+    prefixes map[string]*binding6 // DUID+IAID -> delegated prefix
+    pd       allocators.Allocator // nil without prefix delegation
+    link     netlink.Link
+    probe    *prober              // nil without conflict detection
+}
+
+// newLeaseStore6 builds a store for the pool, taking over prev's bindings
+// that still fit when given
+func newLeaseStore6(pool *pool6, iface string, prev *leaseStore6, probe *prober) (*leaseStore6, error) {
+    ls := &leaseStore6{
+        pool:     pool,
+        probe:    probe,
+        addrs:    make(map[string]*binding6),
+        inUse:    make(map[uint64]bool),
+        prefixes: make(map[string]*binding6),
+    }
+    if pool.pd != nil {
+        alloc, err := bitmap.NewBitmapAllocator(*pool.pd, pool.pdLength)
+        if err != nil {
+            return nil, fmt.Errorf("could not create a prefix allocator: %w", err)
+        }
+        ls.pd = alloc
+
+        // delegated prefixes are routed out of the LAN
+        if ls.link, err = netlink.LinkByName(iface); err != nil {
+            return nil, fmt.Errorf("failed to get interface: %w", err)
+        }
+    }
+    if prev != nil {
+        ls.adopt(prev)
+    }
+    return ls, nil
+}
+
+// adopt takes over prev's unexpired bindings that fit this pool, routing
+// delegated prefixes again
+func (ls *leaseStore6) adopt(prev *leaseStore6) {
+    prev.mu.Lock()
+    defer prev.mu.Unlock()
+    now := time.Now()
+    for key, b := range prev.addrs {
+        h := ip6Host(b.prefix.IP)
+        start := ip6Host(ls.pool.start)
+        if now.After(b.expires) || !sameNetwork64(b.prefix.IP, ls.pool.start) ||
+            h < start || h-start >= ls.pool.size() {
+            continue
+        }
+        nb := *b
+        ls.inUse[h] = true
+        ls.addrs[key] = &nb
+    }
+    for key, b := range prev.prefixes {
+        if ls.pd == nil || now.After(b.expires) {
+            continue
+        }
+        got, err := ls.pd.Allocate(b.prefix)
+        if err != nil || got.String() != b.prefix.String() {
+            if err == nil {
+                ls.pd.Free(got)
+            }
+            log.Warnw("dropping delegated prefix outside the current pool", "prefix", &b.prefix, "mac", b.mac)
+            continue
+        }
+        nb := *b
+        nb.via = nil
+        ls.prefixes[key] = &nb
+        if nb.routed {
+            ls.route(&nb)
+        }
+    }
+    log.Infow("kept DHCPv6 bindings", "addresses", len(ls.addrs), "prefixes", len(ls.prefixes))
+}
+
+func iaKey(duid string, iaid [4]byte) string {
+    return duid + string(iaid[:])
+}
+
+// handle6 serves IA_NA and IA_PD for Solicit, Request, Renew, Rebind and
+// Release. Other messages pass through untouched.
+func (ls *leaseStore6) handle6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+    msg, err := req.GetInnerMessage()
+    if err != nil {
+        return resp, false
+    }
+    reply, ok := resp.(*dhcpv6.Message)
+    if !ok {
+        return resp, false
+    }
+    cid := msg.Options.ClientID()
+    if cid == nil {
+        return resp, false
+    }
+    duid := string(cid.ToBytes())
+    mac, _ := dhcpv6.ExtractMAC(req)
+
+    ls.mu.Lock()
+    defer ls.mu.Unlock()
+
+    switch msg.MessageType {
+    case dhcpv6.MessageTypeRelease:
+        for _, ia := range msg.Options.IANA() {
+            ls.releaseAddr(iaKey(duid, ia.IaId))
+        }
+        for _, ia := range msg.Options.IAPD() {
+            ls.releasePrefix(iaKey(duid, ia.IaId))
+        }
+        reply.UpdateOption(&dhcpv6.OptStatusCode{StatusCode: iana.StatusSuccess})
+        return resp, true
+    case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest,
+        dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+    default:
+        return resp, false
+    }
+
+    // an Advertise only offers; a Reply, including a rapid-commit one,
+    // binds
+    commit := reply.MessageType == dhcpv6.MessageTypeReply
+    for _, ia := range msg.Options.IANA() {
+        if hasIANA(reply, ia.IaId) {
+            // a reservation already answered it
+            continue
+        }
+        reply.AddOption(ls.assignAddr(duid, mac, ia, commit))
+    }
+    if ls.pd != nil {
+        // a relayed client is reached through its relay agent, which
+        // routes the prefix itself
+        route := commit && !req.IsRelay()
+        for _, ia := range msg.Options.IAPD() {
+            reply.AddOption(ls.assignPrefix(duid, mac, ia, commit, route))
+        }
+    }
+    return resp, false
+}
+
+func hasIANA(msg *dhcpv6.Message, iaid [4]byte) bool {
+    for _, ia := range msg.Options.IANA() {
+        if ia.IaId == iaid {
+            return true
+        }
+    }
+    return false
+}
+
+// lifetimes returns the valid lifetime and T1/T2 for a binding
+func (ls *leaseStore6) lifetimes() (time.Duration, time.Duration, time.Duration) {
+    lt := ls.pool.leaseTime.Round(time.Second)
+    return lt, lt / 2, lt * 4 / 5
+}
+
+// hold extends a binding by a full lease once committed, or by offerHold
+// while only advertised
+func (ls *leaseStore6) hold(b *binding6, commit bool) {
+    d := offerHold
+    if commit {
+        d = ls.pool.leaseTime
+    }
+    if until := time.Now().Add(d); until.After(b.expires) {
+        b.expires = until
+    }
+}
+
+func (ls *leaseStore6) assignAddr(duid string, mac net.HardwareAddr, ia *dhcpv6.OptIANA, commit bool) *dhcpv6.OptIANA {
+    key := iaKey(duid, ia.IaId)
+    b, ok := ls.addrs[key]
+    if !ok {
+        var hint net.IP
+        if addrs := ia.Options.Addresses(); len(addrs) > 0 {
+            hint = addrs[0].IPv6Addr
+        }
+        ip, err := ls.allocAddr(duid, mac, hint)
+        if prev, bound := ls.addrs[key]; bound {
+            // another request for the IA was answered while this one
+            // probed
+            if err == nil {
+                delete(ls.inUse, ip6Host(ip))
+            }
+            b, err = prev, nil
+        }
+        if err != nil {
+            log.Errorw("could not allocate IPv6 address", "mac", mac, "error", err)
+            return &dhcpv6.OptIANA{
+                IaId: ia.IaId,
+                Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+                    &dhcpv6.OptStatusCode{StatusCode: iana.StatusNoAddrsAvail, StatusMessage: "no addresses available"},
+                }},
+            }
+        }
+        if b == nil {
+            b = &binding6{duid: duid, iaid: ia.IaId, mac: mac, prefix: net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}}
+            ls.addrs[key] = b
+            log.Infow("DHCPv6 address bound", "ip", ip, "mac", mac)
+        }
+    }
+    ls.hold(b, commit)
+
+    lt, t1, t2 := ls.lifetimes()
+    return &dhcpv6.OptIANA{
+        IaId: ia.IaId,
+        T1:   t1,
+        T2:   t2,
+        Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+            &dhcpv6.OptIAAddress{IPv6Addr: b.prefix.IP, PreferredLifetime: lt, ValidLifetime: lt},
+        }},
+    }
+}
+
+// allocAddr takes the hinted address when it is free, otherwise searches
+// from a slot derived from the DUID so a client tends to get the same
+// address back after its binding is gone. Addresses another device answers
+// for are skipped. It is called with ls.mu held and drops it for each
+// probe, with the candidate marked in use so no other client is offered it.
+func (ls *leaseStore6) allocAddr(duid string, mac net.HardwareAddr, hint net.IP) (net.IP, error) {
+    size := ls.pool.size()
+    if uint64(len(ls.inUse)) >= size && ls.reclaim(time.Now()) == 0 {
+        return nil, allocators.ErrNoAddrAvail
+    }
+    probes := 0
+    // take claims h unless it turns out to be in use
+    take := func(h uint64) bool {
+        ip := ip6WithHost(ls.pool.start, h)
+        if ls.probe != nil {
+            if ls.probe.held(ip, time.Now()) {
+                return false
+            }
+            probes++
+            ls.inUse[h] = true
+            ls.mu.Unlock()
+            usable := ls.probe.usable(ip, mac)
+            ls.mu.Lock()
+            if !usable {
+                delete(ls.inUse, h)
+                return false
+            }
+        }
+        ls.inUse[h] = true
+        return true
+    }
+
+    start := ip6Host(ls.pool.start)
+    if hint != nil && sameNetwork64(hint, ls.pool.start) {
+        if h := ip6Host(hint); h >= start && h-start < size && !ls.inUse[h] && take(h) {
+            return ip6WithHost(ls.pool.start, h), nil
+        }
+    }
+
+    sum := fnv.New64a()
+    sum.Write([]byte(duid))
+    slot := sum.Sum64() % size
+    for i := uint64(0); i < size && probes < maxConflictProbes; i++ {
+        h := start + (slot+i)%size
+        if !ls.inUse[h] && take(h) {
+            return ip6WithHost(ls.pool.start, h), nil
+        }
+    }
+    if probes >= maxConflictProbes {
+        return nil, fmt.Errorf("the last %d addresses tried are in use", maxConflictProbes)
+    }
+    return nil, allocators.ErrNoAddrAvail
+}
+
+func (ls *leaseStore6) assignPrefix(duid string, mac net.HardwareAddr, ia *dhcpv6.OptIAPD, commit, route bool) *dhcpv6.OptIAPD {
+    key := iaKey(duid, ia.IaId)
+    b, ok := ls.prefixes[key]
+    if !ok {
+        var hint net.IPNet
+        if prefixes := ia.Options.Prefixes(); len(prefixes) > 0 && prefixes[0].Prefix != nil {
+            hint = *prefixes[0].Prefix
+        }
+        prefix, err := ls.pd.Allocate(hint)
+        if errors.Is(err, allocators.ErrNoAddrAvail) && ls.reclaim(time.Now()) > 0 {
+            prefix, err = ls.pd.Allocate(hint)
+        }
+        if err != nil {
+            log.Errorw("could not delegate an IPv6 prefix", "mac", mac, "error", err)
+            return &dhcpv6.OptIAPD{
+                IaId: ia.IaId,
+                Options: dhcpv6.PDOptions{Options: []dhcpv6.Option{
+                    &dhcpv6.OptStatusCode{StatusCode: iana.StatusNoPrefixAvail, StatusMessage: "no prefixes available"},
+                }},
+            }
+        }
+        b = &binding6{duid: duid, iaid: ia.IaId, mac: mac, prefix: prefix}
+        ls.prefixes[key] = b
+        log.Infow("DHCPv6 prefix delegated", "prefix", &prefix, "mac", mac)
+    }
+    ls.hold(b, commit)
+    if route {
+        b.routed = true
+        ls.route(b)
+    }
+
+    lt, t1, t2 := ls.lifetimes()
+    prefix := b.prefix
+    return &dhcpv6.OptIAPD{
+        IaId: ia.IaId,
+        T1:   t1,
+        T2:   t2,
+        Options: dhcpv6.PDOptions{Options: []dhcpv6.Option{
+            &dhcpv6.OptIAPrefix{PreferredLifetime: lt, ValidLifetime: lt, Prefix: &prefix},
+        }},
+    }
+}
+
+func (ls *leaseStore6) releaseAddr(key string) {
+    b, ok := ls.addrs[key]
+    if !ok {
+        return
+    }
+    delete(ls.inUse, ip6Host(b.prefix.IP))
+    delete(ls.addrs, key)
+    log.Infow("DHCPv6 address released", "ip", b.prefix.IP, "mac", b.mac)
+}
+
+func (ls *leaseStore6) releasePrefix(key string) {
+    b, ok := ls.prefixes[key]
+    if !ok {
+        return
+    }
+    ls.unroute(b)
+    if err := ls.pd.Free(b.prefix); err != nil {
+        log.Errorw("failed to free delegated prefix", "prefix", &b.prefix, "error", err)
+    }
+    delete(ls.prefixes, key)
+    log.Infow("DHCPv6 prefix released", "prefix", &b.prefix, "mac", b.mac)
+}
+
+// reclaim drops bindings that lapsed before now, returning how many
+func (ls *leaseStore6) reclaim(now time.Time) int {
+    n := 0
+    for key, b := range ls.addrs {
+        if now.After(b.expires) {
+            ls.releaseAddr(key)
+            n++
+        }
+    }
+    for key, b := range ls.prefixes {
+        if now.After(b.expires) {
+            ls.releasePrefix(key)
+            n++
+        }
+    }
+    return n
+}
+
+// expire is the periodic sweep, so routes to vanished routers go away
+// without waiting for the pool to fill
+func (ls *leaseStore6) expire(now time.Time) {
+    ls.mu.Lock()
+    defer ls.mu.Unlock()
+    ls.reclaim(now)
+}
+
+// route points a delegated prefix at the requesting router
+func (ls *leaseStore6) route(b *binding6) {
+    via := ls.nextHop(b.mac)
+    if via == nil {
+        log.Warnw("no next hop for delegated prefix, unknown client MAC", "prefix", &b.prefix)
+        return
+    }
+    if via.Equal(b.via) {
+        return
+    }
+    prefix := b.prefix
+    err := netlink.RouteReplace(&netlink.Route{
+        LinkIndex: ls.link.Attrs().Index,
+        Dst:       &prefix,
+        Gw:        via,
+        Protocol:  unix.RTPROT_DHCP,
+    })
+    if err != nil {
+        log.Errorw("failed to route delegated prefix", "prefix", &prefix, "via", via, "error", err)
+        return
+    }
+    b.via = via
+    log.Infow("routing delegated prefix", "prefix", &prefix, "via", via)
+}
+
+func (ls *leaseStore6) unroute(b *binding6) {
+    if b.via == nil {
+        return
+    }
+    prefix := b.prefix
+    err := netlink.RouteDel(&netlink.Route{
+        LinkIndex: ls.link.Attrs().Index,
+        Dst:       &prefix,
+        Gw:        b.via,
+    })
+    if err != nil {
+        log.Errorw("failed to remove route for delegated prefix", "prefix", &prefix, "error", err)
+    }
+    b.via = nil
+}
+
+// nextHop finds the router's link-local address in the neighbour table,
+// falling back to the EUI-64 address derived from its MAC
+func (ls *leaseStore6) nextHop(mac net.HardwareAddr) net.IP {
+    if len(mac) != 6 {
+        return nil
+    }
+    neighs, err := netlink.NeighList(ls.link.Attrs().Index, netlink.FAMILY_V6)
+    if err == nil {
+        for _, n := range neighs {
+            if n.IP.IsLinkLocalUnicast() && n.HardwareAddr.String() == mac.String() {
+                return n.IP
+            }
+        }
+    }
+    return eui64LinkLocal(mac)
+}
+
+func eui64LinkLocal(mac net.HardwareAddr) net.IP {
+    ip := make(net.IP, net.IPv6len)
+    ip[0], ip[1] = 0xfe, 0x80
+    ip[8], ip[9], ip[10] = mac[0]^0x02, mac[1], mac[2]
+    ip[11], ip[12] = 0xff, 0xfe
+    ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+    return ip
+}
+
+// close withdraws every route installed for a delegated prefix
+func (ls *leaseStore6) close() {
+    ls.mu.Lock()
+    defer ls.mu.Unlock()
+    for _, b := range ls.prefixes {
+        ls.unroute(b)
+    }
+}
+
+func setupLeases6(args ...string) (handler.Handler6, error) {
+    v, err := lookupInstance("leases6", args)
+    if err != nil {
+        return nil, err
+    }
+    ls, ok := v.(*leaseStore6)
+    if !ok {
+        return nil, fmt.Errorf("leases6: instance %q is not a DHCPv6 lease store", args[0])
+    }
+    return ls.handle6, nil
+}
@@ -0,0 +1,223 @@
+package dhcp
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "sync"
+
+    cd_logger "github.com/coredhcp/coredhcp/logger"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+    "github.com/sirupsen/logrus"
+    "go.uber.org/zap"
+
+    "github.com/ryanvillarreal/krouter/pkg/utils"
+)
+
+// log is the DHCP subsystem's logger. coreLog carries coredhcp's own
+// messages, whose call sites are all inside the logrus bridge.
+var (
+    log     = newLog(nil)
+    coreLog = log.Desugar().WithOptions(zap.WithCaller(false)).Sugar()
+
+    bridgeOnce sync.Once
+)
+
+func newLog(logger *utils.Logger) *zap.SugaredLogger {
+    if logger == nil {
+        var err error
+        if logger, err = utils.NewLogger(utils.DefaultConfig()); err != nil {
+            return zap.NewNop().Sugar()
+        }
+    }
+    return logger.WithFields(map[string]interface{}{"subsystem": "dhcp"})
+}
+
+// setLogger sends the package's and coredhcp's logs to logger
+func setLogger(logger *utils.Logger) {
+    log = newLog(logger)
+    coreLog = log.Desugar().WithOptions(zap.WithCaller(false)).Sugar()
+    bridgeOnce.Do(bridgeCoreDHCPLogs)
+}
+
+// bridgeCoreDHCPLogs silences coredhcp's logrus output and hands every
+// entry to coreLog instead. All coredhcp loggers share one logrus logger,
+// so this covers plugins that grabbed theirs at init. Filtering is left to
+// zap so a level change applies to both.
+func bridgeCoreDHCPLogs() {
+    l := cd_logger.GetLogger("krouter").Logger
+    l.SetOutput(io.Discard)
+    l.SetFormatter(discardFormatter{})
+    l.SetLevel(logrus.DebugLevel)
+    l.AddHook(logrusHook{})
+}
+
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+    return nil, nil
+}
+
+// logrusHook forwards logrus entries to coreLog, the prefix coredhcp tags
+// them with becoming the component
+type logrusHook struct{}
+
+func (logrusHook) Levels() []logrus.Level {
+    return logrus.AllLevels
+}
+
+func (logrusHook) Fire(e *logrus.Entry) error {
+    kv := make([]interface{}, 0, 2*len(e.Data))
+    for k, v := range e.Data {
+        if k == "prefix" {
+            k = "component"
+        }
+        kv = append(kv, k, v)
+    }
+    switch e.Level {
+    case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+        coreLog.Errorw(e.Message, kv...)
+    case logrus.WarnLevel:
+        coreLog.Warnw(e.Message, kv...)
+    case logrus.InfoLevel:
+        coreLog.Infow(e.Message, kv...)
+    default:
+        coreLog.Debugw(e.Message, kv...)
+    }
+    return nil
+}
+
+// SetPacketDebug turns logging of every DHCP packet on the LAN on or off.
+// Packets are logged at debug level, so the logger must let those through.
+// The setting outlives Stop and applies again on the next Start.
+func (s *Service) SetPacketDebug(on bool) error {
+    s.debugMu.Lock()
+    defer s.debugMu.Unlock()
+    if on == s.debug {
+        return nil
+    }
+    if !on {
+        s.debug = false
+        s.stopPacketLogLocked()
+        log.Infow("packet debug off")
+        return nil
+    }
+    if s.running() {
+        if err := s.startPacketLogLocked(); err != nil {
+            return fmt.Errorf("failed to start packet debug: %w", err)
+        }
+    }
+    s.debug = true
+    log.Infow("packet debug on")
+    return nil
+}
+
+// resumePacketLog starts the packet log for a new run if it is on
+func (s *Service) resumePacketLog() {
+    s.debugMu.Lock()
+    defer s.debugMu.Unlock()
+    if !s.debug || s.stopDebug != nil {
+        return
+    }
+    if err := s.startPacketLogLocked(); err != nil {
+        log.Warnw("packet debug unavailable", "error", err)
+    }
+}
+
+func (s *Service) stopPacketLog() {
+    s.debugMu.Lock()
+    defer s.debugMu.Unlock()
+    s.stopPacketLogLocked()
+}
+
+func (s *Service) startPacketLogLocked() error {
+    sn, err := newSniffer(s.cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithCancel(s.ctx)
+    s.stopDebug = cancel
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        defer sn.close()
+        if err := sn.run(ctx, logPacket); err != nil {
+            log.Warnw("packet debug stopped", "error", err)
+        }
+    }()
+    return nil
+}
+
+func (s *Service) stopPacketLogLocked() {
+    if s.stopDebug == nil {
+        return
+    }
+    s.stopDebug()
+    s.stopDebug = nil
+}
+
+// logPacket logs who a DHCP packet is for and what it carries
+func logPacket(pkt *sniffedPacket) {
+    dir := "in"
+    if pkt.outgoing {
+        dir = "out"
+    }
+    if pkt.srcPort == portServer4 || pkt.srcPort == portClient4 {
+        logPacket4(pkt, dir)
+        return
+    }
+    logPacket6(pkt, dir)
+}
+
+func logPacket4(pkt *sniffedPacket, dir string) {
+    msg, err := dhcpv4.FromBytes(pkt.payload)
+    if err != nil {
+        log.Debugw("malformed DHCPv4 packet", "dir", dir, "src", pkt.src, "error", err)
+        return
+    }
+    // a reply's address is the one offered, a request's the one wanted
+    ip := msg.YourIPAddr
+    if msg.OpCode == dhcpv4.OpcodeBootRequest {
+        if ip = msg.RequestedIPAddress(); ip == nil {
+            ip = msg.ClientIPAddr
+        }
+    }
+    kv := []interface{}{"dir", dir, "type", msg.MessageType(),
+        "mac", msg.ClientHWAddr, "xid", msg.TransactionID}
+    if !ip.IsUnspecified() {
+        kv = append(kv, "ip", ip)
+    }
+    if server := msg.ServerIdentifier(); server != nil {
+        kv = append(kv, "server", server)
+    }
+    log.Debugw("DHCPv4 packet", append(kv, "src", pkt.src, "dst", pkt.dst)...)
+}
+
+func logPacket6(pkt *sniffedPacket, dir string) {
+    d, err := dhcpv6.FromBytes(pkt.payload)
+    if err != nil {
+        log.Debugw("malformed DHCPv6 packet", "dir", dir, "src", pkt.src, "error", err)
+        return
+    }
+    kv := []interface{}{"dir", dir, "type", d.Type()}
+    msg, err := d.GetInnerMessage()
+    if err != nil {
+        log.Debugw("DHCPv6 packet", append(kv, "src", pkt.src, "dst", pkt.dst, "error", err)...)
+        return
+    }
+    if d.IsRelay() {
+        kv = append(kv, "inner", msg.Type())
+    }
+    kv = append(kv, "xid", msg.TransactionID)
+    // only a client's own packets carry its MAC
+    if pkt.dstPort == portServer6 && !pkt.outgoing && !d.IsRelay() {
+        kv = append(kv, "mac", pkt.srcMAC)
+    }
+    if iana := msg.Options.OneIANA(); iana != nil {
+        if addr := iana.Options.OneAddress(); addr != nil {
+            kv = append(kv, "ip", addr.IPv6Addr)
+        }
+    }
+    log.Debugw("DHCPv6 packet", append(kv, "src", pkt.src, "dst", pkt.dst)...)
+}
@@ -0,0 +1,390 @@
+package dhcp
+
+import (
+    "encoding/binary"
+    "encoding/hex"
+    "fmt"
+    "net"
+    "regexp"
+    "strconv"
+    "strings"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+    "github.com/insomniacslk/dhcp/rfc1035label"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// optionsPlugin pushes configured raw options at pool, class and
+// reservation level. Its argument is the id of a registered *optionSet.
+var optionsPlugin = plugins.Plugin{
+    Name:   "options",
+    Setup4: setupOptions4,
+    Setup6: setupOptions6,
+}
+
+// rawOption is an option already encoded for the wire
+type rawOption struct {
+    code uint16
+    data []byte
+}
+
+// encodedOptions holds one level's options split by family
+type encodedOptions struct {
+    v4 []rawOption
+    v6 []rawOption
+}
+
+// clientClass is a compiled krouter.ClientClass
+type clientClass struct {
+    name        string
+    vendorClass *regexp.Regexp
+    userClass   *regexp.Regexp
+    macPrefix   [][]byte
+    device      *regexp.Regexp
+    options     encodedOptions
+}
+
+// optionSet is everything the options plugin needs to answer a client
+type optionSet struct {
+    pool    encodedOptions
+    classes []*clientClass
+    hosts   map[string]encodedOptions // MAC -> reservation options
+    devices *fingerprinter
+}
+
+func newOptionSet(cfg *krouter.Config, devices *fingerprinter) (*optionSet, error) {
+    set := &optionSet{hosts: make(map[string]encodedOptions), devices: devices}
+
+    var err error
+    if set.pool, err = encodeOptions(cfg.DHCP.Options); err != nil {
+        return nil, fmt.Errorf("pool options: %w", err)
+    }
+    for _, cc := range cfg.DHCP.Classes {
+        c, err := compileClass(cc)
+        if err != nil {
+            return nil, fmt.Errorf("class %s: %w", cc.Name, err)
+        }
+        set.classes = append(set.classes, c)
+    }
+    for _, r := range cfg.DHCP.Reservations {
+        if len(r.Options) == 0 {
+            continue
+        }
+        mac, err := net.ParseMAC(r.MAC)
+        if err != nil {
+            return nil, fmt.Errorf("reservation %s: %w", r.MAC, err)
+        }
+        if set.hosts[mac.String()], err = encodeOptions(r.Options); err != nil {
+            return nil, fmt.Errorf("reservation %s options: %w", r.MAC, err)
+        }
+    }
+    return set, nil
+}
+
+// empty reports whether the plugin has nothing to do
+func (set *optionSet) empty() bool {
+    return len(set.pool.v4)+len(set.pool.v6) == 0 && len(set.classes) == 0 && len(set.hosts) == 0
+}
+
+func compileClass(cc krouter.ClientClass) (*clientClass, error) {
+    c := &clientClass{name: cc.Name}
+    var err error
+    compile := func(expr string) *regexp.Regexp {
+        if expr == "" || err != nil {
+            return nil
+        }
+        var re *regexp.Regexp
+        re, err = regexp.Compile("(?i)" + expr)
+        return re
+    }
+    c.vendorClass = compile(cc.VendorClass)
+    c.userClass = compile(cc.UserClass)
+    c.device = compile(cc.Device)
+    if err != nil {
+        return nil, err
+    }
+    for _, prefix := range cc.MACPrefix {
+        b, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "", ".", "").Replace(prefix))
+        if err != nil || len(b) == 0 || len(b) > 6 {
+            return nil, fmt.Errorf("invalid MAC prefix %q", prefix)
+        }
+        c.macPrefix = append(c.macPrefix, b)
+    }
+    if c.vendorClass == nil && c.userClass == nil && c.device == nil && len(c.macPrefix) == 0 {
+        return nil, fmt.Errorf("no selectors, use pool options instead")
+    }
+    if c.options, err = encodeOptions(cc.Options); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// matches checks every selector the class sets
+func (c *clientClass) matches(mac net.HardwareAddr, vendor string, users []string, dev *Device) bool {
+    if c.vendorClass != nil && !c.vendorClass.MatchString(vendor) {
+        return false
+    }
+    if c.userClass != nil && !matchesAnyString(c.userClass, users) {
+        return false
+    }
+    if len(c.macPrefix) > 0 {
+        found := false
+        for _, p := range c.macPrefix {
+            if len(mac) >= len(p) && string(mac[:len(p)]) == string(p) {
+                found = true
+                break
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+    if c.device != nil {
+        if dev == nil || !matchesAnyString(c.device, []string{dev.Device, dev.OS, dev.Type}) {
+            return false
+        }
+    }
+    return true
+}
+
+func matchesAnyString(re *regexp.Regexp, values []string) bool {
+    for _, v := range values {
+        if v != "" && re.MatchString(v) {
+            return true
+        }
+    }
+    return false
+}
+
+// forClient returns the option levels that apply to a client, lowest
+// precedence first
+func (set *optionSet) forClient(mac net.HardwareAddr, vendor string, users []string) []encodedOptions {
+    levels := []encodedOptions{set.pool}
+    if len(set.classes) > 0 {
+        var dev *Device
+        if set.devices != nil && mac != nil {
+            if d, ok := set.devices.device(mac); ok {
+                dev = &d
+            }
+        }
+        for _, c := range set.classes {
+            if c.matches(mac, vendor, users, dev) {
+                levels = append(levels, c.options)
+            }
+        }
+    }
+    if mac != nil {
+        if host, ok := set.hosts[mac.String()]; ok {
+            levels = append(levels, host)
+        }
+    }
+    return levels
+}
+
+func setupOptions4(args ...string) (handler.Handler4, error) {
+    set, err := lookupOptionSet(args)
+    if err != nil {
+        return nil, err
+    }
+    return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+        for _, level := range set.forClient(req.ClientHWAddr, req.ClassIdentifier(), req.UserClass()) {
+            for _, o := range level.v4 {
+                resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(o.code), o.data))
+            }
+        }
+        return resp, false
+    }, nil
+}
+
+func setupOptions6(args ...string) (handler.Handler6, error) {
+    set, err := lookupOptionSet(args)
+    if err != nil {
+        return nil, err
+    }
+    return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+        msg, err := req.GetInnerMessage()
+        if err != nil {
+            return resp, false
+        }
+        mac, _ := dhcpv6.ExtractMAC(req)
+
+        var vendor string
+        if vcs := msg.Options.VendorClasses(); len(vcs) > 0 && len(vcs[0].Data) > 0 {
+            vendor = string(vcs[0].Data[0])
+        }
+        var users []string
+        for _, uc := range msg.Options.UserClasses() {
+            users = append(users, string(uc))
+        }
+
+        for _, level := range set.forClient(mac, vendor, users) {
+            for _, o := range level.v6 {
+                resp.UpdateOption(&dhcpv6.OptionGeneric{
+                    OptionCode: dhcpv6.OptionCode(o.code),
+                    OptionData: o.data,
+                })
+            }
+        }
+        return resp, false
+    }, nil
+}
+
+func lookupOptionSet(args []string) (*optionSet, error) {
+    v, err := lookupInstance("options", args)
+    if err != nil {
+        return nil, err
+    }
+    set, ok := v.(*optionSet)
+    if !ok {
+        return nil, fmt.Errorf("options: instance %q is not an option set", args[0])
+    }
+    return set, nil
+}
+
+// encodeOptions validates and encodes a level's options
+func encodeOptions(opts []krouter.DHCPOption) (encodedOptions, error) {
+    var out encodedOptions
+    for _, o := range opts {
+        v6 := false
+        switch strings.ToLower(o.Family) {
+        case "", "v4", "4":
+        case "v6", "6":
+            v6 = true
+        default:
+            return out, fmt.Errorf("option %d: unknown family %q", o.Code, o.Family)
+        }
+        if o.Code == 0 || (!v6 && o.Code >= 255) {
+            return out, fmt.Errorf("option %d: code out of range", o.Code)
+        }
+        data, err := encodeOptionValue(o.Type, o.Value, v6)
+        if err != nil {
+            return out, fmt.Errorf("option %d: %w", o.Code, err)
+        }
+        // DHCPv4 values over 255 bytes, long route or search lists, go
+        // out split across repeated options as RFC 3396 describes
+        if v6 && len(data) > 0xffff {
+            return out, fmt.Errorf("option %d: value is %d bytes, DHCPv6 allows 65535", o.Code, len(data))
+        }
+        if v6 {
+            out.v6 = append(out.v6, rawOption{o.Code, data})
+        } else {
+            out.v4 = append(out.v4, rawOption{o.Code, data})
+        }
+    }
+    return out, nil
+}
+
+// encodeOptionValue turns a typed config value into option data
+func encodeOptionValue(typ, value string, v6 bool) ([]byte, error) {
+    typ = strings.ToLower(typ)
+    switch typ {
+    case "string", "":
+        return []byte(value), nil
+
+    case "hex":
+        b, err := hex.DecodeString(strings.NewReplacer(":", "", " ", "").Replace(value))
+        if err != nil {
+            return nil, fmt.Errorf("invalid hex %q", value)
+        }
+        return b, nil
+
+    case "bool":
+        b, err := strconv.ParseBool(value)
+        if err != nil {
+            return nil, fmt.Errorf("invalid bool %q", value)
+        }
+        if b {
+            return []byte{1}, nil
+        }
+        return []byte{0}, nil
+
+    case "uint8", "uint16", "uint32":
+        bits, _ := strconv.Atoi(strings.TrimPrefix(typ, "uint"))
+        n, err := strconv.ParseUint(value, 0, bits)
+        if err != nil {
+            return nil, fmt.Errorf("invalid %s %q", typ, value)
+        }
+        b := make([]byte, 8)
+        binary.BigEndian.PutUint64(b, n)
+        return b[8-bits/8:], nil
+
+    case "ip", "ips":
+        addrs := splitList(value)
+        if len(addrs) == 0 {
+            return nil, fmt.Errorf("%s needs an address", typ)
+        }
+        if typ == "ip" && len(addrs) > 1 {
+            return nil, fmt.Errorf("ip takes one address, use ips for a list")
+        }
+        var out []byte
+        for _, s := range addrs {
+            ip := net.ParseIP(s)
+            if ip == nil || (ip.To4() != nil) == v6 {
+                return nil, fmt.Errorf("invalid address %q for this family", s)
+            }
+            if v6 {
+                out = append(out, ip.To16()...)
+            } else {
+                out = append(out, ip.To4()...)
+            }
+        }
+        return out, nil
+
+    case "domains":
+        labels := &rfc1035label.Labels{Labels: splitList(value)}
+        if len(labels.Labels) == 0 {
+            return nil, fmt.Errorf("domains needs at least one name")
+        }
+        return labels.ToBytes(), nil
+
+    case "routes":
+        if v6 {
+            return nil, fmt.Errorf("routes is a DHCPv4 type")
+        }
+        return encodeClasslessRoutes(value)
+    }
+    return nil, fmt.Errorf("unknown type %q", typ)
+}
+
+// encodeClasslessRoutes encodes "prefix router" pairs per RFC 3442: the
+// prefix length, the significant octets of the destination, then the router
+func encodeClasslessRoutes(value string) ([]byte, error) {
+    var out []byte
+    for _, route := range splitList(value) {
+        fields := strings.Fields(route)
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("route %q is not \"<prefix> <router>\"", route)
+        }
+        _, dst, err := net.ParseCIDR(fields[0])
+        if err != nil || dst.IP.To4() == nil {
+            return nil, fmt.Errorf("invalid IPv4 prefix %q", fields[0])
+        }
+        router := net.ParseIP(fields[1]).To4()
+        if router == nil {
+            return nil, fmt.Errorf("invalid IPv4 router %q", fields[1])
+        }
+        ones, _ := dst.Mask.Size()
+        out = append(out, byte(ones))
+        out = append(out, dst.IP.To4()[:(ones+7)/8]...)
+        out = append(out, router...)
+    }
+    if len(out) == 0 {
+        return nil, fmt.Errorf("routes needs at least one route")
+    }
+    return out, nil
+}
+
+// splitList splits comma-separated values, dropping empty entries
+func splitList(value string) []string {
+    var out []string
+    for _, part := range strings.Split(value, ",") {
+        if part = strings.TrimSpace(part); part != "" {
+            out = append(out, part)
+        }
+    }
+    return out
+}
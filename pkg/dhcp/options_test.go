@@ -0,0 +1,154 @@
+package dhcp
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "testing"
+
+    "github.com/insomniacslk/dhcp/dhcpv4"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+func TestEncodeOptionValue(t *testing.T) {
+    tests := []struct {
+        typ, value string
+        v6         bool
+        want       []byte
+        wantErr    bool
+    }{
+        {typ: "string", value: "pxe", want: []byte("pxe")},
+        {typ: "", value: "x", want: []byte("x")},
+        {typ: "hex", value: "de:ad be ef", want: []byte{0xde, 0xad, 0xbe, 0xef}},
+        {typ: "hex", value: "xyz", wantErr: true},
+        {typ: "bool", value: "true", want: []byte{1}},
+        {typ: "bool", value: "0", want: []byte{0}},
+        {typ: "bool", value: "maybe", wantErr: true},
+        {typ: "uint8", value: "255", want: []byte{255}},
+        {typ: "uint8", value: "256", wantErr: true},
+        {typ: "uint16", value: "0x1234", want: []byte{0x12, 0x34}},
+        {typ: "UINT32", value: "3600", want: []byte{0, 0, 0x0e, 0x10}},
+        {typ: "uint32", value: "-1", wantErr: true},
+        {typ: "ip", value: "192.0.2.1", want: []byte{192, 0, 2, 1}},
+        {typ: "ip", value: "192.0.2.1, 192.0.2.2", wantErr: true},
+        {typ: "ip", value: "2001:db8::1", wantErr: true},
+        {typ: "ip", value: "2001:db8::1", v6: true, want: []byte{0x20, 0x01, 0x0d, 0xb8, 12: 0, 13: 0, 14: 0, 15: 1}},
+        {typ: "ip", value: "192.0.2.1", v6: true, wantErr: true},
+        {typ: "ips", value: "192.0.2.1, 192.0.2.2,", want: []byte{192, 0, 2, 1, 192, 0, 2, 2}},
+        {typ: "ips", value: " , ", wantErr: true},
+        {typ: "domains", value: "example.com", want: []byte("\x07example\x03com\x00")},
+        {typ: "domains", value: "", wantErr: true},
+        {typ: "routes", value: "10.0.0.0/8 192.0.2.1", want: []byte{8, 10, 192, 0, 2, 1}},
+        {typ: "routes", value: "10.0.0.0/8 192.0.2.1", v6: true, wantErr: true},
+        {typ: "float", value: "1.5", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        name := fmt.Sprintf("%s %q v6=%v", tt.typ, tt.value, tt.v6)
+        t.Run(name, func(t *testing.T) {
+            got, err := encodeOptionValue(tt.typ, tt.value, tt.v6)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("got %x, want an error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(got, tt.want) {
+                t.Errorf("got %x, want %x", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestEncodeClasslessRoutes(t *testing.T) {
+    tests := []struct {
+        name    string
+        value   string
+        want    []byte
+        wantErr bool
+    }{
+        {
+            name:  "default route",
+            value: "0.0.0.0/0 192.0.2.1",
+            want:  []byte{0, 192, 0, 2, 1},
+        },
+        {
+            // RFC 3442's own examples
+            name:  "significant octets only",
+            value: "10.17.0.0/16 10.0.0.1, 10.27.129.0/24 10.0.0.2, 10.229.0.128/25 10.0.0.3",
+            want: []byte{
+                16, 10, 17, 10, 0, 0, 1,
+                24, 10, 27, 129, 10, 0, 0, 2,
+                25, 10, 229, 0, 128, 10, 0, 0, 3,
+            },
+        },
+        {
+            name:  "host route",
+            value: "198.51.100.7/32 192.0.2.1",
+            want:  []byte{32, 198, 51, 100, 7, 192, 0, 2, 1},
+        },
+        {
+            name:  "host bits are masked",
+            value: "10.1.2.3/8 192.0.2.1",
+            want:  []byte{8, 10, 192, 0, 2, 1},
+        },
+        {name: "empty", value: "", wantErr: true},
+        {name: "missing router", value: "10.0.0.0/8", wantErr: true},
+        {name: "not a prefix", value: "10.0.0.1 192.0.2.1", wantErr: true},
+        {name: "IPv6 prefix", value: "2001:db8::/32 192.0.2.1", wantErr: true},
+        {name: "IPv6 router", value: "10.0.0.0/8 2001:db8::1", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := encodeClasslessRoutes(tt.value)
+            if tt.wantErr {
+                if err == nil {
+                    t.Fatalf("got %x, want an error", got)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !bytes.Equal(got, tt.want) {
+                t.Errorf("got %x, want %x", got, tt.want)
+            }
+        })
+    }
+}
+
+// A value over 255 bytes is split on the wire and joined again on receipt
+func TestLongOptionRoundTrip(t *testing.T) {
+    var routes []string
+    for i := 0; i < 40; i++ {
+        routes = append(routes, fmt.Sprintf("10.%d.0.0/16 192.0.2.1", i))
+    }
+    enc, err := encodeOptions([]krouter.DHCPOption{
+        {Code: 121, Type: "routes", Value: strings.Join(routes, ",")},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := enc.v4[0].data
+    if len(data) <= 255 {
+        t.Fatalf("test value is only %d bytes", len(data))
+    }
+
+    m, err := dhcpv4.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+    m.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionClasslessStaticRoute, data))
+    got, err := dhcpv4.FromBytes(m.ToBytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got.Options.Get(dhcpv4.OptionClasslessStaticRoute), data) {
+        t.Errorf("option 121 did not survive the round trip")
+    }
+}
@@ -0,0 +1,148 @@
+package dhcp
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "time"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// defaultLeaseTime is used when dhcp.lease_time is unset
+const defaultLeaseTime = time.Hour
+
+// pool4 is the DHCPv4 address pool handed out on the LAN
+type pool4 struct {
+    start     net.IP
+    end       net.IP
+    netmask   net.IP
+    router    net.IP
+    subnet    *net.IPNet
+    leaseTime time.Duration
+}
+
+// newPool4 derives the v4 pool from the LAN CIDR, applying any explicit
+// dhcp settings on top, and checks the result is usable.
+func newPool4(cfg *krouter.Config) (*pool4, error) {
+    router, subnet, err := net.ParseCIDR(cfg.Interfaces.LAN.IPv4)
+    if err != nil {
+        return nil, fmt.Errorf("invalid LAN IPv4 %q: %w", cfg.Interfaces.LAN.IPv4, err)
+    }
+    router = router.To4()
+    if router == nil {
+        return nil, fmt.Errorf("LAN IPv4 %q is not an IPv4 address", cfg.Interfaces.LAN.IPv4)
+    }
+
+    p := &pool4{
+        router:    router,
+        subnet:    subnet,
+        netmask:   net.IP(subnet.Mask).To4(),
+        leaseTime: cfg.DHCP.LeaseTime,
+    }
+    if p.leaseTime <= 0 {
+        p.leaseTime = defaultLeaseTime
+    }
+
+    if cfg.DHCP.Netmask != "" {
+        mask := net.ParseIP(cfg.DHCP.Netmask).To4()
+        if mask == nil {
+            return nil, fmt.Errorf("invalid DHCP netmask %q", cfg.DHCP.Netmask)
+        }
+        if ones, bits := net.IPMask(mask).Size(); bits == 0 {
+            return nil, fmt.Errorf("DHCP netmask %q is not contiguous", cfg.DHCP.Netmask)
+        } else if ones > 30 {
+            return nil, fmt.Errorf("DHCP netmask %q leaves no room for clients", cfg.DHCP.Netmask)
+        }
+        p.netmask = mask
+    }
+
+    start, end, err := defaultRange(router, subnet)
+    if err != nil {
+        return nil, err
+    }
+    if cfg.DHCP.PoolStart != "" {
+        if start = net.ParseIP(cfg.DHCP.PoolStart).To4(); start == nil {
+            return nil, fmt.Errorf("invalid DHCP pool start %q", cfg.DHCP.PoolStart)
+        }
+    }
+    if cfg.DHCP.PoolEnd != "" {
+        if end = net.ParseIP(cfg.DHCP.PoolEnd).To4(); end == nil {
+            return nil, fmt.Errorf("invalid DHCP pool end %q", cfg.DHCP.PoolEnd)
+        }
+    }
+    p.start, p.end = start, end
+
+    if err := p.validate(); err != nil {
+        return nil, err
+    }
+    return p, nil
+}
+
+// validate checks the pool sits inside the LAN subnet, clear of the
+// network, broadcast and router addresses
+func (p *pool4) validate() error {
+    network, broadcast := ip4ToUint(p.subnet.IP), ip4ToUint(broadcastAddr(p.subnet))
+    start, end, router := ip4ToUint(p.start), ip4ToUint(p.end), ip4ToUint(p.router)
+
+    if start > end {
+        return fmt.Errorf("DHCP pool start %s is after end %s", p.start, p.end)
+    }
+    if start <= network || end >= broadcast {
+        return fmt.Errorf("DHCP pool %s-%s is not inside LAN subnet %s", p.start, p.end, p.subnet)
+    }
+    if router >= start && router <= end {
+        return fmt.Errorf("DHCP pool %s-%s includes the router address %s", p.start, p.end, p.router)
+    }
+    if !p.subnet.Contains(p.router) {
+        return fmt.Errorf("router %s is not inside LAN subnet %s", p.router, p.subnet)
+    }
+    return nil
+}
+
+// defaultRange picks network+10 .. broadcast-5, falling back to every host
+// address on small subnets, and keeps the router out of it by taking the
+// larger side of the range when the router falls inside.
+func defaultRange(router net.IP, subnet *net.IPNet) (net.IP, net.IP, error) {
+    if ones, _ := subnet.Mask.Size(); ones > 30 {
+        return nil, nil, fmt.Errorf("LAN subnet %s is too small for a DHCP pool", subnet)
+    }
+
+    network, broadcast := ip4ToUint(subnet.IP), ip4ToUint(broadcastAddr(subnet))
+    start, end := network+10, broadcast-5
+    if start > end {
+        start, end = network+1, broadcast-1
+    }
+
+    r := ip4ToUint(router)
+    if r >= start && r <= end {
+        if r-start >= end-r {
+            end = r - 1
+        } else {
+            start = r + 1
+        }
+        if start > end {
+            return nil, nil, fmt.Errorf("LAN subnet %s has no room for a DHCP pool besides the router", subnet)
+        }
+    }
+    return uintToIP4(start), uintToIP4(end), nil
+}
+
+func broadcastAddr(n *net.IPNet) net.IP {
+    ip := n.IP.To4()
+    out := make(net.IP, net.IPv4len)
+    for i := range ip {
+        out[i] = ip[i] | ^n.Mask[len(n.Mask)-net.IPv4len+i]
+    }
+    return out
+}
+
+func ip4ToUint(ip net.IP) uint32 {
+    return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP4(v uint32) net.IP {
+    ip := make(net.IP, net.IPv4len)
+    binary.BigEndian.PutUint32(ip, v)
+    return ip
+}
@@ -0,0 +1,143 @@
+package dhcp
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "time"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// the default IA_NA range inside the LAN prefix, well clear of the router
+// and of hand-numbered hosts at the bottom of the /64
+const (
+    defaultPool6Start = 0x1000
+    defaultPool6End   = 0x1fff
+)
+
+// pool6 is the DHCPv6 address range and delegation pool
+type pool6 struct {
+    start     net.IP
+    end       net.IP
+    router    net.IP
+    subnet    *net.IPNet
+    leaseTime time.Duration
+    // pd is nil when prefix delegation is off
+    pd        *net.IPNet
+    pdLength  int
+}
+
+// newPool6 derives the v6 pool from the LAN prefix, applying any explicit
+// dhcp.v6 settings on top. It returns nil when the LAN has no IPv6 prefix.
+func newPool6(cfg *krouter.Config) (*pool6, error) {
+    if cfg.Interfaces.LAN.IPv6 == "" {
+        return nil, nil
+    }
+    router, subnet, err := net.ParseCIDR(cfg.Interfaces.LAN.IPv6)
+    if err != nil {
+        return nil, fmt.Errorf("invalid LAN IPv6 %q: %w", cfg.Interfaces.LAN.IPv6, err)
+    }
+    if router.To4() != nil {
+        return nil, fmt.Errorf("LAN IPv6 %q is not an IPv6 address", cfg.Interfaces.LAN.IPv6)
+    }
+    if ones, _ := subnet.Mask.Size(); ones > 64 {
+        return nil, fmt.Errorf("LAN IPv6 prefix %s is longer than /64", subnet)
+    }
+
+    p := &pool6{
+        router:    router,
+        subnet:    subnet,
+        leaseTime: cfg.DHCP.V6.LeaseTime,
+        start:     ip6WithHost(subnet.IP, defaultPool6Start),
+        end:       ip6WithHost(subnet.IP, defaultPool6End),
+    }
+    if p.leaseTime <= 0 {
+        p.leaseTime = cfg.DHCP.LeaseTime
+    }
+    if p.leaseTime <= 0 {
+        p.leaseTime = defaultLeaseTime
+    }
+
+    if v := cfg.DHCP.V6.PoolStart; v != "" {
+        if p.start = net.ParseIP(v); p.start == nil || p.start.To4() != nil {
+            return nil, fmt.Errorf("invalid DHCPv6 pool start %q", v)
+        }
+    }
+    if v := cfg.DHCP.V6.PoolEnd; v != "" {
+        if p.end = net.ParseIP(v); p.end == nil || p.end.To4() != nil {
+            return nil, fmt.Errorf("invalid DHCPv6 pool end %q", v)
+        }
+    }
+
+    if pd := cfg.DHCP.V6.PrefixDelegation; pd.Pool != "" {
+        _, p.pd, err = net.ParseCIDR(pd.Pool)
+        if err != nil || p.pd.IP.To4() != nil {
+            return nil, fmt.Errorf("invalid prefix delegation pool %q", pd.Pool)
+        }
+        p.pdLength = pd.Length
+    }
+
+    if err := p.validate(); err != nil {
+        return nil, err
+    }
+    return p, nil
+}
+
+// validate checks the range sits in one /64 of the LAN prefix, clear of the
+// router, and that the delegation pool can be carved into prefixes
+func (p *pool6) validate() error {
+    if !p.subnet.Contains(p.start) || !p.subnet.Contains(p.end) {
+        return fmt.Errorf("DHCPv6 pool %s-%s is not inside LAN prefix %s", p.start, p.end, p.subnet)
+    }
+    if !sameNetwork64(p.start, p.end) {
+        return fmt.Errorf("DHCPv6 pool %s-%s spans more than one /64", p.start, p.end)
+    }
+    start, end := ip6Host(p.start), ip6Host(p.end)
+    if start > end {
+        return fmt.Errorf("DHCPv6 pool start %s is after end %s", p.start, p.end)
+    }
+    if start == 0 {
+        return fmt.Errorf("DHCPv6 pool %s-%s includes the subnet-router anycast address", p.start, p.end)
+    }
+    if sameNetwork64(p.router, p.start) && ip6Host(p.router) >= start && ip6Host(p.router) <= end {
+        return fmt.Errorf("DHCPv6 pool %s-%s includes the router address %s", p.start, p.end, p.router)
+    }
+
+    if p.pd == nil {
+        return nil
+    }
+    poolLen, _ := p.pd.Mask.Size()
+    if p.pdLength < poolLen || p.pdLength > 64 {
+        return fmt.Errorf("delegated prefix length /%d must be between the pool's /%d and /64", p.pdLength, poolLen)
+    }
+    if p.pdLength-poolLen > 24 {
+        return fmt.Errorf("prefix delegation pool %s holds too many /%d prefixes", p.pd, p.pdLength)
+    }
+    if p.pd.Contains(p.subnet.IP) || p.subnet.Contains(p.pd.IP) {
+        return fmt.Errorf("prefix delegation pool %s overlaps LAN prefix %s", p.pd, p.subnet)
+    }
+    return nil
+}
+
+// size is how many addresses the IA_NA range holds
+func (p *pool6) size() uint64 {
+    return ip6Host(p.end) - ip6Host(p.start) + 1
+}
+
+// ip6Host returns the interface identifier, the low 64 bits
+func ip6Host(ip net.IP) uint64 {
+    return binary.BigEndian.Uint64(ip.To16()[8:])
+}
+
+// ip6WithHost sets the interface identifier of network's /64
+func ip6WithHost(network net.IP, host uint64) net.IP {
+    ip := make(net.IP, net.IPv6len)
+    copy(ip, network.To16()[:8])
+    binary.BigEndian.PutUint64(ip[8:], host)
+    return ip
+}
+
+func sameNetwork64(a, b net.IP) bool {
+    return string(a.To16()[:8]) == string(b.To16()[:8])
+}
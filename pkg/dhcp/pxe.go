@@ -0,0 +1,139 @@
+package dhcp
+
+import (
+    "bytes"
+    "fmt"
+    "net"
+    "strings"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/iana"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+    "github.com/ryanvillarreal/krouter/pkg/pxe"
+)
+
+// pxePlugin points netbooting clients at the boot file for their firmware.
+// Its argument is the id of a registered *bootMenu.
+var pxePlugin = plugins.Plugin{
+    Name:   "pxe",
+    Setup4: setupPXE4,
+}
+
+// vendor classes (option 60) of netbooting firmware
+const (
+    classPXE  = "PXEClient"
+    classHTTP = "HTTPClient"
+)
+
+// optionIPXE is the option space iPXE sends its feature flags in
+const optionIPXE = dhcpv4.GenericOptionCode(175)
+
+// bootMenu maps client architectures (option 93) to boot files
+type bootMenu struct {
+    // server is the TFTP server, sent as next-server and option 66
+    server net.IP
+    // files are TFTP boot files for PXE, urls are for UEFI HTTP boot
+    files  map[iana.Arch]string
+    urls   map[iana.Arch]string
+    // ipxe is the script URL for clients already running iPXE
+    ipxe   string
+}
+
+func newBootMenu(cfg *krouter.Config) (*bootMenu, error) {
+    server := krouter.HostIP(cfg.Interfaces.LAN.IPv4).To4()
+    if server == nil {
+        return nil, fmt.Errorf("PXE needs a LAN IPv4 address")
+    }
+    // next-server and option 66 carry no port, so firmware always asks 69
+    if cfg.PXE.TFTPPort != 69 {
+        return nil, fmt.Errorf("PXE clients only use TFTP port 69, not pxe.tftp_port %d", cfg.PXE.TFTPPort)
+    }
+    m := &bootMenu{
+        server: server,
+        files:  make(map[iana.Arch]string),
+        urls:   make(map[iana.Arch]string),
+    }
+    // firmware asking for PXE and for HTTP boot share a file
+    add := func(file string, pxeArchs []iana.Arch, httpArchs []iana.Arch) {
+        if file == "" {
+            return
+        }
+        for _, a := range pxeArchs {
+            m.files[a] = file
+        }
+        for _, a := range httpArchs {
+            m.urls[a] = pxe.URL(cfg, file)
+        }
+    }
+    add(cfg.PXE.BIOS, []iana.Arch{iana.INTEL_X86PC}, nil)
+    // RFC 4578 has 7 as EFI BC and 9 as x86-64; firmware uses both for x86-64
+    add(cfg.PXE.UEFI, []iana.Arch{iana.EFI_X86_64, iana.EFI_BC}, []iana.Arch{iana.EFI_X86_64_HTTP})
+    add(cfg.PXE.UEFI32, []iana.Arch{iana.EFI_IA32}, []iana.Arch{iana.EFI_X86_HTTP})
+    add(cfg.PXE.ARM64, []iana.Arch{iana.EFI_ARM64}, []iana.Arch{iana.EFI_ARM64_HTTP})
+    if cfg.PXE.IPXE != "" {
+        m.ipxe = pxe.URL(cfg, cfg.PXE.IPXE)
+    }
+    return m, nil
+}
+
+// isIPXE spots iPXE by its user class or its own option space. Handing it
+// the iPXE binary again would loop forever.
+func isIPXE(req *dhcpv4.DHCPv4) bool {
+    if bytes.Contains(req.Options.Get(dhcpv4.OptionUserClassInformation), []byte("iPXE")) {
+        return true
+    }
+    return req.Options.Has(optionIPXE)
+}
+
+func (m *bootMenu) handle4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+    vendor := req.ClassIdentifier()
+    ipxe := isIPXE(req)
+    if !ipxe && !strings.HasPrefix(vendor, classPXE) && !strings.HasPrefix(vendor, classHTTP) {
+        return resp, false
+    }
+    arch := iana.INTEL_X86PC
+    if archs := req.ClientArch(); len(archs) > 0 {
+        arch = archs[0]
+    }
+
+    var file string
+    switch {
+    case ipxe:
+        file = m.ipxe
+    case strings.HasPrefix(vendor, classHTTP):
+        // UEFI only takes the offer if the vendor class comes back
+        if file = m.urls[arch]; file != "" {
+            resp.UpdateOption(dhcpv4.OptClassIdentifier(classHTTP))
+        }
+    default:
+        if file = m.files[arch]; file != "" {
+            resp.ServerIPAddr = m.server
+            resp.BootFileName = file
+            resp.UpdateOption(dhcpv4.OptTFTPServerName(m.server.String()))
+        }
+    }
+    if file == "" {
+        log.Warnw("no PXE boot file", "mac", req.ClientHWAddr, "arch", arch)
+        return resp, false
+    }
+    resp.UpdateOption(dhcpv4.OptBootFileName(file))
+    if req.MessageType() == dhcpv4.MessageTypeRequest {
+        log.Infow("PXE boot", "mac", req.ClientHWAddr, "arch", arch, "file", file)
+    }
+    return resp, false
+}
+
+func setupPXE4(args ...string) (handler.Handler4, error) {
+    v, err := lookupInstance("pxe", args)
+    if err != nil {
+        return nil, err
+    }
+    m, ok := v.(*bootMenu)
+    if !ok {
+        return nil, fmt.Errorf("pxe: instance %q is not a boot menu", args[0])
+    }
+    return m.handle4, nil
+}
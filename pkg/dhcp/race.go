@@ -0,0 +1,311 @@
+package dhcp
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// racePlugin answers only target clients in race mode. Its first argument
+// is the id of a registered *racer. Early in the chain it drops everyone
+// else and copies in the rival's parameters; with a second argument, pin,
+// it sits just ahead of the allocator and hands out the rival's address
+// for the client instead.
+var racePlugin = plugins.Plugin{
+    Name:   "race",
+    Setup4: setupRace4,
+}
+
+const modeRace = "race"
+
+// mirroredOptions are the rival's parameters a target needs to keep
+// working on its subnet. Router and DNS are never among them.
+var mirroredOptions = []dhcpv4.OptionCode{
+    dhcpv4.OptionSubnetMask,
+    dhcpv4.OptionTimeOffset,
+    dhcpv4.OptionDomainName,
+    dhcpv4.OptionInterfaceMTU,
+    dhcpv4.OptionBroadcastAddress,
+    dhcpv4.OptionNTPServers,
+    dhcpv4.OptionIPAddressLeaseTime,
+    dhcpv4.OptionRenewTimeValue,
+    dhcpv4.OptionRebindingTimeValue,
+    dhcpv4.OptionDNSDomainSearchList,
+}
+
+// Capture is a target client that took an address from krouter in race
+// mode
+type Capture struct {
+    MAC           net.HardwareAddr
+    IP            net.IP
+    Hostname      string
+    // Rival is the other server seen answering the client, if any
+    Rival         net.IP
+    // Mirrored is set when the address came from the rival's subnet
+    Mirrored      bool
+    FirstCaptured time.Time
+    LastCaptured  time.Time
+    // ACKs counts acknowledgements sent to the client
+    ACKs          int
+}
+
+// rival is the server krouter races, as learned from its replies
+type rival struct {
+    server  net.IP
+    subnet  *net.IPNet
+    options dhcpv4.Options
+}
+
+// rivalLease is what the rival last handed a target
+type rivalLease struct {
+    ip     net.IP
+    server net.IP
+}
+
+// racer answers target clients as fast as the plugin chain allows, ahead
+// of the server already on the LAN, and records those it captures
+type racer struct {
+    targets map[string]bool
+    mirror  bool
+    lanIP   net.IP
+
+    mu        sync.Mutex
+    rival     *rival
+    leases    map[string]rivalLease // target MAC -> rival's lease
+    hostnames map[string]string     // target MAC -> last hostname sent
+    captured  map[string]*Capture
+}
+
+func newRacer(cfg *krouter.Config) (*racer, error) {
+    if len(cfg.DHCP.Race.Targets) == 0 {
+        return nil, errors.New("race mode needs dhcp.race.targets")
+    }
+    r := &racer{
+        targets:   make(map[string]bool),
+        mirror:    cfg.DHCP.Race.Mirror,
+        lanIP:     krouter.HostIP(cfg.Interfaces.LAN.IPv4).To4(),
+        leases:    make(map[string]rivalLease),
+        hostnames: make(map[string]string),
+        captured:  make(map[string]*Capture),
+    }
+    for _, t := range cfg.DHCP.Race.Targets {
+        mac, err := net.ParseMAC(t)
+        if err != nil {
+            return nil, fmt.Errorf("race target %q: %w", t, err)
+        }
+        r.targets[mac.String()] = true
+    }
+    return r, nil
+}
+
+// adopt keeps what prev learned and captured, so a reload loses neither
+func (r *racer) adopt(prev *racer) {
+    prev.mu.Lock()
+    defer prev.mu.Unlock()
+    r.rival = prev.rival
+    for mac, l := range prev.leases {
+        r.leases[mac] = l
+    }
+    for mac, c := range prev.captured {
+        r.captured[mac] = c
+    }
+}
+
+// handle4 drops non-targets and gives targets the rival's parameters
+func (r *racer) handle4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+    mac := req.ClientHWAddr.String()
+    if !r.targets[mac] {
+        return nil, true
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if hostname := req.HostName(); hostname != "" {
+        r.hostnames[mac] = hostname
+    }
+    if r.mirror && r.rival != nil {
+        for code, v := range r.rival.options {
+            resp.Options[code] = v
+        }
+    }
+    return resp, false
+}
+
+// pin4 hands a target the rival's address for it, sparing the pool and
+// the client a renumbering
+func (r *racer) pin4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+    ip := r.mirroredAddress(req)
+    if ip == nil {
+        return resp, false
+    }
+    resp.YourIPAddr = ip
+    return resp, true
+}
+
+// mirroredAddress picks an address in the rival's subnet: on a DISCOVER
+// the one the rival last gave the client, else whatever the client asks
+// to keep. A REQUEST can only be granted what it names.
+func (r *racer) mirroredAddress(req *dhcpv4.DHCPv4) net.IP {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.rival == nil || r.rival.subnet == nil {
+        return nil
+    }
+    candidates := []net.IP{req.RequestedIPAddress(), req.ClientIPAddr}
+    if req.MessageType() == dhcpv4.MessageTypeDiscover {
+        candidates = append([]net.IP{r.leases[req.ClientHWAddr.String()].ip}, candidates...)
+    }
+    subnet := r.rival.subnet
+    for _, ip := range candidates {
+        ip = ip.To4()
+        if ip == nil || ip.IsUnspecified() || !subnet.Contains(ip) || ip.Equal(r.lanIP) || ip.Equal(r.rival.server) {
+            continue
+        }
+        // neither the network nor the broadcast address
+        if ip.Equal(subnet.IP) || ip.Equal(broadcastOf(subnet)) {
+            continue
+        }
+        return ip
+    }
+    return nil
+}
+
+func broadcastOf(n *net.IPNet) net.IP {
+    ip := make(net.IP, len(n.IP))
+    for i := range ip {
+        ip[i] = n.IP[i] | ^n.Mask[i]
+    }
+    return ip
+}
+
+// observe learns the rival from its replies and records captures from
+// ours
+func (r *racer) observe(pkt *sniffedPacket) {
+    if pkt.srcPort != portServer4 {
+        return
+    }
+    msg, err := dhcpv4.FromBytes(pkt.payload)
+    if err != nil || msg.OpCode != dhcpv4.OpcodeBootReply {
+        return
+    }
+    if pkt.outgoing {
+        if msg.MessageType() == dhcpv4.MessageTypeAck {
+            r.capture(msg, pkt.time)
+        }
+        return
+    }
+    switch msg.MessageType() {
+    case dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck:
+        r.learn(msg, pkt.src)
+    }
+}
+
+// learn takes the rival's subnet parameters from a reply, and its lease
+// when the client is a target
+func (r *racer) learn(msg *dhcpv4.DHCPv4, src net.IP) {
+    server := msg.ServerIdentifier()
+    if server == nil {
+        server = src
+    }
+    rv := &rival{server: server, options: make(dhcpv4.Options)}
+    for _, code := range mirroredOptions {
+        if v := msg.Options.Get(code); v != nil {
+            rv.options[code.Code()] = v
+        }
+    }
+    if mask := msg.SubnetMask(); mask != nil && !msg.YourIPAddr.IsUnspecified() {
+        rv.subnet = &net.IPNet{IP: msg.YourIPAddr.Mask(mask), Mask: mask}
+    }
+
+    mac := msg.ClientHWAddr.String()
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.targets[mac] && !msg.YourIPAddr.IsUnspecified() {
+        r.leases[mac] = rivalLease{ip: msg.YourIPAddr, server: server}
+    }
+    // an INFORM answer has no subnet, so the one known is kept
+    if rv.subnet == nil {
+        if r.rival == nil || !r.rival.server.Equal(server) {
+            return
+        }
+        rv.subnet = r.rival.subnet
+    }
+    changed := r.rival == nil || !r.rival.server.Equal(server) || r.rival.subnet.String() != rv.subnet.String()
+    r.rival = rv
+    if !changed || !r.mirror {
+        return
+    }
+    log.Infow("race mirroring rival", "server", server, "subnet", rv.subnet)
+    if r.lanIP != nil && !rv.subnet.Contains(r.lanIP) {
+        log.Warnw("LAN address is outside the rival subnet, captured clients will not reach krouter", "lan", r.lanIP, "subnet", rv.subnet)
+    }
+}
+
+// capture records an ACK krouter sent a target
+func (r *racer) capture(msg *dhcpv4.DHCPv4, now time.Time) {
+    mac := msg.ClientHWAddr.String()
+    if !r.targets[mac] || msg.YourIPAddr.IsUnspecified() {
+        return
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    c, ok := r.captured[mac]
+    if !ok {
+        c = &Capture{MAC: append(net.HardwareAddr{}, msg.ClientHWAddr...), FirstCaptured: now}
+        r.captured[mac] = c
+    }
+    c.IP = msg.YourIPAddr
+    c.Hostname = r.hostnames[mac]
+    c.Rival = r.leases[mac].server
+    c.Mirrored = r.mirror && r.rival != nil && r.rival.subnet.Contains(c.IP)
+    c.LastCaptured = now
+    c.ACKs++
+    if !ok {
+        log.Infow("race captured client", "mac", mac, "hostname", c.Hostname, "ip", c.IP, "rival", c.Rival)
+    }
+}
+
+// all returns the captured clients, first captured first
+func (r *racer) all() []Capture {
+    r.mu.Lock()
+    out := make([]Capture, 0, len(r.captured))
+    for _, c := range r.captured {
+        out = append(out, *c)
+    }
+    r.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool {
+        return out[i].FirstCaptured.Before(out[j].FirstCaptured)
+    })
+    return out
+}
+
+func setupRace4(args ...string) (handler.Handler4, error) {
+    stage := ""
+    if len(args) == 2 {
+        args, stage = args[:1], args[1]
+    }
+    v, err := lookupInstance("race", args)
+    if err != nil {
+        return nil, err
+    }
+    r, ok := v.(*racer)
+    if !ok {
+        return nil, fmt.Errorf("race: instance %q is not a racer", args[0])
+    }
+    switch stage {
+    case "":
+        return r.handle4, nil
+    case "pin":
+        return r.pin4, nil
+    }
+    return nil, fmt.Errorf("race: unknown stage %q", stage)
+}
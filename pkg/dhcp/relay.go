@@ -0,0 +1,373 @@
+package dhcp
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "net"
+    "sync"
+
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/dhcpv4/server4"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+    "github.com/insomniacslk/dhcp/dhcpv6/server6"
+    "golang.org/x/net/ipv6"
+    "golang.org/x/sys/unix"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// DHCP service modes
+const (
+    modeServer = "server"
+    modeRelay  = "relay"
+)
+
+// hop limits past which a relayed message is dropped, RFC 1542 and RFC 8415
+const (
+    maxHops4 = 16
+    maxHops6 = 8
+)
+
+// relay forwards LAN clients to upstream servers over the WAN, as an
+// RFC 3046 relay agent for DHCPv4 and an RFC 8415 one for DHCPv6
+type relay struct {
+    lan      *net.Interface
+    wan      string
+    // giaddr is the LAN address servers answer to and choose a subnet by
+    giaddr   net.IP
+    // link6 is the LAN address put in Relay-Forw, unspecified when the
+    // LAN has no global one and the Interface-ID has to do
+    link6    net.IP
+    servers  []*net.UDPAddr
+    servers6 []*net.UDPAddr
+    circuit  []byte
+    remote   []byte
+    devices  *fingerprinter
+
+    lan4, wan4 *net.UDPConn
+    lan6, wan6 *net.UDPConn
+    // fd is an AF_PACKET socket for replies to clients without an address
+    fd         int
+}
+
+func newRelay(cfg *krouter.Config) (*relay, error) {
+    rc := cfg.DHCP.Relay
+    if len(rc.Servers) == 0 && len(rc.Servers6) == 0 {
+        return nil, errors.New("relay mode needs dhcp.relay.servers or servers6")
+    }
+    if cfg.Interfaces.WAN == "" {
+        return nil, errors.New("relay mode needs a WAN interface")
+    }
+    lan, err := net.InterfaceByName(cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get interface: %w", err)
+    }
+    r := &relay{
+        lan:     lan,
+        wan:     cfg.Interfaces.WAN,
+        circuit: []byte(rc.CircuitID),
+        remote:  []byte(rc.RemoteID),
+        link6:   net.IPv6unspecified,
+        fd:      -1,
+    }
+    if len(r.circuit) == 0 {
+        r.circuit = []byte(lan.Name)
+    }
+
+    for _, a := range rc.Servers {
+        ip := net.ParseIP(a).To4()
+        if ip == nil {
+            return nil, fmt.Errorf("relay server %q is not an IPv4 address", a)
+        }
+        r.servers = append(r.servers, &net.UDPAddr{IP: ip, Port: portServer4})
+    }
+    if len(r.servers) > 0 {
+        if r.giaddr = krouter.HostIP(cfg.Interfaces.LAN.IPv4).To4(); r.giaddr == nil {
+            return nil, errors.New("DHCPv4 relay needs a LAN IPv4 address")
+        }
+    }
+
+    for _, a := range rc.Servers6 {
+        ip := net.ParseIP(a)
+        if ip == nil || ip.To4() != nil {
+            return nil, fmt.Errorf("relay server %q is not an IPv6 address", a)
+        }
+        srv := &net.UDPAddr{IP: ip, Port: portServer6}
+        if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+            srv.Zone = r.wan
+        }
+        r.servers6 = append(r.servers6, srv)
+    }
+    if ip := krouter.HostIP(cfg.Interfaces.LAN.IPv6); ip != nil && ip.IsGlobalUnicast() {
+        r.link6 = ip
+    }
+    return r, nil
+}
+
+// open binds the relay's sockets; on the LAN they take the server ports
+// clients send to, on the WAN the ports servers answer on
+func (r *relay) open() error {
+    var err error
+    if len(r.servers) > 0 {
+        any4 := &net.UDPAddr{IP: net.IPv4zero, Port: portServer4}
+        if r.lan4, err = server4.NewIPv4UDPConn(r.lan.Name, any4); err != nil {
+            r.close()
+            return fmt.Errorf("failed to listen on %s: %w", r.lan.Name, err)
+        }
+        if r.wan4, err = server4.NewIPv4UDPConn(r.wan, any4); err != nil {
+            r.close()
+            return fmt.Errorf("failed to listen on %s: %w", r.wan, err)
+        }
+        if r.fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0); err != nil {
+            r.close()
+            return fmt.Errorf("failed to open packet socket: %w", err)
+        }
+    }
+    if len(r.servers6) > 0 {
+        any6 := &net.UDPAddr{IP: net.IPv6unspecified, Port: portServer6}
+        if r.lan6, err = server6.NewIPv6UDPConn(r.lan.Name, any6); err != nil {
+            r.close()
+            return fmt.Errorf("failed to listen on %s: %w", r.lan.Name, err)
+        }
+        // clients send to All_DHCP_Relay_Agents_and_Servers
+        if err := ipv6.NewPacketConn(r.lan6).JoinGroup(r.lan, &net.UDPAddr{IP: allDHCPServers6}); err != nil {
+            r.close()
+            return fmt.Errorf("failed to join %s on %s: %w", allDHCPServers6, r.lan.Name, err)
+        }
+        if r.wan6, err = server6.NewIPv6UDPConn(r.wan, any6); err != nil {
+            r.close()
+            return fmt.Errorf("failed to listen on %s: %w", r.wan, err)
+        }
+    }
+    return nil
+}
+
+func (r *relay) close() {
+    for _, conn := range []*net.UDPConn{r.lan4, r.wan4, r.lan6, r.wan6} {
+        if conn != nil {
+            conn.Close()
+        }
+    }
+    if r.fd >= 0 {
+        unix.Close(r.fd)
+        r.fd = -1
+    }
+}
+
+// start reads every open socket until close, passing read errors to
+// report
+func (r *relay) start(wg *sync.WaitGroup, report func(error)) {
+    loops := []struct {
+        conn   *net.UDPConn
+        handle func([]byte, *net.UDPAddr)
+    }{
+        {r.lan4, r.forward4},
+        {r.wan4, r.reply4},
+        {r.lan6, r.forward6},
+        {r.wan6, r.reply6},
+    }
+    for _, l := range loops {
+        if l.conn == nil {
+            continue
+        }
+        wg.Add(1)
+        go func(conn *net.UDPConn, handle func([]byte, *net.UDPAddr)) {
+            defer wg.Done()
+            buf := make([]byte, 65536)
+            for {
+                n, from, err := conn.ReadFromUDP(buf)
+                if err != nil {
+                    if !errors.Is(err, net.ErrClosed) {
+                        report(fmt.Errorf("DHCP relay read: %w", err))
+                    }
+                    return
+                }
+                handle(append([]byte{}, buf[:n]...), from)
+            }
+        }(l.conn, l.handle)
+    }
+    log.Infow("relay started", "lan", r.lan.Name, "servers", r.servers, "servers6", r.servers6, "wan", r.wan)
+}
+
+// forward4 passes a client request on to every server, stamping it with
+// our address and option 82
+func (r *relay) forward4(b []byte, from *net.UDPAddr) {
+    req, err := dhcpv4.FromBytes(b)
+    if err != nil || req.OpCode != dhcpv4.OpcodeBootRequest {
+        return
+    }
+    r.devices.observe4(req)
+    if req.HopCount >= maxHops4 {
+        log.Warnw("relay dropping message after too many hops", "type", req.MessageType(), "mac", req.ClientHWAddr, "hops", req.HopCount)
+        return
+    }
+    req.HopCount++
+    // a request with giaddr set comes from a relay further down, which
+    // has already added its own option 82
+    if req.GatewayIPAddr.IsUnspecified() {
+        if req.Options.Has(dhcpv4.OptionRelayAgentInformation) {
+            log.Warnw("relay dropping message carrying its own option 82", "type", req.MessageType(), "mac", req.ClientHWAddr)
+            return
+        }
+        req.GatewayIPAddr = r.giaddr
+        req.UpdateOption(r.agentInfo())
+    }
+
+    payload := req.ToBytes()
+    for _, srv := range r.servers {
+        if _, err := r.wan4.WriteToUDP(payload, srv); err != nil {
+            log.Errorw("relay failed to forward", "server", srv.IP, "error", err)
+        }
+    }
+    log.Infow("relayed request", "type", req.MessageType(), "mac", req.ClientHWAddr, "xid", req.TransactionID, "src", from.IP, "servers", r.servers)
+}
+
+// agentInfo is the option 82 added to forwarded requests
+func (r *relay) agentInfo() dhcpv4.Option {
+    subs := []dhcpv4.Option{dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, r.circuit)}
+    if len(r.remote) > 0 {
+        subs = append(subs, dhcpv4.OptGeneric(dhcpv4.AgentRemoteIDSubOption, r.remote))
+    }
+    return dhcpv4.OptRelayAgentInfo(subs...)
+}
+
+// reply4 delivers a server's answer to the client, the way RFC 2131
+// section 4.1 tells a relay to address it
+func (r *relay) reply4(b []byte, from *net.UDPAddr) {
+    if !r.isServer4(from.IP) {
+        return
+    }
+    resp, err := dhcpv4.FromBytes(b)
+    if err != nil || resp.OpCode != dhcpv4.OpcodeBootReply || !resp.GatewayIPAddr.Equal(r.giaddr) {
+        return
+    }
+    resp.Options.Del(dhcpv4.OptionRelayAgentInformation)
+    payload := resp.ToBytes()
+
+    switch {
+    case resp.MessageType() == dhcpv4.MessageTypeNak || resp.IsBroadcast():
+        err = r.send4(payload, net.IPv4bcast, broadcastMAC)
+    case !resp.ClientIPAddr.IsUnspecified():
+        _, err = r.lan4.WriteToUDP(payload, &net.UDPAddr{IP: resp.ClientIPAddr, Port: portClient4})
+    case resp.YourIPAddr.IsUnspecified():
+        err = r.send4(payload, net.IPv4bcast, broadcastMAC)
+    default:
+        // the client cannot answer ARP for an address it does not have
+        // yet, so the reply goes straight to its MAC
+        err = r.send4(payload, resp.YourIPAddr, resp.ClientHWAddr)
+    }
+    if err != nil {
+        log.Errorw("relay failed to deliver reply", "type", resp.MessageType(), "mac", resp.ClientHWAddr, "error", err)
+        return
+    }
+    log.Infow("relayed reply", "type", resp.MessageType(), "mac", resp.ClientHWAddr, "xid", resp.TransactionID, "ip", resp.YourIPAddr, "server", from.IP)
+}
+
+func (r *relay) isServer4(ip net.IP) bool {
+    for _, srv := range r.servers {
+        if srv.IP.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// send4 sends payload from the server port of our LAN address to dst at
+// mac
+func (r *relay) send4(payload []byte, dst net.IP, mac net.HardwareAddr) error {
+    frame := udp4Frame(r.giaddr, dst, portServer4, portClient4, payload)
+    sll := &unix.SockaddrLinklayer{
+        Protocol: htons(unix.ETH_P_IP),
+        Ifindex:  r.lan.Index,
+        Halen:    uint8(len(mac)),
+    }
+    copy(sll.Addr[:], mac)
+    return unix.Sendto(r.fd, frame, 0, sll)
+}
+
+// forward6 wraps a client message, or one from a relay further down, in
+// a Relay-Forw for every server
+func (r *relay) forward6(b []byte, from *net.UDPAddr) {
+    msg, err := dhcpv6.FromBytes(b)
+    if err != nil {
+        return
+    }
+    link := r.link6
+    if rm, ok := msg.(*dhcpv6.RelayMessage); ok {
+        if rm.MessageType != dhcpv6.MessageTypeRelayForward {
+            return
+        }
+        if rm.HopCount+1 >= maxHops6 {
+            log.Warnw("relay dropping DHCPv6 message after too many hops", "src", from.IP, "hops", rm.HopCount)
+            return
+        }
+        // the other relay has already said which link the client is on
+        link = net.IPv6unspecified
+    } else {
+        switch msg.Type() {
+        case dhcpv6.MessageTypeAdvertise, dhcpv6.MessageTypeReply, dhcpv6.MessageTypeReconfigure:
+            return
+        }
+    }
+
+    fw, err := dhcpv6.EncapsulateRelay(msg, dhcpv6.MessageTypeRelayForward, link, from.IP)
+    if err != nil {
+        return
+    }
+    fw.AddOption(dhcpv6.OptInterfaceID(r.circuit))
+    payload := fw.ToBytes()
+    for _, srv := range r.servers6 {
+        if _, err := r.wan6.WriteToUDP(payload, srv); err != nil {
+            log.Errorw("relay failed to forward", "server", srv.IP, "error", err)
+        }
+    }
+    log.Infow("relayed DHCPv6 request", "type", msg.Type(), "src", from.IP, "servers", r.servers6)
+}
+
+// reply6 unwraps a Relay-Repl and sends what it carries to the peer it
+// names
+func (r *relay) reply6(b []byte, from *net.UDPAddr) {
+    if !r.isServer6(from.IP) {
+        return
+    }
+    msg, err := dhcpv6.FromBytes(b)
+    if err != nil {
+        return
+    }
+    rm, ok := msg.(*dhcpv6.RelayMessage)
+    if !ok || rm.MessageType != dhcpv6.MessageTypeRelayReply {
+        return
+    }
+    if id := rm.Options.InterfaceID(); id != nil && !bytes.Equal(id, r.circuit) {
+        return
+    }
+    inner := rm.Options.RelayMessage()
+    if inner == nil {
+        return
+    }
+
+    dst := &net.UDPAddr{IP: rm.PeerAddr, Port: portClient6}
+    if inner.IsRelay() {
+        dst.Port = portServer6
+    }
+    if dst.IP.IsLinkLocalUnicast() {
+        dst.Zone = r.lan.Name
+    }
+    if _, err := r.lan6.WriteToUDP(inner.ToBytes(), dst); err != nil {
+        log.Errorw("relay failed to deliver DHCPv6 reply", "type", inner.Type(), "dst", dst.IP, "error", err)
+        return
+    }
+    log.Infow("relayed DHCPv6 reply", "type", inner.Type(), "dst", dst.IP, "server", from.IP)
+}
+
+// isServer6 accepts any source when a server is a multicast group, as
+// whichever server answers it is one of ours
+func (r *relay) isServer6(ip net.IP) bool {
+    for _, srv := range r.servers6 {
+        if srv.IP.IsMulticast() || srv.IP.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
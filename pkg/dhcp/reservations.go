@@ -0,0 +1,257 @@
+package dhcp
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+    "github.com/insomniacslk/dhcp/rfc1035label"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// reservationsPlugin answers pinned hosts with their fixed addresses and
+// per-host options. Each argument is one host, as built by reservationArg:
+//
+//     <mac> [ipv4=<ip>] [ipv6=<ip>] [hostname=<name>] [lease_time=<dur>]
+//           [router=<ip>] [dns=<ip>,<ip>] [domain_name=<name>]
+var reservationsPlugin = plugins.Plugin{
+    Name:   "reservations",
+    Setup4: setupReservations4,
+    Setup6: setupReservations6,
+}
+
+// reservation is one parsed host entry
+type reservation struct {
+    mac        net.HardwareAddr
+    ipv4       net.IP
+    ipv6       net.IP
+    hostname   string
+    leaseTime  time.Duration
+    router     net.IP
+    dns        []net.IP
+    domainName string
+}
+
+// reservationArg encodes a configured reservation as a plugin argument
+func reservationArg(r krouter.Reservation) string {
+    fields := []string{r.MAC}
+    add := func(key, value string) {
+        if value != "" {
+            fields = append(fields, key+"="+value)
+        }
+    }
+    add("ipv4", r.IPv4)
+    add("ipv6", r.IPv6)
+    add("hostname", r.Hostname)
+    if r.LeaseTime > 0 {
+        add("lease_time", r.LeaseTime.String())
+    }
+    add("router", r.Router)
+    add("dns", strings.Join(r.DNS, ","))
+    add("domain_name", r.DomainName)
+    return strings.Join(fields, " ")
+}
+
+func parseReservation(arg string) (*reservation, error) {
+    fields := strings.Fields(arg)
+    if len(fields) == 0 {
+        return nil, errors.New("empty reservation")
+    }
+    mac, err := net.ParseMAC(fields[0])
+    if err != nil {
+        return nil, fmt.Errorf("invalid MAC %q: %w", fields[0], err)
+    }
+    r := &reservation{mac: mac}
+
+    for _, field := range fields[1:] {
+        key, value, ok := strings.Cut(field, "=")
+        if !ok {
+            return nil, fmt.Errorf("%s: malformed field %q", mac, field)
+        }
+        switch key {
+        case "ipv4":
+            if r.ipv4 = net.ParseIP(value).To4(); r.ipv4 == nil {
+                return nil, fmt.Errorf("%s: invalid IPv4 %q", mac, value)
+            }
+        case "ipv6":
+            if r.ipv6 = net.ParseIP(value); r.ipv6 == nil || r.ipv6.To4() != nil {
+                return nil, fmt.Errorf("%s: invalid IPv6 %q", mac, value)
+            }
+        case "hostname":
+            r.hostname = value
+        case "lease_time":
+            if r.leaseTime, err = time.ParseDuration(value); err != nil {
+                return nil, fmt.Errorf("%s: invalid lease time %q: %w", mac, value, err)
+            }
+        case "router":
+            if r.router = net.ParseIP(value).To4(); r.router == nil {
+                return nil, fmt.Errorf("%s: invalid router %q", mac, value)
+            }
+        case "dns":
+            for _, s := range strings.Split(value, ",") {
+                ip := net.ParseIP(s)
+                if ip == nil {
+                    return nil, fmt.Errorf("%s: invalid DNS server %q", mac, s)
+                }
+                r.dns = append(r.dns, ip)
+            }
+        case "domain_name":
+            r.domainName = value
+        default:
+            return nil, fmt.Errorf("%s: unknown field %q", mac, key)
+        }
+    }
+    return r, nil
+}
+
+// parseReservations indexes hosts by MAC, rejecting duplicates
+func parseReservations(args []string) (map[string]*reservation, error) {
+    hosts := make(map[string]*reservation, len(args))
+    for _, arg := range args {
+        r, err := parseReservation(arg)
+        if err != nil {
+            return nil, fmt.Errorf("reservations: %w", err)
+        }
+        if _, dup := hosts[r.mac.String()]; dup {
+            return nil, fmt.Errorf("reservations: duplicate MAC %s", r.mac)
+        }
+        hosts[r.mac.String()] = r
+    }
+    return hosts, nil
+}
+
+func setupReservations4(args ...string) (handler.Handler4, error) {
+    hosts, err := parseReservations(args)
+    if err != nil {
+        return nil, err
+    }
+    return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+        r, ok := hosts[req.ClientHWAddr.String()]
+        if !ok || r.ipv4 == nil {
+            return resp, false
+        }
+
+        resp.YourIPAddr = r.ipv4
+        if r.leaseTime > 0 {
+            resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(r.leaseTime))
+        }
+        if r.router != nil {
+            resp.UpdateOption(dhcpv4.OptRouter(r.router))
+        }
+        if dns := ipv4Only(r.dns); len(dns) > 0 {
+            resp.UpdateOption(dhcpv4.OptDNS(dns...))
+        }
+        if r.domainName != "" {
+            resp.UpdateOption(dhcpv4.OptDomainName(r.domainName))
+        }
+        if r.hostname != "" {
+            resp.UpdateOption(dhcpv4.OptHostName(r.hostname))
+        }
+        // the pinned address replaces any pool allocation
+        return resp, true
+    }, nil
+}
+
+func setupReservations6(args ...string) (handler.Handler6, error) {
+    hosts, err := parseReservations(args)
+    if err != nil {
+        return nil, err
+    }
+    return func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+        msg, err := req.GetInnerMessage()
+        if err != nil {
+            return resp, false
+        }
+        mac, err := dhcpv6.ExtractMAC(req)
+        if err != nil {
+            return resp, false
+        }
+        r, ok := hosts[mac.String()]
+        if !ok {
+            return resp, false
+        }
+
+        if iana := msg.Options.OneIANA(); iana != nil && r.ipv6 != nil {
+            lifetime := r.leaseTime
+            if lifetime <= 0 {
+                lifetime = defaultLeaseTime
+            }
+            resp.UpdateOption(&dhcpv6.OptIANA{
+                IaId: iana.IaId,
+                Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+                    &dhcpv6.OptIAAddress{
+                        IPv6Addr:          r.ipv6,
+                        PreferredLifetime: lifetime,
+                        ValidLifetime:     lifetime,
+                    },
+                }},
+            })
+        }
+        if dns := ipv6Only(r.dns); len(dns) > 0 {
+            resp.UpdateOption(dhcpv6.OptDNS(dns...))
+        }
+        if r.domainName != "" {
+            resp.UpdateOption(dhcpv6.OptDomainSearchList(&rfc1035label.Labels{
+                Labels: []string{r.domainName},
+            }))
+        }
+        return resp, false
+    }, nil
+}
+
+// validateReservations checks pinned v4 addresses sit in the LAN subnet
+// but outside the dynamic pool, so the range plugin never hands them out
+func validateReservations(pool *pool4, hosts []krouter.Reservation) error {
+    seen := make(map[string]string)
+    for _, h := range hosts {
+        r, err := parseReservation(reservationArg(h))
+        if err != nil {
+            return err
+        }
+        if r.ipv4 == nil {
+            continue
+        }
+        ip := ip4ToUint(r.ipv4)
+        switch {
+        case !pool.subnet.Contains(r.ipv4):
+            return fmt.Errorf("reservation %s: %s is outside LAN subnet %s", r.mac, r.ipv4, pool.subnet)
+        case r.ipv4.Equal(pool.router):
+            return fmt.Errorf("reservation %s: %s is the router address", r.mac, r.ipv4)
+        case ip >= ip4ToUint(pool.start) && ip <= ip4ToUint(pool.end):
+            return fmt.Errorf("reservation %s: %s is inside the dynamic pool %s-%s",
+                r.mac, r.ipv4, pool.start, pool.end)
+        }
+        if other, dup := seen[r.ipv4.String()]; dup {
+            return fmt.Errorf("reservation %s: %s is already reserved for %s", r.mac, r.ipv4, other)
+        }
+        seen[r.ipv4.String()] = r.mac.String()
+    }
+    return nil
+}
+
+func ipv4Only(ips []net.IP) []net.IP {
+    var out []net.IP
+    for _, ip := range ips {
+        if ip.To4() != nil {
+            out = append(out, ip)
+        }
+    }
+    return out
+}
+
+func ipv6Only(ips []net.IP) []net.IP {
+    var out []net.IP
+    for _, ip := range ips {
+        if ip.To4() == nil {
+            out = append(out, ip)
+        }
+    }
+    return out
+}
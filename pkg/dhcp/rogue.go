@@ -0,0 +1,310 @@
+package dhcp
+
+import (
+    "encoding/binary"
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/insomniacslk/dhcp/dhcpv4"
+    "github.com/insomniacslk/dhcp/dhcpv6"
+    "golang.org/x/sys/unix"
+
+    krouter "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// RogueServer is a DHCP server other than krouter answering on the LAN
+type RogueServer struct {
+    MAC       net.HardwareAddr
+    IP        net.IP
+    // Family is 4 or 6
+    Family    int
+    // Offered is the last address the server handed out, if any
+    Offered   net.IP
+    // Options are those of its last answer, one "name: value" each
+    Options   []string
+    FirstSeen time.Time
+    LastSeen  time.Time
+    Answers   int
+}
+
+var (
+    broadcastMAC  = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+    // ff02::1:2, All_DHCP_Relay_Agents_and_Servers, and its multicast MAC
+    allDHCPServers6   = net.ParseIP("ff02::1:2")
+    allDHCPServersMAC = net.HardwareAddr{0x33, 0x33, 0x00, 0x01, 0x00, 0x02}
+)
+
+// rogueDetector watches sniffed DHCP replies for servers that are not
+// krouter, and probes for them with DISCOVER and SOLICIT
+type rogueDetector struct {
+    iface  *net.Interface
+    allow  map[string]bool // MACs and IPs
+    report func(error)
+    // fd is an AF_PACKET socket probes are sent on
+    fd     int
+
+    mu      sync.Mutex
+    servers map[string]*RogueServer // family+MAC -> server
+}
+
+func newRogueDetector(cfg *krouter.Config, report func(error)) (*rogueDetector, error) {
+    iface, err := net.InterfaceByName(cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get interface: %w", err)
+    }
+    d := &rogueDetector{
+        iface:   iface,
+        allow:   make(map[string]bool),
+        report:  report,
+        fd:      -1,
+        servers: make(map[string]*RogueServer),
+    }
+    for _, a := range cfg.DHCP.Rogue.Allow {
+        if mac, err := net.ParseMAC(a); err == nil {
+            d.allow[mac.String()] = true
+        } else if ip := net.ParseIP(a); ip != nil {
+            d.allow[ip.String()] = true
+        } else {
+            return nil, fmt.Errorf("rogue allow entry %q is neither a MAC nor an IP", a)
+        }
+    }
+    if cfg.DHCP.Rogue.Interval > 0 {
+        if d.fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0); err != nil {
+            return nil, fmt.Errorf("failed to open probe socket: %w", err)
+        }
+    }
+    return d, nil
+}
+
+func (d *rogueDetector) close() {
+    if d.fd >= 0 {
+        unix.Close(d.fd)
+    }
+}
+
+// adopt carries known servers over from a previous run so they are not
+// reported again
+func (d *rogueDetector) adopt(prev *rogueDetector) {
+    prev.mu.Lock()
+    defer prev.mu.Unlock()
+    for k, srv := range prev.servers {
+        d.servers[k] = srv
+    }
+}
+
+// observe checks a sniffed packet for a server reply that is not ours
+func (d *rogueDetector) observe(pkt *sniffedPacket) {
+    if pkt.outgoing || pkt.srcMAC.String() == d.iface.HardwareAddr.String() {
+        return
+    }
+    srv := &RogueServer{MAC: pkt.srcMAC, IP: pkt.src}
+    switch {
+    case pkt.srcPort == portServer4 && pkt.dstPort == portClient4:
+        msg, err := dhcpv4.FromBytes(pkt.payload)
+        if err != nil || msg.OpCode != dhcpv4.OpcodeBootReply {
+            return
+        }
+        switch msg.MessageType() {
+        case dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck:
+        default:
+            return
+        }
+        srv.Family = 4
+        if id := msg.ServerIdentifier(); id != nil {
+            srv.IP = id
+        }
+        if !msg.YourIPAddr.IsUnspecified() {
+            srv.Offered = msg.YourIPAddr
+        }
+        for _, line := range strings.Split(msg.Options.String(), "\n") {
+            if line = strings.TrimSpace(line); line != "" {
+                srv.Options = append(srv.Options, line)
+            }
+        }
+
+    case pkt.srcPort == portServer6 && pkt.dstPort == portClient6:
+        msg, err := dhcpv6.MessageFromBytes(pkt.payload)
+        if err != nil {
+            return
+        }
+        switch msg.MessageType {
+        case dhcpv6.MessageTypeAdvertise, dhcpv6.MessageTypeReply:
+        default:
+            return
+        }
+        srv.Family = 6
+        if ia := msg.Options.OneIANA(); ia != nil {
+            if addr := ia.Options.OneAddress(); addr != nil {
+                srv.Offered = addr.IPv6Addr
+            }
+        }
+        for _, o := range msg.Options.Options {
+            srv.Options = append(srv.Options, o.String())
+        }
+
+    default:
+        return
+    }
+    if d.allow[srv.MAC.String()] || d.allow[srv.IP.String()] || d.allow[pkt.src.String()] {
+        return
+    }
+    d.record(srv, pkt.time)
+}
+
+func (d *rogueDetector) record(srv *RogueServer, now time.Time) {
+    key := fmt.Sprintf("%d/%s", srv.Family, srv.MAC)
+    d.mu.Lock()
+    known, ok := d.servers[key]
+    if !ok {
+        srv.FirstSeen = now
+        d.servers[key] = srv
+        known = srv
+    }
+    known.IP, known.Offered, known.Options = srv.IP, srv.Offered, srv.Options
+    known.LastSeen = now
+    known.Answers++
+    d.mu.Unlock()
+
+    if ok {
+        return
+    }
+    log.Warnw("rogue DHCP server", "family", srv.Family, "mac", srv.MAC, "ip", srv.IP,
+        "offered", srv.Offered, "options", strings.Join(srv.Options, "; "))
+    d.report(fmt.Errorf("rogue DHCPv%d server %s (%s) on %s", srv.Family, srv.MAC, srv.IP, d.iface.Name))
+}
+
+func (d *rogueDetector) all() []RogueServer {
+    d.mu.Lock()
+    out := make([]RogueServer, 0, len(d.servers))
+    for _, srv := range d.servers {
+        out = append(out, *srv)
+    }
+    d.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool {
+        return out[i].FirstSeen.Before(out[j].FirstSeen)
+    })
+    return out
+}
+
+// probe broadcasts a DISCOVER and multicasts a SOLICIT from our own MAC.
+// Answers come back to the sniffer like any other reply.
+func (d *rogueDetector) probe() error {
+    discover, err := dhcpv4.NewDiscovery(d.iface.HardwareAddr, dhcpv4.WithBroadcast(true))
+    if err != nil {
+        return err
+    }
+    frame := udp4Frame(net.IPv4zero, net.IPv4bcast, portClient4, portServer4, discover.ToBytes())
+    if err := d.send(frame, unix.ETH_P_IP, broadcastMAC); err != nil {
+        return fmt.Errorf("sending DISCOVER probe: %w", err)
+    }
+
+    src := linkLocal(d.iface)
+    if src == nil {
+        return nil
+    }
+    solicit, err := dhcpv6.NewSolicit(d.iface.HardwareAddr)
+    if err != nil {
+        return err
+    }
+    frame = udp6Frame(src, allDHCPServers6, portClient6, portServer6, solicit.ToBytes())
+    if err := d.send(frame, unix.ETH_P_IPV6, allDHCPServersMAC); err != nil {
+        return fmt.Errorf("sending SOLICIT probe: %w", err)
+    }
+    return nil
+}
+
+func (d *rogueDetector) send(frame []byte, proto uint16, dst net.HardwareAddr) error {
+    sll := &unix.SockaddrLinklayer{
+        Protocol: htons(proto),
+        Ifindex:  d.iface.Index,
+        Halen:    uint8(len(dst)),
+    }
+    copy(sll.Addr[:], dst)
+    return unix.Sendto(d.fd, frame, 0, sll)
+}
+
+func linkLocal(iface *net.Interface) net.IP {
+    addrs, err := iface.Addrs()
+    if err != nil {
+        return nil
+    }
+    for _, a := range addrs {
+        if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() == nil && ipn.IP.IsLinkLocalUnicast() {
+            return ipn.IP
+        }
+    }
+    return nil
+}
+
+// udp4Frame builds an IPv4 UDP datagram; the UDP checksum is optional
+// over IPv4 and left out
+func udp4Frame(src, dst net.IP, sport, dport uint16, payload []byte) []byte {
+    b := make([]byte, 28+len(payload))
+    b[0] = 0x45
+    binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+    b[8] = 64
+    b[9] = unix.IPPROTO_UDP
+    copy(b[12:16], src.To4())
+    copy(b[16:20], dst.To4())
+    binary.BigEndian.PutUint16(b[10:], checksum(b[:20], 0))
+
+    binary.BigEndian.PutUint16(b[20:], sport)
+    binary.BigEndian.PutUint16(b[22:], dport)
+    binary.BigEndian.PutUint16(b[24:], uint16(8+len(payload)))
+    copy(b[28:], payload)
+    return b
+}
+
+// udp6Frame builds an IPv6 UDP datagram, checksum included as IPv6 demands
+func udp6Frame(src, dst net.IP, sport, dport uint16, payload []byte) []byte {
+    udp := make([]byte, 8+len(payload))
+    binary.BigEndian.PutUint16(udp[0:], sport)
+    binary.BigEndian.PutUint16(udp[2:], dport)
+    binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+    copy(udp[8:], payload)
+    // link-local only
+    return ip6Frame(src, dst, unix.IPPROTO_UDP, 1, udp, 6)
+}
+
+// ip6Frame puts an IPv6 header in front of an upper-layer packet and fills
+// in the packet's checksum, which sits at csumOff
+func ip6Frame(src, dst net.IP, next, hopLimit byte, upper []byte, csumOff int) []byte {
+    b := make([]byte, 40+len(upper))
+    b[0] = 0x60
+    binary.BigEndian.PutUint16(b[4:], uint16(len(upper)))
+    b[6] = next
+    b[7] = hopLimit
+    copy(b[8:24], src.To16())
+    copy(b[24:40], dst.To16())
+    copy(b[40:], upper)
+
+    // pseudo-header: addresses, length and next header
+    pseudo := uint32(len(upper)) + uint32(next)
+    for i := 8; i < 40; i += 2 {
+        pseudo += uint32(binary.BigEndian.Uint16(b[i:]))
+    }
+    sum := checksum(b[40:], pseudo)
+    if sum == 0 {
+        sum = 0xffff
+    }
+    binary.BigEndian.PutUint16(b[40+csumOff:], sum)
+    return b
+}
+
+// checksum is the internet checksum of b on top of a partial sum
+func checksum(b []byte, sum uint32) uint16 {
+    for i := 0; i+1 < len(b); i += 2 {
+        sum += uint32(binary.BigEndian.Uint16(b[i:]))
+    }
+    if len(b)%2 == 1 {
+        sum += uint32(b[len(b)-1]) << 8
+    }
+    for sum > 0xffff {
+        sum = sum&0xffff + sum>>16
+    }
+    return ^uint16(sum)
+}
@@ -0,0 +1,185 @@
+package dhcp
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+    "unsafe"
+
+    "golang.org/x/net/bpf"
+    "golang.org/x/sys/unix"
+)
+
+// DHCP ports seen by the sniffer
+const (
+    portServer4 = 67
+    portClient4 = 68
+    portClient6 = 546
+    portServer6 = 547
+)
+
+// sniffedPacket is one DHCP datagram seen on the LAN, in either direction
+type sniffedPacket struct {
+    time     time.Time
+    outgoing bool             // sent by this host
+    srcMAC   net.HardwareAddr // link-layer source, ours when outgoing
+    src, dst net.IP
+    srcPort  uint16
+    dstPort  uint16
+    payload  []byte
+}
+
+// sniffer reads DHCP traffic off the LAN with an AF_PACKET socket. coredhcp
+// drops RELEASE, DECLINE and INFORM before any plugin runs and plugins never
+// see the final reply, so anything that must observe the whole exchange
+// watches the wire instead.
+type sniffer struct {
+    fd    int
+    iface *net.Interface
+}
+
+// snifferFilter passes UDP over IPv4 or IPv6 (no extension headers); port
+// matching is done in Go where the IPv4 header length is easier to handle
+var snifferFilter = []bpf.Instruction{
+    bpf.LoadExtension{Num: bpf.ExtProto},
+    bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.ETH_P_IP, SkipFalse: 2},
+    bpf.LoadAbsolute{Off: 9, Size: 1}, // IPv4 protocol
+    bpf.Jump{Skip: 2},
+    bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.ETH_P_IPV6, SkipFalse: 3},
+    bpf.LoadAbsolute{Off: 6, Size: 1}, // IPv6 next header
+    bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 1},
+    bpf.RetConstant{Val: 0xffff},
+    bpf.RetConstant{Val: 0},
+}
+
+func newSniffer(ifaceName string) (*sniffer, error) {
+    iface, err := net.InterfaceByName(ifaceName)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get interface: %w", err)
+    }
+
+    fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+    if err != nil {
+        return nil, fmt.Errorf("failed to open packet socket: %w", err)
+    }
+    s := &sniffer{fd: fd, iface: iface}
+
+    raw, err := bpf.Assemble(snifferFilter)
+    if err != nil {
+        s.close()
+        return nil, fmt.Errorf("failed to assemble filter: %w", err)
+    }
+    prog := unix.SockFprog{
+        Len:    uint16(len(raw)),
+        Filter: (*unix.SockFilter)(unsafe.Pointer(&raw[0])),
+    }
+    if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+        s.close()
+        return nil, fmt.Errorf("failed to attach filter: %w", err)
+    }
+
+    // wake up periodically so run notices cancellation
+    tv := unix.Timeval{Sec: 1}
+    if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+        s.close()
+        return nil, fmt.Errorf("failed to set receive timeout: %w", err)
+    }
+
+    sll := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}
+    if err := unix.Bind(fd, sll); err != nil {
+        s.close()
+        return nil, fmt.Errorf("failed to bind packet socket to %s: %w", ifaceName, err)
+    }
+    return s, nil
+}
+
+// run delivers DHCP packets to fn until ctx is cancelled
+func (s *sniffer) run(ctx context.Context, fn func(*sniffedPacket)) error {
+    buf := make([]byte, 65536)
+    for ctx.Err() == nil {
+        n, from, err := unix.Recvfrom(s.fd, buf, 0)
+        if err != nil {
+            if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+                continue
+            }
+            if ctx.Err() != nil {
+                return nil
+            }
+            return fmt.Errorf("packet socket read: %w", err)
+        }
+        sll, ok := from.(*unix.SockaddrLinklayer)
+        if !ok {
+            continue
+        }
+        pkt := parseDatagram(buf[:n], sll.Protocol == htons(unix.ETH_P_IPV6))
+        if pkt == nil || !isDHCPPort(pkt.srcPort) || !isDHCPPort(pkt.dstPort) {
+            continue
+        }
+        pkt.time = time.Now()
+        pkt.outgoing = sll.Pkttype == unix.PACKET_OUTGOING
+        pkt.srcMAC = append(net.HardwareAddr{}, sll.Addr[:sll.Halen]...)
+        fn(pkt)
+    }
+    return nil
+}
+
+func (s *sniffer) close() {
+    unix.Close(s.fd)
+}
+
+// parseDatagram extracts addresses, ports and payload of a UDP packet
+func parseDatagram(b []byte, v6 bool) *sniffedPacket {
+    pkt := &sniffedPacket{}
+    var udp []byte
+    if v6 {
+        if len(b) < 48 || b[6] != unix.IPPROTO_UDP {
+            return nil
+        }
+        pkt.src = net.IP(append([]byte{}, b[8:24]...))
+        pkt.dst = net.IP(append([]byte{}, b[24:40]...))
+        udp = b[40:]
+    } else {
+        if len(b) < 28 || b[9] != unix.IPPROTO_UDP {
+            return nil
+        }
+        ihl := int(b[0]&0x0f) * 4
+        if ihl < 20 || len(b) < ihl+8 {
+            return nil
+        }
+        // only first fragments carry the UDP header
+        if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+            return nil
+        }
+        pkt.src = net.IPv4(b[12], b[13], b[14], b[15])
+        pkt.dst = net.IPv4(b[16], b[17], b[18], b[19])
+        udp = b[ihl:]
+    }
+
+    pkt.srcPort = binary.BigEndian.Uint16(udp[0:2])
+    pkt.dstPort = binary.BigEndian.Uint16(udp[2:4])
+    length := int(binary.BigEndian.Uint16(udp[4:6]))
+    if length < 8 || length > len(udp) {
+        length = len(udp)
+    }
+    pkt.payload = append([]byte{}, udp[8:length]...)
+    return pkt
+}
+
+func isDHCPPort(port uint16) bool {
+    switch port {
+    case portServer4, portClient4, portClient6, portServer6:
+        return true
+    }
+    return false
+}
+
+// htons puts v in network byte order, as AF_PACKET wants protocols,
+// whatever the host's own order
+func htons(v uint16) uint16 {
+    var b [2]byte
+    binary.BigEndian.PutUint16(b[:], v)
+    return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,30 @@
+package dhcp
+
+import (
+    "errors"
+
+    "github.com/coredhcp/coredhcp/handler"
+    "github.com/coredhcp/coredhcp/plugins"
+    "github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// optionWPAD is the private-use option browsers query for the PAC URL
+const optionWPAD = dhcpv4.GenericOptionCode(252)
+
+// wpadPlugin advertises the WPAD URL through DHCP option 252
+var wpadPlugin = plugins.Plugin{
+    Name:   "wpad",
+    Setup4: setupWPAD4,
+}
+
+// setupWPAD4 takes the PAC URL as its only argument
+func setupWPAD4(args ...string) (handler.Handler4, error) {
+    if len(args) != 1 || args[0] == "" {
+        return nil, errors.New("wpad: need exactly one argument, the PAC URL")
+    }
+    url := []byte(args[0])
+    return func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+        resp.UpdateOption(dhcpv4.OptGeneric(optionWPAD, url))
+        return resp, false
+    }, nil
+}
@@ -0,0 +1,278 @@
+package dns
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+    "golang.org/x/net/publicsuffix"
+)
+
+const (
+    archiveOff    = "off"
+    archiveRecord = "record"
+    archiveReplay = "replay"
+)
+
+// archiveEntry is one line of the archive file
+type archiveEntry struct {
+    Time time.Time `json:"time"`
+    Name string    `json:"name"`
+    Type string    `json:"type"`
+    Msg  []byte    `json:"msg"` // upstream response in wire format
+}
+
+type archiveKey struct {
+    name  string
+    qtype uint16
+}
+
+// dnsArchive persists upstream responses so a captured session can later
+// be replayed with no network at all.
+type dnsArchive struct {
+    mode    string
+    miss    string
+    sink4   net.IP
+    sink6   net.IP
+    mu      sync.RWMutex
+    entries map[archiveKey]*dns.Msg
+    file    *os.File
+    writer  *bufio.Writer
+}
+
+func newArchive(cfg *config.Config) (*dnsArchive, error) {
+    ac := cfg.DNS.Archive
+    a := &dnsArchive{
+        mode:    strings.ToLower(ac.Mode),
+        miss:    strings.ToLower(ac.Miss),
+        entries: make(map[archiveKey]*dns.Msg),
+    }
+
+    switch a.mode {
+    case "", archiveOff:
+        a.mode = archiveOff
+        return a, nil
+    case archiveRecord, archiveReplay:
+    default:
+        return nil, fmt.Errorf("unknown archive mode %q", ac.Mode)
+    }
+
+    switch a.miss {
+    case "", "nxdomain", "wildcard":
+    case "sinkhole":
+        a.sink4 = net.ParseIP(ac.SinkholeIPv4)
+        a.sink6 = net.ParseIP(ac.SinkholeIPv6)
+        if a.sink4 == nil && a.sink6 == nil {
+            return nil, fmt.Errorf("sinkhole miss policy needs sinkhole_ipv4 or sinkhole_ipv6")
+        }
+    default:
+        return nil, fmt.Errorf("unknown archive miss policy %q", ac.Miss)
+    }
+
+    if err := a.load(ac.Path); err != nil {
+        return nil, err
+    }
+
+    if a.mode == archiveRecord {
+        f, err := os.OpenFile(ac.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+        if err != nil {
+            return nil, fmt.Errorf("opening archive %s: %w", ac.Path, err)
+        }
+        a.file = f
+        a.writer = bufio.NewWriter(f)
+    }
+
+    log.Printf("DNS archive in %s mode with %d entries from %s", a.mode, len(a.entries), ac.Path)
+    return a, nil
+}
+
+// load reads every entry of the archive; later entries win.
+func (a *dnsArchive) load(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        if os.IsNotExist(err) && a.mode == archiveRecord {
+            return nil
+        }
+        return fmt.Errorf("opening archive %s: %w", path, err)
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+    line := 0
+    for scanner.Scan() {
+        line++
+        var entry archiveEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            log.Printf("Warning: skipping archive line %d: %v", line, err)
+            continue
+        }
+        m := new(dns.Msg)
+        if err := m.Unpack(entry.Msg); err != nil {
+            log.Printf("Warning: skipping archive line %d: %v", line, err)
+            continue
+        }
+        qtype, ok := dns.StringToType[entry.Type]
+        if !ok {
+            log.Printf("Warning: skipping archive line %d: unknown type %s", line, entry.Type)
+            continue
+        }
+        a.entries[archiveKey{strings.ToLower(entry.Name), qtype}] = m
+    }
+    return scanner.Err()
+}
+
+// record appends an upstream response to the archive. Responses arriving
+// after close are dropped.
+func (a *dnsArchive) record(q dns.Question, m *dns.Msg) {
+    if a.mode != archiveRecord {
+        return
+    }
+
+    buf, err := m.Pack()
+    if err != nil {
+        log.Printf("Failed to pack response for archive: %v", err)
+        return
+    }
+    line, err := json.Marshal(archiveEntry{
+        Time: time.Now(),
+        Name: q.Name,
+        Type: dns.TypeToString[q.Qtype],
+        Msg:  buf,
+    })
+    if err != nil {
+        log.Printf("Failed to encode archive entry: %v", err)
+        return
+    }
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.file == nil {
+        return
+    }
+    a.entries[archiveKey{strings.ToLower(q.Name), q.Qtype}] = m.Copy()
+    a.writer.Write(append(line, '\n'))
+    if err := a.writer.Flush(); err != nil {
+        log.Printf("Failed to write archive entry: %v", err)
+    }
+}
+
+// replay answers r purely from the archive. Sinkholed misses are reported
+// as blocked.
+func (a *dnsArchive) replay(r *dns.Msg) (*dns.Msg, Outcome) {
+    q := r.Question[0]
+    key := archiveKey{strings.ToLower(q.Name), q.Qtype}
+
+    a.mu.RLock()
+    stored, ok := a.entries[key]
+    a.mu.RUnlock()
+    if ok {
+        m := stored.Copy()
+        m.Id = r.Id
+        m.Question = r.Question
+        return m, OutcomeReplayed
+    }
+
+    switch a.miss {
+    case "sinkhole":
+        return a.sinkhole(r), OutcomeBlocked
+    case "wildcard":
+        if m := a.wildcard(r); m != nil {
+            return m, OutcomeReplayed
+        }
+    }
+
+    m := new(dns.Msg)
+    m.SetRcode(r, dns.RcodeNameError)
+    return m, OutcomeReplayed
+}
+
+// replayStage answers every query from the archive in replay mode and is
+// left out of the chain otherwise
+func replayStage(p *DNSProxy) (Middleware, error) {
+    if p.archive.mode != archiveReplay {
+        return nil, nil
+    }
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            req := RequestFromContext(ctx)
+            var m *dns.Msg
+            m, req.Outcome = p.archive.replay(r)
+            w.WriteMsg(m)
+        })
+    }, nil
+}
+
+func (a *dnsArchive) sinkhole(r *dns.Msg) *dns.Msg {
+    q := r.Question[0]
+    m := new(dns.Msg)
+    m.SetReply(r)
+    hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET}
+    switch {
+    case q.Qtype == dns.TypeA && a.sink4 != nil:
+        m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: a.sink4.To4()})
+    case q.Qtype == dns.TypeAAAA && a.sink6 != nil:
+        m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: a.sink6})
+    }
+    return m
+}
+
+// wildcard answers with the nearest recorded relative of the name: walking
+// up the tree, the first ancestor with a "*." entry or an entry of its own
+// supplies the answer, renamed to the query name. The walk stops short of
+// the public suffix, so one site's records never answer for another's.
+func (a *dnsArchive) wildcard(r *dns.Msg) *dns.Msg {
+    q := r.Question[0]
+    name := strings.ToLower(q.Name)
+    suffix, _ := publicsuffix.PublicSuffix(strings.TrimSuffix(name, "."))
+
+    a.mu.RLock()
+    defer a.mu.RUnlock()
+
+    for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+        parent := name[off:]
+        if parent == "." || strings.TrimSuffix(parent, ".") == suffix {
+            break
+        }
+        for _, c := range []string{"*." + parent, parent} {
+            if stored, ok := a.entries[archiveKey{c, q.Qtype}]; ok {
+                return renameAnswer(stored, r, c)
+            }
+        }
+    }
+    return nil
+}
+
+// renameAnswer copies stored, rewriting records owned by from to the
+// query name.
+func renameAnswer(stored, r *dns.Msg, from string) *dns.Msg {
+    m := stored.Copy()
+    m.Id = r.Id
+    m.Question = r.Question
+    for _, rr := range m.Answer {
+        if strings.EqualFold(rr.Header().Name, from) {
+            rr.Header().Name = r.Question[0].Name
+        }
+    }
+    return m
+}
+
+func (a *dnsArchive) close() {
+    if a.file == nil {
+        return
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.writer.Flush()
+    a.file.Close()
+    a.file = nil
+}
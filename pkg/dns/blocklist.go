@@ -0,0 +1,163 @@
+package dns
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "strings"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// blocklist refuses or sinkholes names from the configured lists
+type blocklist struct {
+    names    map[string]bool // name and everything below it
+    children map[string]bool // only names below it ("*." patterns)
+    action   string
+    sink4    net.IP
+    sink6    net.IP
+}
+
+func newBlocklist(p *DNSProxy) (*blocklist, error) {
+    bc := p.cfg.DNS.Blocklist
+    b := &blocklist{
+        names:    make(map[string]bool),
+        children: make(map[string]bool),
+        action:   strings.ToLower(bc.Action),
+    }
+
+    switch b.action {
+    case "", "nxdomain", "refused":
+    case "sinkhole":
+        b.sink4 = net.ParseIP(bc.SinkholeIPv4)
+        b.sink6 = net.ParseIP(bc.SinkholeIPv6)
+        if b.sink4 == nil && b.sink6 == nil {
+            // default to sinkholing into krouter itself
+            b.sink4 = config.HostIP(p.cfg.Interfaces.LAN.IPv4)
+            b.sink6 = config.HostIP(p.cfg.Interfaces.LAN.IPv6)
+        }
+    default:
+        return nil, fmt.Errorf("unknown blocklist action %q", bc.Action)
+    }
+
+    for _, d := range bc.Domains {
+        b.add(d)
+    }
+    for _, path := range bc.Files {
+        if err := b.load(path); err != nil {
+            return nil, err
+        }
+    }
+    return b, nil
+}
+
+func (b *blocklist) add(pattern string) {
+    pattern = strings.ToLower(strings.TrimSpace(pattern))
+    if pattern == "" {
+        return
+    }
+    if strings.HasPrefix(pattern, "*.") {
+        b.children[dns.Fqdn(pattern[2:])] = true
+        return
+    }
+    b.names[dns.Fqdn(pattern)] = true
+}
+
+// load reads a list file; both bare names and hosts-file lines work
+func (b *blocklist) load(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("opening blocklist %s: %w", path, err)
+    }
+    defer f.Close()
+
+    before := len(b.names) + len(b.children)
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.IndexByte(line, '#'); i >= 0 {
+            line = line[:i]
+        }
+        fields := strings.Fields(line)
+        switch {
+        case len(fields) == 0:
+        case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+            for _, name := range fields[1:] {
+                b.add(name)
+            }
+        default:
+            b.add(fields[0])
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("reading blocklist %s: %w", path, err)
+    }
+    log.Printf("Loaded %d blocklist entries from %s", len(b.names)+len(b.children)-before, path)
+    return nil
+}
+
+func (b *blocklist) empty() bool {
+    return len(b.names) == 0 && len(b.children) == 0
+}
+
+// blocked walks up the name looking for a listed ancestor
+func (b *blocklist) blocked(name string) bool {
+    name = strings.ToLower(dns.Fqdn(name))
+    if b.names[name] {
+        return true
+    }
+    for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+        parent := name[off:]
+        if b.names[parent] || b.children[parent] {
+            return true
+        }
+    }
+    return false
+}
+
+func (b *blocklist) answer(r *dns.Msg) *dns.Msg {
+    m := new(dns.Msg)
+    switch b.action {
+    case "refused":
+        m.SetRcode(r, dns.RcodeRefused)
+    case "sinkhole":
+        m.SetReply(r)
+        q := r.Question[0]
+        hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+        if q.Qtype == dns.TypeA && b.sink4 != nil {
+            m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: b.sink4.To4()})
+        }
+        if q.Qtype == dns.TypeAAAA && b.sink6 != nil {
+            m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: b.sink6})
+        }
+    default:
+        m.SetRcode(r, dns.RcodeNameError)
+    }
+    return m
+}
+
+// blocklistStage answers listed names itself; it drops out of the chain
+// when no lists are configured
+func blocklistStage(p *DNSProxy) (Middleware, error) {
+    b, err := newBlocklist(p)
+    if err != nil {
+        return nil, err
+    }
+    if b.empty() {
+        return nil, nil
+    }
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            if b.blocked(r.Question[0].Name) {
+                RequestFromContext(ctx).Outcome = OutcomeBlocked
+                w.WriteMsg(b.answer(r))
+                return
+            }
+            next.ServeDNS(ctx, w, r)
+        })
+    }, nil
+}
@@ -0,0 +1,185 @@
+package dns
+
+import (
+    "context"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// maxCacheTTL bounds how long any answer is kept
+const maxCacheTTL = 24 * time.Hour
+
+type cacheKey struct {
+    name   string
+    qtype  uint16
+    qclass uint16
+    do     bool // DNSSEC records requested
+    cd     bool // checking disabled
+}
+
+type cacheEntry struct {
+    msg     *dns.Msg
+    stored  time.Time
+    expires time.Time
+}
+
+// dnsCache holds positive and negative answers until their TTL runs out
+type dnsCache struct {
+    mu      sync.Mutex
+    size    int
+    entries map[cacheKey]*cacheEntry
+}
+
+func newCacheKey(r *dns.Msg) cacheKey {
+    q := r.Question[0]
+    key := cacheKey{
+        name:   strings.ToLower(q.Name),
+        qtype:  q.Qtype,
+        qclass: q.Qclass,
+        cd:     r.CheckingDisabled,
+    }
+    if opt := r.IsEdns0(); opt != nil {
+        key.do = opt.Do()
+    }
+    return key
+}
+
+func (c *dnsCache) get(r *dns.Msg) *dns.Msg {
+    key := newCacheKey(r)
+    now := time.Now()
+
+    c.mu.Lock()
+    entry, ok := c.entries[key]
+    if ok && now.After(entry.expires) {
+        delete(c.entries, key)
+        ok = false
+    }
+    c.mu.Unlock()
+    if !ok {
+        return nil
+    }
+
+    m := entry.msg.Copy()
+    m.Id = r.Id
+    m.Question = r.Question
+    age := uint32(now.Sub(entry.stored) / time.Second)
+    for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+        for _, rr := range section {
+            hdr := rr.Header()
+            if hdr.Rrtype == dns.TypeOPT {
+                continue
+            }
+            if hdr.Ttl > age {
+                hdr.Ttl -= age
+            } else {
+                hdr.Ttl = 0
+            }
+        }
+    }
+    return m
+}
+
+func (c *dnsCache) put(r, m *dns.Msg) {
+    if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+        return
+    }
+    ttl := cacheTTL(m)
+    if ttl <= 0 {
+        return
+    }
+
+    key := newCacheKey(r)
+    now := time.Now()
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if len(c.entries) >= c.size {
+        c.evict(now)
+    }
+    c.entries[key] = &cacheEntry{msg: m.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// evict drops expired entries, then arbitrary ones until there is room.
+// Callers must hold c.mu.
+func (c *dnsCache) evict(now time.Time) {
+    for key, entry := range c.entries {
+        if now.After(entry.expires) {
+            delete(c.entries, key)
+        }
+    }
+    for key := range c.entries {
+        if len(c.entries) < c.size {
+            break
+        }
+        delete(c.entries, key)
+    }
+}
+
+// cacheTTL is the smallest TTL in the answer, or the SOA minimum for
+// negative answers
+func cacheTTL(m *dns.Msg) time.Duration {
+    var min uint32
+    found := false
+    consider := func(ttl uint32) {
+        if !found || ttl < min {
+            min, found = ttl, true
+        }
+    }
+
+    if len(m.Answer) > 0 {
+        for _, rr := range m.Answer {
+            consider(rr.Header().Ttl)
+        }
+    } else {
+        for _, rr := range m.Ns {
+            if soa, ok := rr.(*dns.SOA); ok {
+                consider(soa.Hdr.Ttl)
+                consider(soa.Minttl)
+            }
+        }
+    }
+    if !found {
+        return 0
+    }
+    ttl := time.Duration(min) * time.Second
+    if ttl > maxCacheTTL {
+        ttl = maxCacheTTL
+    }
+    return ttl
+}
+
+// cacheWriter keeps a pristine copy of the answer before later writers
+// (TTL policy, rewrites) modify it
+type cacheWriter struct {
+    dns.ResponseWriter
+    cache *dnsCache
+    req   *dns.Msg
+}
+
+func (cw *cacheWriter) WriteMsg(m *dns.Msg) error {
+    cw.cache.put(cw.req, m)
+    return cw.ResponseWriter.WriteMsg(m)
+}
+
+// cacheStage answers repeated queries without going upstream
+func cacheStage(p *DNSProxy) (Middleware, error) {
+    cc := p.cfg.DNS.Cache
+    if !cc.Enabled || cc.Size <= 0 {
+        return nil, nil
+    }
+    cache := &dnsCache{size: cc.Size, entries: make(map[cacheKey]*cacheEntry)}
+
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            if m := cache.get(r); m != nil {
+                RequestFromContext(ctx).Outcome = OutcomeCached
+                w.WriteMsg(m)
+                return
+            }
+            next.ServeDNS(ctx, &cacheWriter{ResponseWriter: w, cache: cache, req: r}, r)
+        })
+    }, nil
+}
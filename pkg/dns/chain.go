@@ -0,0 +1,169 @@
+package dns
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// Handler answers a DNS query by writing to w, or declines by writing
+// nothing. Stages hand queries they do not answer to the next Handler.
+type Handler interface {
+    ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
+}
+
+// HandlerFunc adapts a function to the Handler interface
+type HandlerFunc func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+    f(ctx, w, r)
+}
+
+// Middleware wraps the remainder of the chain
+type Middleware func(next Handler) Handler
+
+// StageFactory builds a stage for a proxy. It is called once per proxy and
+// may return a nil Middleware to leave itself out of the chain.
+type StageFactory func(p *DNSProxy) (Middleware, error)
+
+// Request carries per-query state through the chain
+type Request struct {
+    Client   net.IP
+    Question dns.Question
+    Start    time.Time
+    // Outcome is set by whichever stage answers the query
+    Outcome  Outcome
+}
+
+type requestKey struct{}
+
+// RequestFromContext returns the state of the query being served
+func RequestFromContext(ctx context.Context) *Request {
+    req, _ := ctx.Value(requestKey{}).(*Request)
+    return req
+}
+
+var (
+    stagesMu sync.RWMutex
+    stages   = make(map[string]StageFactory)
+)
+
+// RegisterStage makes a stage available to the dns.chain config. Code
+// embedding krouter registers its own stages before creating the proxy.
+func RegisterStage(name string, factory StageFactory) error {
+    stagesMu.Lock()
+    defer stagesMu.Unlock()
+    if factory == nil {
+        return fmt.Errorf("stage %q has no factory", name)
+    }
+    if _, ok := stages[name]; ok {
+        return fmt.Errorf("stage %q is already registered", name)
+    }
+    stages[name] = factory
+    return nil
+}
+
+// Stages lists the registered stage names
+func Stages() []string {
+    stagesMu.RLock()
+    defer stagesMu.RUnlock()
+    names := make([]string, 0, len(stages))
+    for name := range stages {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+func init() {
+    builtin := map[string]StageFactory{
+        "stats":     statsStage,
+        "faults":    faultsStage,
+        "ttl":       ttlStage,
+        "dnssec":    dnssecStage,
+        "log":       logStage,
+        "local":     localStage,
+        "blocklist": blocklistStage,
+        "rewrite":   rewriteStage,
+        "cache":     cacheStage,
+        "replay":    replayStage,
+        "forward":   forwardStage,
+    }
+    for name, factory := range builtin {
+        if err := RegisterStage(name, factory); err != nil {
+            panic(err)
+        }
+    }
+}
+
+// buildChain assembles the configured stages in order, ending in a
+// handler that fails any query no stage answered.
+func (p *DNSProxy) buildChain(names []string) (Handler, error) {
+    var h Handler = HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeServerFailure)
+        w.WriteMsg(m)
+    })
+
+    if len(names) == 0 {
+        names = config.DefaultDNSChain()
+    }
+
+    seen := make(map[string]bool)
+    middleware := make([]Middleware, 0, len(names))
+    for _, name := range names {
+        if seen[name] {
+            return nil, fmt.Errorf("stage %q listed twice", name)
+        }
+        seen[name] = true
+
+        stagesMu.RLock()
+        factory, ok := stages[name]
+        stagesMu.RUnlock()
+        if !ok {
+            return nil, fmt.Errorf("unknown stage %q", name)
+        }
+        mw, err := factory(p)
+        if err != nil {
+            return nil, fmt.Errorf("stage %s: %w", name, err)
+        }
+        if mw != nil {
+            middleware = append(middleware, mw)
+        }
+    }
+
+    for i := len(middleware) - 1; i >= 0; i-- {
+        h = middleware[i](h)
+    }
+    return h, nil
+}
+
+// Config returns the configuration the proxy was built from
+func (p *DNSProxy) Config() *config.Config {
+    return p.cfg
+}
+
+// logStage logs every query with its answer and how it was produced
+func logStage(p *DNSProxy) (Middleware, error) {
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            sw := &statsWriter{ResponseWriter: w, rcode: -1}
+            next.ServeDNS(ctx, sw, r)
+            req := RequestFromContext(ctx)
+            rcode := "none"
+            if sw.written {
+                rcode = dns.RcodeToString[sw.rcode]
+            }
+            log.Printf("DNS %s %s %s -> %s (%s, %v)",
+                req.Client, req.Question.Name, dns.TypeToString[req.Question.Qtype],
+                rcode, req.Outcome, time.Since(req.Start).Round(time.Microsecond))
+        })
+    }, nil
+}
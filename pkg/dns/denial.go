@@ -0,0 +1,300 @@
+package dns
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// maxNSEC3Iterations is the most NSEC3 hash iterations worth computing;
+// zones asking for more are treated as unsigned (RFC 9276 3.2)
+const maxNSEC3Iterations = 150
+
+// proveAnswer checks the proofs a signed response owes beyond its
+// signatures: a negative answer must show the name or type really is
+// absent, and a wildcard expansion that the query name itself does not
+// exist. The records in ns must already have verified.
+func proveAnswer(m *dns.Msg, qname string, qtype uint16) (security, error) {
+    target := strings.ToLower(dns.Fqdn(qname))
+    if qtype != dns.TypeCNAME {
+        // follow the CNAME chain to the name the answer is really for
+        for i := 0; i < len(m.Answer); i++ {
+            next := ""
+            for _, rr := range m.Answer {
+                if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, target) {
+                    next = strings.ToLower(c.Target)
+                }
+            }
+            if next == "" {
+                break
+            }
+            target = next
+        }
+    }
+
+    if m.Rcode == dns.RcodeNameError {
+        return proveDenial(m.Ns, target, qtype, true)
+    }
+    answered := false
+    for _, rr := range m.Answer {
+        if strings.EqualFold(rr.Header().Name, target) && (rr.Header().Rrtype == qtype || qtype == dns.TypeANY) {
+            answered = true
+        }
+    }
+    if !answered && m.Rcode == dns.RcodeSuccess {
+        return proveDenial(m.Ns, target, qtype, false)
+    }
+
+    // RRSIG labels below the owner's count mean a wildcard was expanded
+    for _, rr := range m.Answer {
+        sig, ok := rr.(*dns.RRSIG)
+        if !ok {
+            continue
+        }
+        labels := dns.CountLabel(sig.Hdr.Name)
+        if strings.HasPrefix(sig.Hdr.Name, "*.") {
+            labels--
+        }
+        if int(sig.Labels) < labels {
+            status, err := proveExpansion(m.Ns, strings.ToLower(sig.Hdr.Name), int(sig.Labels))
+            if status != secure {
+                return status, err
+            }
+        }
+    }
+    return secure, nil
+}
+
+// proveDenial checks that the NSEC or NSEC3 records in ns show qtype does
+// not exist at name, or with nxdomain that name does not exist at all.
+// An opt-out span is all the proof an unsigned delegation gets, so it
+// leaves the answer insecure.
+func proveDenial(ns []dns.RR, name string, qtype uint16, nxdomain bool) (security, error) {
+    nsecs, nsec3s := denialRecords(ns)
+    switch {
+    case len(nsecs) > 0:
+        if err := nsecDenial(nsecs, name, qtype, nxdomain); err != nil {
+            return bogus, err
+        }
+        return secure, nil
+    case len(nsec3s) > 0:
+        if nsec3s[0].Iterations > maxNSEC3Iterations {
+            return insecure, nil
+        }
+        return nsec3Denial(nsec3s, name, qtype, nxdomain)
+    }
+    return bogus, fmt.Errorf("no NSEC or NSEC3 records deny %s", name)
+}
+
+// proveExpansion checks that name, answered from a wildcard with labels
+// labels of its own, does not exist (RFC 4035 5.3.4, RFC 5155 8.8)
+func proveExpansion(ns []dns.RR, name string, labels int) (security, error) {
+    nsecs, nsec3s := denialRecords(ns)
+    if len(nsecs) > 0 {
+        if coveringNSEC(nsecs, name) == nil {
+            return bogus, fmt.Errorf("wildcard answer but no NSEC shows %s does not exist", name)
+        }
+        return secure, nil
+    }
+    if len(nsec3s) > 0 {
+        if nsec3s[0].Iterations > maxNSEC3Iterations {
+            return insecure, nil
+        }
+        names := dns.SplitDomainName(name)
+        nextCloser := dns.Fqdn(strings.Join(names[len(names)-labels-1:], "."))
+        for _, n := range nsec3s {
+            if nsec3Covers(n, nextCloser) {
+                return secure, nil
+            }
+        }
+    }
+    return bogus, fmt.Errorf("wildcard answer but nothing shows %s does not exist", name)
+}
+
+func denialRecords(ns []dns.RR) ([]*dns.NSEC, []*dns.NSEC3) {
+    var nsecs []*dns.NSEC
+    var nsec3s []*dns.NSEC3
+    for _, rr := range ns {
+        switch d := rr.(type) {
+        case *dns.NSEC:
+            nsecs = append(nsecs, d)
+        case *dns.NSEC3:
+            nsec3s = append(nsec3s, d)
+        }
+    }
+    return nsecs, nsec3s
+}
+
+// nsecDenial is the NSEC proof of RFC 4035 5.4: an NSEC at name without
+// the type, or one covering name plus one covering or, for NODATA,
+// matching the wildcard at its closest encloser
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) error {
+    if !nxdomain {
+        for _, n := range nsecs {
+            if strings.EqualFold(n.Hdr.Name, name) {
+                return absentType(n.TypeBitMap, name, qtype)
+            }
+        }
+    }
+    cover := coveringNSEC(nsecs, name)
+    if cover == nil {
+        return fmt.Errorf("no NSEC covers %s", name)
+    }
+    wildcard := "*." + nsecEncloser(name, cover)
+    if nxdomain {
+        if coveringNSEC(nsecs, wildcard) == nil {
+            return fmt.Errorf("no NSEC covers %s", wildcard)
+        }
+        return nil
+    }
+    for _, n := range nsecs {
+        if strings.EqualFold(n.Hdr.Name, wildcard) {
+            return absentType(n.TypeBitMap, wildcard, qtype)
+        }
+    }
+    return fmt.Errorf("no NSEC shows %s has no %s", name, dns.TypeToString[qtype])
+}
+
+// coveringNSEC finds the NSEC whose span holds name. A delegation's NSEC
+// comes from the parent and says nothing about names below it.
+func coveringNSEC(nsecs []*dns.NSEC, name string) *dns.NSEC {
+    for _, n := range nsecs {
+        owner := strings.ToLower(n.Hdr.Name)
+        if dns.IsSubDomain(owner, name) && owner != name &&
+            hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA) {
+            continue
+        }
+        if canonicalCompare(owner, name) >= 0 {
+            continue
+        }
+        next := strings.ToLower(n.NextDomain)
+        if canonicalCompare(owner, next) < 0 {
+            if canonicalCompare(name, next) < 0 {
+                return n
+            }
+            continue
+        }
+        // the zone's last NSEC points back at the apex
+        if dns.IsSubDomain(next, name) {
+            return n
+        }
+    }
+    return nil
+}
+
+// nsecEncloser is the closest encloser an NSEC covering name reveals: the
+// deeper of the ancestors name shares with the NSEC's owner and next name
+func nsecEncloser(name string, n *dns.NSEC) string {
+    best := "."
+    for _, other := range []string{n.Hdr.Name, n.NextDomain} {
+        shared := dns.CompareDomainName(name, other)
+        labels := dns.SplitDomainName(name)
+        if shared > len(labels)-1 {
+            shared = len(labels) - 1
+        }
+        if ce := dns.Fqdn(strings.Join(labels[len(labels)-shared:], ".")); dns.CountLabel(ce) > dns.CountLabel(best) {
+            best = ce
+        }
+    }
+    return strings.ToLower(best)
+}
+
+// nsec3Denial is the NSEC3 proof of RFC 5155 8.4 to 8.7
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) (security, error) {
+    if !nxdomain {
+        for _, n := range nsec3s {
+            if n.Match(name) {
+                if err := absentType(n.TypeBitMap, name, qtype); err != nil {
+                    return bogus, err
+                }
+                return secure, nil
+            }
+        }
+    }
+
+    ce, cover, err := closestEncloserProof(nsec3s, name)
+    if err != nil {
+        return bogus, err
+    }
+    optOut := cover.Flags&1 == 1
+    wildcard := "*." + ce
+    if nxdomain {
+        for _, n := range nsec3s {
+            if nsec3Covers(n, wildcard) {
+                if optOut {
+                    return insecure, nil
+                }
+                return secure, nil
+            }
+        }
+        return bogus, fmt.Errorf("no NSEC3 covers %s", wildcard)
+    }
+    for _, n := range nsec3s {
+        if n.Match(wildcard) {
+            if err := absentType(n.TypeBitMap, wildcard, qtype); err != nil {
+                return bogus, err
+            }
+            return secure, nil
+        }
+    }
+    if qtype == dns.TypeDS && optOut {
+        return insecure, nil
+    }
+    return bogus, fmt.Errorf("no NSEC3 shows %s has no %s", name, dns.TypeToString[qtype])
+}
+
+// closestEncloserProof finds the nearest ancestor of name with a matching
+// NSEC3 and the NSEC3 covering the next closer name below it
+func closestEncloserProof(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3, error) {
+    nextCloser := name
+    for off, end := dns.NextLabel(name, 0); ; off, end = dns.NextLabel(name, off) {
+        ce := "."
+        if !end {
+            ce = name[off:]
+        }
+        for _, n := range nsec3s {
+            if !n.Match(ce) {
+                continue
+            }
+            for _, c := range nsec3s {
+                if nsec3Covers(c, nextCloser) {
+                    return ce, c, nil
+                }
+            }
+            return "", nil, fmt.Errorf("no NSEC3 covers %s", nextCloser)
+        }
+        if end {
+            return "", nil, fmt.Errorf("no closest encloser proven for %s", name)
+        }
+        nextCloser = ce
+    }
+}
+
+// nsec3Covers reports whether n's span holds name without n being name's
+// own record, which dns.NSEC3.Cover also counts
+func nsec3Covers(n *dns.NSEC3, name string) bool {
+    return n.Cover(name) && !n.Match(name)
+}
+
+// absentType fails when a bitmap shows name does have qtype, or a CNAME
+// that should have been followed
+func absentType(bitmap []uint16, name string, qtype uint16) error {
+    if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+        return fmt.Errorf("denial for %s %s lists the type", name, dns.TypeToString[qtype])
+    }
+    return nil
+}
+
+// canonicalCompare orders names as DNSSEC does (RFC 4034 6.1): label by
+// label from the root, case-insensitively
+func canonicalCompare(a, b string) int {
+    la := dns.SplitDomainName(strings.ToLower(a))
+    lb := dns.SplitDomainName(strings.ToLower(b))
+    for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+        if c := strings.Compare(la[i], lb[j]); c != 0 {
+            return c
+        }
+    }
+    return len(la) - len(lb)
+}
@@ -7,6 +7,7 @@ import (
     "net"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
     
     "github.com/miekg/dns"
@@ -19,27 +20,81 @@ type DNSProxy struct {
     cancel   context.CancelFunc
     wg       sync.WaitGroup
     errChan  chan error
-    domains  map[string][]net.IP // domain name -> IP addresses
+    locals   atomic.Pointer[localTable] // swapped whole when reservations change
+    ttl      *ttlPolicy
+    faults   *faultInjector
+    archive  *dnsArchive
+    server   *dns.Server
+    lan      *responders
+    wpad     *localRecord // LAN addresses served for wpad.<domain>
+    stats    *queryStats
+    handler  Handler
 }
 
-func NewDNSProxy(cfg *config.Config) *DNSProxy {
+// localTable is the local domains, configured and from DHCP reservations
+type localTable struct {
+    domains map[string]*localRecord // domain name -> local record
+    order   []config.LocalDomain    // local domains in lookup order
+}
+
+// localRecord holds the spoofed addresses served for a local domain
+type localRecord struct {
+    ips []net.IP
+    ttl uint32 // per-domain TTL override, 0 uses the policy default
+}
+
+func NewDNSProxy(cfg *config.Config) (*DNSProxy, error) {
+    faults, err := newFaultInjector(cfg)
+    if err != nil {
+        return nil, fmt.Errorf("invalid fault injection config: %w", err)
+    }
+
+    archive, err := newArchive(cfg)
+    if err != nil {
+        return nil, fmt.Errorf("invalid DNS archive config: %w", err)
+    }
+
     ctx, cancel := context.WithCancel(context.Background())
     proxy := &DNSProxy{
         cfg:     cfg,
         ctx:     ctx,
         cancel:  cancel,
         errChan: make(chan error, 1),
-        domains: make(map[string][]net.IP),
+        ttl:     newTTLPolicy(cfg),
+        faults:  faults,
+        archive: archive,
+        stats:   newQueryStats(cfg),
+    }
+
+    lan, err := newResponders(proxy)
+    if err != nil {
+        cancel()
+        return nil, fmt.Errorf("invalid responder config: %w", err)
     }
+    proxy.lan = lan
     
     // Initialize domain mappings
-    proxy.initializeDomains()
+    proxy.SetReservations(cfg.DHCP.Reservations)
+    proxy.initializeWPAD()
+
+    handler, err := proxy.buildChain(cfg.DNS.Chain)
+    if err != nil {
+        cancel()
+        return nil, fmt.Errorf("invalid DNS chain: %w", err)
+    }
+    proxy.handler = handler
     
-    return proxy
+    return proxy, nil
 }
 
-func (p *DNSProxy) initializeDomains() {
-    for _, domain := range p.cfg.DNS.LocalDomains {
+// SetReservations rebuilds the local domains with the hostnames of
+// reservations, so a DHCP reload's pinned devices resolve by name
+func (p *DNSProxy) SetReservations(reservations []config.Reservation) {
+    t := &localTable{
+        domains: make(map[string]*localRecord),
+        order:   p.localDomains(reservations),
+    }
+    for _, domain := range t.order {
         var ips []net.IP
         
         // Add IPv4 addresses
@@ -66,12 +121,116 @@ func (p *DNSProxy) initializeDomains() {
             name = name + "."
         }
         
-        p.domains[name] = ips
+        if _, exists := t.domains[name]; exists {
+            continue
+        }
+        t.domains[name] = &localRecord{ips: ips, ttl: domain.TTL}
+    }
+    p.locals.Store(t)
+}
+
+func (p *DNSProxy) initializeWPAD() {
+    if p.cfg.WPAD.Enabled {
+        var ips []net.IP
+        for _, addr := range []string{p.cfg.Interfaces.LAN.IPv4, p.cfg.Interfaces.LAN.IPv6} {
+            if ip := config.HostIP(addr); ip != nil {
+                ips = append(ips, ip)
+            }
+        }
+        p.wpad = &localRecord{ips: ips}
+    }
+}
+
+// localDomains is the configured local domains followed by the hostnames of
+// reservations, so pinned devices resolve by name. Explicit local domains
+// win over a reservation with the same name.
+func (p *DNSProxy) localDomains(reservations []config.Reservation) []config.LocalDomain {
+    domains := append([]config.LocalDomain{}, p.cfg.DNS.LocalDomains...)
+    for _, r := range reservations {
+        if r.Hostname == "" || (r.IPv4 == "" && r.IPv6 == "") {
+            continue
+        }
+        name := r.Hostname
+        if !strings.Contains(strings.TrimSuffix(name, "."), ".") && r.DomainName != "" {
+            name = name + "." + r.DomainName
+        }
+        domain := config.LocalDomain{Name: name}
+        if r.IPv4 != "" {
+            domain.IPv4 = []string{r.IPv4}
+        }
+        if r.IPv6 != "" {
+            domain.IPv6 = []string{r.IPv6}
+        }
+        domains = append(domains, domain)
+    }
+    return domains
+}
+
+// wpadRecord returns the LAN record for WPAD lookups, honouring the
+// configured domain when one is set.
+func (p *DNSProxy) wpadRecord(name string) *localRecord {
+    if p.wpad == nil {
+        return nil
+    }
+    labels := dns.SplitDomainName(name)
+    if len(labels) == 0 || !strings.EqualFold(labels[0], "wpad") {
+        return nil
+    }
+    // bare "wpad" comes from LLMNR/NetBIOS clients and is always answered
+    if domain := p.cfg.WPAD.Domain; domain != "" && len(labels) > 1 {
+        parent := dns.Fqdn(strings.Join(labels[1:], "."))
+        if !strings.EqualFold(parent, dns.Fqdn(domain)) {
+            return nil
+        }
+    }
+    return p.wpad
+}
+
+// lookupLocal finds the local record for name. Single-label names, as asked
+// by LLMNR and NetBIOS clients, also match the first label of a local
+// domain, earliest configured first.
+func (p *DNSProxy) lookupLocal(name string) *localRecord {
+    name = dns.Fqdn(name)
+    t := p.locals.Load()
+    if record, ok := t.domains[name]; ok {
+        return record
+    }
+    single := dns.CountLabel(name) == 1
+    for _, domain := range t.order {
+        full := dns.Fqdn(domain.Name)
+        if strings.EqualFold(full, name) {
+            return t.domains[full]
+        }
+        if labels := dns.SplitDomainName(full); single && len(labels) > 0 &&
+            strings.EqualFold(labels[0]+".", name) {
+            return t.domains[full]
+        }
     }
+    return p.wpadRecord(name)
+}
+
+// SetLowTTLMode toggles rewriting every answer to the configured low TTL so
+// clients can be retargeted quickly.
+func (p *DNSProxy) SetLowTTLMode(enabled bool) {
+    p.ttl.lowMode.Store(enabled)
+    log.Printf("DNS low-TTL mode set to %v", enabled)
+}
+
+// LowTTLMode reports whether low-TTL mode is active.
+func (p *DNSProxy) LowTTLMode() bool {
+    return p.ttl.lowMode.Load()
 }
 
 func (p *DNSProxy) Start() error {
-    server := &dns.Server{
+    // responders first, so a failure leaves nothing listening on :53
+    if p.lan.enabled() {
+        if err := p.lan.start(); err != nil {
+            return fmt.Errorf("failed to start LAN responders: %w", err)
+        }
+        log.Printf("LAN name responders started on %s", p.cfg.Interfaces.LAN.Iface)
+    }
+
+    p.server = &dns.Server{
         Addr: ":53",
         Net:  "udp",
         Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
@@ -82,7 +241,7 @@ func (p *DNSProxy) Start() error {
     p.wg.Add(1)
     go func() {
         defer p.wg.Done()
-        if err := server.ListenAndServe(); err != nil {
+        if err := p.server.ListenAndServe(); err != nil {
             select {
             case p.errChan <- fmt.Errorf("DNS server error: %w", err):
             default:
@@ -99,57 +258,115 @@ func (p *DNSProxy) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
         return
     }
 
-    question := r.Question[0]
-    qname := question.Name
-    qtype := question.Qtype
+    req := &Request{
+        Client:   clientIP(w.RemoteAddr()),
+        Question: r.Question[0],
+        Start:    time.Now(),
+        Outcome:  OutcomeFailed,
+    }
+    ctx := context.WithValue(p.ctx, requestKey{}, req)
+    p.handler.ServeDNS(ctx, w, r)
+}
+
+// localStage answers local domains (and WPAD) with spoofed records
+func localStage(p *DNSProxy) (Middleware, error) {
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            if m := p.localAnswer(r); m != nil {
+                RequestFromContext(ctx).Outcome = OutcomeLocal
+                w.WriteMsg(m)
+                return
+            }
+            next.ServeDNS(ctx, w, r)
+        })
+    }, nil
+}
+
+// localAnswer builds the reply for a local domain, or nil when the name
+// is not ours or has no records of the asked type
+func (p *DNSProxy) localAnswer(r *dns.Msg) *dns.Msg {
+    qname := r.Question[0].Name
+    qtype := r.Question[0].Qtype
 
     // Check if it's one of our local domains
-    if ips, exists := p.domains[qname]; exists {
-        m := new(dns.Msg)
-        m.SetReply(r)
-        m.Authoritative = true
-
-        switch qtype {
-        case dns.TypeA:
-            // Add all IPv4 addresses
-            for _, ip := range ips {
-                if ipv4 := ip.To4(); ipv4 != nil {
-                    rr := &dns.A{
-                        Hdr: dns.RR_Header{
-                            Name:   qname,
-                            Rrtype: dns.TypeA,
-                            Class:  dns.ClassINET,
-                            Ttl:    300,
-                        },
-                        A: ipv4,
-                    }
-                    m.Answer = append(m.Answer, rr)
+    record, exists := p.locals.Load().domains[qname]
+    if !exists {
+        record = p.wpadRecord(qname)
+        exists = record != nil
+    }
+    if !exists {
+        return nil
+    }
+
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.Authoritative = true
+    ttl := p.ttl.localTTL(record.ttl)
+
+    switch qtype {
+    case dns.TypeA:
+        // Add all IPv4 addresses
+        for _, ip := range record.ips {
+            if ipv4 := ip.To4(); ipv4 != nil {
+                rr := &dns.A{
+                    Hdr: dns.RR_Header{
+                        Name:   qname,
+                        Rrtype: dns.TypeA,
+                        Class:  dns.ClassINET,
+                        Ttl:    ttl,
+                    },
+                    A: ipv4,
                 }
+                m.Answer = append(m.Answer, rr)
             }
-        case dns.TypeAAAA:
-            // Add all IPv6 addresses
-            for _, ip := range ips {
-                if ip.To4() == nil { // Is IPv6
-                    rr := &dns.AAAA{
-                        Hdr: dns.RR_Header{
-                            Name:   qname,
-                            Rrtype: dns.TypeAAAA,
-                            Class:  dns.ClassINET,
-                            Ttl:    300,
-                        },
-                        AAAA: ip,
-                    }
-                    m.Answer = append(m.Answer, rr)
+        }
+    case dns.TypeAAAA:
+        // Add all IPv6 addresses
+        for _, ip := range record.ips {
+            if ip.To4() == nil { // Is IPv6
+                rr := &dns.AAAA{
+                    Hdr: dns.RR_Header{
+                        Name:   qname,
+                        Rrtype: dns.TypeAAAA,
+                        Class:  dns.ClassINET,
+                        Ttl:    ttl,
+                    },
+                    AAAA: ip,
                 }
+                m.Answer = append(m.Answer, rr)
             }
         }
+    }
 
-        if len(m.Answer) > 0 {
-            w.WriteMsg(m)
-            return
-        }
+    if len(m.Answer) == 0 {
+        return nil
     }
+    return m
+}
+
+// forwardStage sends the query to the upstream servers over the WAN
+func forwardStage(p *DNSProxy) (Middleware, error) {
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            req := RequestFromContext(ctx)
+            if m := p.forward(r); m != nil {
+                p.archive.record(req.Question, m)
+                req.Outcome = OutcomeForwarded
+                w.WriteMsg(m)
+                return
+            }
 
+            // Return SERVFAIL if all upstream servers fail
+            req.Outcome = OutcomeFailed
+            m := new(dns.Msg)
+            m.SetRcode(r, dns.RcodeServerFailure)
+            w.WriteMsg(m)
+        })
+    }, nil
+}
+
+// forward tries each upstream in turn, returning nil when all of them fail
+func (p *DNSProxy) forward(r *dns.Msg) *dns.Msg {
     // Forward request using WAN interface
     c := &dns.Client{
         Timeout: 5 * time.Second,
@@ -164,25 +381,46 @@ func (p *DNSProxy) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
     // Try each upstream DNS server until one responds
     var lastErr error
     for _, upstream := range p.cfg.DNS.Upstream.IPv4 {
-        m, _, err := c.Exchange(r, upstream+":53")
+        m, rtt, err := c.Exchange(r, upstream+":53")
+        p.stats.observeUpstream(upstream, rtt, err)
+        if err == nil && m != nil && m.Truncated {
+            // large (typically signed) answers need TCP
+            tcp := *c
+            tcp.Net = "tcp"
+            tcp.Dialer = &net.Dialer{Timeout: c.Timeout}
+            if full, _, terr := tcp.Exchange(r, upstream+":53"); terr == nil && full != nil {
+                m = full
+            }
+        }
         if err == nil && m != nil {
-            w.WriteMsg(m)
-            return
+            return m
         }
         lastErr = err
     }
 
     log.Printf("Failed to forward DNS request: %v", lastErr)
-    
-    // Return SERVFAIL if all upstream servers fail
-    m := new(dns.Msg)
-    m.SetRcode(r, dns.RcodeServerFailure)
-    w.WriteMsg(m)
+    return nil
+}
+
+// clientIP extracts the source address of a query
+func clientIP(addr net.Addr) net.IP {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        return a.IP
+    case *net.TCPAddr:
+        return a.IP
+    }
+    return nil
 }
 
 func (p *DNSProxy) Stop() {
     p.cancel()
+    if p.server != nil {
+        p.server.Shutdown()
+    }
+    p.lan.stop()
     p.wg.Wait()
+    p.archive.close()
     log.Println("DNS Proxy stopped")
 }
 
@@ -0,0 +1,661 @@
+package dns
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+const (
+    dnssecOff      = "off"
+    dnssecPreserve = "preserve"
+    dnssecValidate = "validate"
+
+    // upstreamUDPSize is advertised on every query we send upstream
+    upstreamUDPSize = 4096
+)
+
+// rootAnchors are the IANA root KSKs (KSK-2017 and KSK-2024)
+var rootAnchors = []string{
+    ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+    ". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// security is the DNSSEC status of an answer
+type security int
+
+const (
+    insecure security = iota
+    secure
+    bogus
+)
+
+func (s security) String() string {
+    switch s {
+    case secure:
+        return "secure"
+    case bogus:
+        return "bogus"
+    }
+    return "insecure"
+}
+
+// dnssecStage keeps the DO bit and DNSSEC records intact on the way
+// upstream and, in validate mode, checks answers before they reach the
+// client. It sits above the answering stages so local answers can be
+// validated too unless exempted.
+func dnssecStage(p *DNSProxy) (Middleware, error) {
+    dc := p.cfg.DNS.DNSSEC
+    mode := strings.ToLower(dc.Mode)
+    var v *validator
+
+    switch mode {
+    case "", dnssecOff:
+        return nil, nil
+    case dnssecPreserve:
+    case dnssecValidate:
+        var err error
+        if v, err = newValidator(p.forward, dc.TrustAnchors); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, fmt.Errorf("unknown DNSSEC mode %q", dc.Mode)
+    }
+
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            clientOpt := r.IsEdns0()
+            clientDO := clientOpt != nil && clientOpt.Do()
+
+            // our own query always carries an OPT so large answers fit
+            up := r.Copy()
+            opt := up.IsEdns0()
+            if opt == nil {
+                up.SetEdns0(upstreamUDPSize, false)
+                opt = up.IsEdns0()
+            }
+            if opt.UDPSize() < upstreamUDPSize {
+                opt.SetUDPSize(upstreamUDPSize)
+            }
+            opt.SetDo(clientDO || v != nil)
+            if v != nil {
+                // we validate ourselves, so ask upstream for raw data
+                up.CheckingDisabled = true
+            }
+
+            next.ServeDNS(ctx, &dnssecWriter{
+                ResponseWriter: w,
+                ctx:            ctx,
+                proxy:          p,
+                validator:      v,
+                req:            r,
+                clientOpt:      clientOpt,
+            }, up)
+        })
+    }, nil
+}
+
+// dnssecWriter validates and then tailors answers to what the client asked
+type dnssecWriter struct {
+    dns.ResponseWriter
+    ctx       context.Context
+    proxy     *DNSProxy
+    validator *validator
+    req       *dns.Msg
+    clientOpt *dns.OPT
+}
+
+func (dw *dnssecWriter) WriteMsg(m *dns.Msg) error {
+    req := RequestFromContext(dw.ctx)
+    clientDO := dw.clientOpt != nil && dw.clientOpt.Do()
+
+    m.AuthenticatedData = false
+    if dw.validator != nil && !dw.req.CheckingDisabled && !dw.exempt(req) {
+        switch status := dw.validator.validate(m, req.Question.Name); status {
+        case secure:
+            m.AuthenticatedData = true
+        case bogus:
+            log.Printf("DNSSEC: bogus answer for %s %s to %s",
+                req.Question.Name, dns.TypeToString[req.Question.Qtype], req.Client)
+            req.Outcome = OutcomeFailed
+            fail := new(dns.Msg)
+            fail.SetRcode(dw.req, dns.RcodeServerFailure)
+            if dw.clientOpt != nil {
+                fail.SetEdns0(dw.clientOpt.UDPSize(), clientDO)
+                fail.IsEdns0().Option = append(fail.IsEdns0().Option, &dns.EDNS0_EDE{
+                    InfoCode: dns.ExtendedErrorCodeDNSBogus,
+                })
+            }
+            return dw.ResponseWriter.WriteMsg(fail)
+        }
+    }
+
+    m.Id = dw.req.Id
+    m.CheckingDisabled = dw.req.CheckingDisabled
+    if !clientDO {
+        stripDNSSEC(m, dw.req.Question[0].Qtype)
+    }
+
+    size := dns.MinMsgSize
+    if dw.clientOpt == nil {
+        // the client never asked for EDNS, so don't answer with it
+        m.Extra = removeOPT(m.Extra)
+    } else {
+        size = int(dw.clientOpt.UDPSize())
+        if opt := m.IsEdns0(); opt != nil {
+            opt.SetDo(clientDO)
+        }
+    }
+    if _, udp := dw.RemoteAddr().(*net.UDPAddr); udp {
+        m.Truncate(size)
+    }
+    return dw.ResponseWriter.WriteMsg(m)
+}
+
+// exempt reports answers we never validate: policy answers we produced
+// ourselves, offline replays, rewritten answers whose signatures no longer
+// fit the name and configured exemptions
+func (dw *dnssecWriter) exempt(req *Request) bool {
+    dc := dw.proxy.cfg.DNS.DNSSEC
+    switch req.Outcome {
+    case OutcomeBlocked, OutcomeFault, OutcomeReplayed, OutcomeRewritten:
+        return true
+    case OutcomeLocal:
+        if dc.ExemptLocal {
+            return true
+        }
+    }
+    return len(dc.Exempt) > 0 && matchAny(dc.Exempt, req.Question.Name)
+}
+
+// stripDNSSEC drops DNSSEC records a non-DO client did not ask for
+func stripDNSSEC(m *dns.Msg, qtype uint16) {
+    filter := func(rrs []dns.RR) []dns.RR {
+        out := rrs[:0]
+        for _, rr := range rrs {
+            t := rr.Header().Rrtype
+            if t != qtype && (t == dns.TypeRRSIG || t == dns.TypeNSEC || t == dns.TypeNSEC3 || t == dns.TypeDS) {
+                continue
+            }
+            out = append(out, rr)
+        }
+        return out
+    }
+    m.Answer = filter(m.Answer)
+    m.Ns = filter(m.Ns)
+    m.Extra = filter(m.Extra)
+}
+
+func removeOPT(rrs []dns.RR) []dns.RR {
+    out := rrs[:0]
+    for _, rr := range rrs {
+        if rr.Header().Rrtype != dns.TypeOPT {
+            out = append(out, rr)
+        }
+    }
+    return out
+}
+
+// validator checks RRSIG chains from the trust anchors down to answers
+type validator struct {
+    // exchange sends a query upstream, nil when none answered
+    exchange func(*dns.Msg) *dns.Msg
+    anchors  map[string][]*dns.DS
+    mu      sync.Mutex
+    zones   map[string]*zoneKeys
+}
+
+// zoneKeys is the validated key set of a zone apex
+type zoneKeys struct {
+    status  security
+    keys    []*dns.DNSKEY
+    expires time.Time
+}
+
+func newValidator(exchange func(*dns.Msg) *dns.Msg, anchors []string) (*validator, error) {
+    if len(anchors) == 0 {
+        anchors = rootAnchors
+    }
+    v := &validator{
+        exchange: exchange,
+        anchors:  make(map[string][]*dns.DS),
+        zones:    make(map[string]*zoneKeys),
+    }
+    for _, a := range anchors {
+        rr, err := dns.NewRR(a)
+        if err != nil {
+            return nil, fmt.Errorf("invalid trust anchor %q: %w", a, err)
+        }
+        var ds *dns.DS
+        switch t := rr.(type) {
+        case *dns.DS:
+            ds = t
+        case *dns.DNSKEY:
+            ds = t.ToDS(dns.SHA256)
+        default:
+            return nil, fmt.Errorf("trust anchor %q is neither DS nor DNSKEY", a)
+        }
+        zone := strings.ToLower(ds.Hdr.Name)
+        v.anchors[zone] = append(v.anchors[zone], ds)
+    }
+    return v, nil
+}
+
+// query asks upstream for raw DNSSEC data
+func (v *validator) query(name string, qtype uint16) (*dns.Msg, error) {
+    m := new(dns.Msg)
+    m.SetQuestion(name, qtype)
+    m.SetEdns0(upstreamUDPSize, true)
+    m.CheckingDisabled = true
+    resp := v.exchange(m)
+    if resp == nil {
+        return nil, fmt.Errorf("no upstream answered %s %s", name, dns.TypeToString[qtype])
+    }
+    return resp, nil
+}
+
+// walk tracks the lookups one validation has in progress, so an answer
+// whose chain leads back to itself fails instead of recursing forever
+type walk map[string]bool
+
+// maxWalkDepth bounds how many lookups may be nested in one validation
+const maxWalkDepth = 32
+
+func (w walk) enter(step, name string) error {
+    key := step + " " + name
+    if w[key] {
+        return fmt.Errorf("chain of trust loops at %s %s", step, name)
+    }
+    if len(w) >= maxWalkDepth {
+        return fmt.Errorf("chain of trust for %s is too long", name)
+    }
+    w[key] = true
+    return nil
+}
+
+func (w walk) leave(step, name string) {
+    delete(w, step+" "+name)
+}
+
+// validate classifies a whole response. Every RRset in the answer and
+// authority sections must verify; the weakest result wins. A secure
+// negative or wildcard answer must also carry the NSEC/NSEC3 proof that
+// the name or type is absent, or a replayed denial could deny anything.
+func (v *validator) validate(m *dns.Msg, qname string) security {
+    w := make(walk)
+    sets, sigs := groupRRsets(append(append([]dns.RR{}, m.Answer...), m.Ns...))
+    if len(sets) == 0 {
+        status, err := v.classifyUnsigned(w, qname)
+        if err != nil {
+            log.Printf("DNSSEC: %s: %v", qname, err)
+            return bogus
+        }
+        return status
+    }
+
+    result := secure
+    for key, set := range sets {
+        status, err := v.verifyRRset(w, set, sigs[key])
+        if err != nil {
+            log.Printf("DNSSEC: %s %s: %v", key.name, dns.TypeToString[key.rrtype], err)
+            return bogus
+        }
+        if status == bogus {
+            return bogus
+        }
+        if status == insecure {
+            result = insecure
+        }
+    }
+    if result != secure || len(m.Question) == 0 {
+        return result
+    }
+    result, err := proveAnswer(m, qname, m.Question[0].Qtype)
+    if err != nil {
+        log.Printf("DNSSEC: %s: %v", qname, err)
+    }
+    return result
+}
+
+type rrsetKey struct {
+    name   string
+    rrtype uint16
+}
+
+// groupRRsets splits records into RRsets and the signatures covering them
+func groupRRsets(rrs []dns.RR) (map[rrsetKey][]dns.RR, map[rrsetKey][]*dns.RRSIG) {
+    sets := make(map[rrsetKey][]dns.RR)
+    sigs := make(map[rrsetKey][]*dns.RRSIG)
+    for _, rr := range rrs {
+        hdr := rr.Header()
+        name := strings.ToLower(hdr.Name)
+        if sig, ok := rr.(*dns.RRSIG); ok {
+            key := rrsetKey{name, sig.TypeCovered}
+            sigs[key] = append(sigs[key], sig)
+            continue
+        }
+        key := rrsetKey{name, hdr.Rrtype}
+        sets[key] = append(sets[key], rr)
+    }
+    return sets, sigs
+}
+
+// verifyRRset checks one RRset against its signatures. Only a zone above
+// the owner may sign it, and a DS only its parent side, so no zone can
+// vouch for names outside itself.
+func (v *validator) verifyRRset(w walk, set []dns.RR, sigs []*dns.RRSIG) (security, error) {
+    owner := strings.ToLower(dns.Fqdn(set[0].Header().Name))
+    if len(sigs) == 0 {
+        return v.classifyUnsigned(w, owner)
+    }
+
+    now := time.Now()
+    var lastErr error
+    for _, sig := range sigs {
+        signer := strings.ToLower(dns.Fqdn(sig.SignerName))
+        if !dns.IsSubDomain(signer, owner) {
+            lastErr = fmt.Errorf("%s may not sign %s", signer, owner)
+            continue
+        }
+        if set[0].Header().Rrtype == dns.TypeDS && signer == owner {
+            lastErr = fmt.Errorf("DS for %s signed by the zone itself", owner)
+            continue
+        }
+        zk, err := v.keysFor(w, signer)
+        if err != nil {
+            return bogus, err
+        }
+        if zk.status == insecure {
+            return insecure, nil
+        }
+        if !sig.ValidityPeriod(now) {
+            lastErr = fmt.Errorf("signature by %s outside its validity period", sig.SignerName)
+            continue
+        }
+        for _, key := range zk.keys {
+            if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+                continue
+            }
+            if err := sig.Verify(key, set); err != nil {
+                lastErr = err
+                continue
+            }
+            return secure, nil
+        }
+    }
+    if lastErr == nil {
+        lastErr = errors.New("no matching key for any signature")
+    }
+    return bogus, lastErr
+}
+
+// keysFor returns the validated DNSKEYs of a zone apex, walking up to a
+// trust anchor through signed DS records.
+func (v *validator) keysFor(w walk, zone string) (*zoneKeys, error) {
+    zone = strings.ToLower(dns.Fqdn(zone))
+
+    v.mu.Lock()
+    if zk, ok := v.zones[zone]; ok && time.Now().Before(zk.expires) {
+        v.mu.Unlock()
+        return zk, nil
+    }
+    v.mu.Unlock()
+
+    if err := w.enter("keys", zone); err != nil {
+        return nil, err
+    }
+    zk, err := v.resolveKeys(w, zone)
+    w.leave("keys", zone)
+    if err != nil {
+        return nil, err
+    }
+
+    v.mu.Lock()
+    v.zones[zone] = zk
+    v.mu.Unlock()
+    return zk, nil
+}
+
+func (v *validator) resolveKeys(w walk, zone string) (*zoneKeys, error) {
+    if ds, ok := v.anchors[zone]; ok {
+        return v.fetchKeys(zone, ds)
+    }
+    if zone == "." {
+        // no anchor covers the root, so nothing chains to it
+        return &zoneKeys{status: insecure, expires: time.Now().Add(time.Hour)}, nil
+    }
+
+    resp, err := v.query(zone, dns.TypeDS)
+    if err != nil {
+        return nil, err
+    }
+
+    sets, sigs := groupRRsets(resp.Answer)
+    key := rrsetKey{zone, dns.TypeDS}
+    if dsSet, ok := sets[key]; ok {
+        status, err := v.verifyRRset(w, dsSet, sigs[key])
+        if err != nil || status == bogus {
+            return nil, fmt.Errorf("DS for %s does not verify: %v", zone, err)
+        }
+        if status == insecure {
+            return &zoneKeys{status: insecure, expires: expiry(dsSet)}, nil
+        }
+        var ds []*dns.DS
+        for _, rr := range dsSet {
+            ds = append(ds, rr.(*dns.DS))
+        }
+        return v.fetchKeys(zone, ds)
+    }
+
+    // no DS: the parent must prove the delegation is unsigned
+    status, err := v.provenUnsigned(w, zone, resp)
+    if err != nil {
+        return nil, err
+    }
+    if status != insecure {
+        return nil, fmt.Errorf("%s has no DS but parent does not prove an insecure delegation", zone)
+    }
+    return &zoneKeys{status: insecure, expires: time.Now().Add(time.Hour)}, nil
+}
+
+// fetchKeys loads a zone's DNSKEY RRset and checks it is self-signed by a
+// key matching one of the DS records. Only the DS records decide whether
+// the zone can be validated at all; once one is usable, a missing key is
+// an attack, not an excuse to treat the zone as unsigned.
+func (v *validator) fetchKeys(zone string, dsSet []*dns.DS) (*zoneKeys, error) {
+    var usable []*dns.DS
+    for _, ds := range dsSet {
+        if supportedDS(ds) {
+            usable = append(usable, ds)
+        }
+    }
+    if len(usable) == 0 {
+        // RFC 4035 5.2: unsupported algorithms make the zone insecure
+        return &zoneKeys{status: insecure, expires: expiry(dsRRs(dsSet))}, nil
+    }
+
+    resp, err := v.query(zone, dns.TypeDNSKEY)
+    if err != nil {
+        return nil, err
+    }
+    sets, sigs := groupRRsets(resp.Answer)
+    key := rrsetKey{zone, dns.TypeDNSKEY}
+    keySet := sets[key]
+    if len(keySet) == 0 {
+        return nil, fmt.Errorf("%s has a DS but no DNSKEY", zone)
+    }
+
+    var keys []*dns.DNSKEY
+    for _, rr := range keySet {
+        keys = append(keys, rr.(*dns.DNSKEY))
+    }
+
+    now := time.Now()
+    for _, ds := range usable {
+        for _, k := range keys {
+            if k.KeyTag() != ds.KeyTag || k.Algorithm != ds.Algorithm {
+                continue
+            }
+            digest := k.ToDS(ds.DigestType)
+            if digest == nil || !strings.EqualFold(digest.Digest, ds.Digest) {
+                continue
+            }
+            for _, sig := range sigs[key] {
+                if sig.KeyTag != k.KeyTag() || !sig.ValidityPeriod(now) {
+                    continue
+                }
+                if sig.Verify(k, keySet) == nil {
+                    return &zoneKeys{status: secure, keys: keys, expires: expiry(keySet)}, nil
+                }
+            }
+        }
+    }
+    return nil, fmt.Errorf("DNSKEY set for %s is not signed by a key matching its DS", zone)
+}
+
+// supportedDS reports whether the validator implements the digest and
+// signing algorithm a DS record names
+func supportedDS(ds *dns.DS) bool {
+    switch ds.DigestType {
+    case dns.SHA1, dns.SHA256, dns.SHA384:
+    default:
+        return false
+    }
+    switch ds.Algorithm {
+    case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+        dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+        return true
+    }
+    return false
+}
+
+func dsRRs(dsSet []*dns.DS) []dns.RR {
+    rrs := make([]dns.RR, 0, len(dsSet))
+    for _, ds := range dsSet {
+        rrs = append(rrs, ds)
+    }
+    return rrs
+}
+
+// classifyUnsigned decides whether unsigned data for name is acceptable:
+// it is if name sits in an unsigned zone or below an insecure delegation.
+func (v *validator) classifyUnsigned(w walk, name string) (security, error) {
+    name = strings.ToLower(dns.Fqdn(name))
+    if err := w.enter("unsigned", name); err != nil {
+        return bogus, err
+    }
+    defer w.leave("unsigned", name)
+    resp, err := v.query(name, dns.TypeDS)
+    if err != nil {
+        return bogus, err
+    }
+
+    // a signed DS for name means it is a secure zone of its own
+    sets, sigs := groupRRsets(resp.Answer)
+    key := rrsetKey{name, dns.TypeDS}
+    if dsSet, ok := sets[key]; ok {
+        status, err := v.verifyRRset(w, dsSet, sigs[key])
+        if err != nil {
+            return bogus, err
+        }
+        if status == secure {
+            return bogus, fmt.Errorf("%s is a signed zone but the data is unsigned", name)
+        }
+        return insecure, nil
+    }
+    return v.provenUnsigned(w, name, resp)
+}
+
+// provenUnsigned inspects a negative DS response for name. The answering
+// zone is taken from the SOA; if that zone is unsigned so is name,
+// otherwise its signed NSEC/NSEC3 records must show an insecure delegation.
+func (v *validator) provenUnsigned(w walk, name string, resp *dns.Msg) (security, error) {
+    var parent string
+    for _, rr := range resp.Ns {
+        if soa, ok := rr.(*dns.SOA); ok {
+            parent = strings.ToLower(soa.Hdr.Name)
+        }
+    }
+    if parent == "" || parent == name || !dns.IsSubDomain(parent, name) {
+        // fall back to the next label up
+        off, end := dns.NextLabel(name, 0)
+        if end {
+            parent = "."
+        } else {
+            parent = name[off:]
+        }
+    }
+
+    zk, err := v.keysFor(w, parent)
+    if err != nil {
+        return bogus, err
+    }
+    if zk.status == insecure {
+        return insecure, nil
+    }
+
+    // the parent is signed: its denial must verify and show a delegation
+    sets, sigs := groupRRsets(resp.Ns)
+    for key, set := range sets {
+        status, err := v.verifyRRset(w, set, sigs[key])
+        if err != nil || status != secure {
+            return bogus, fmt.Errorf("denial for %s does not verify: %v", name, err)
+        }
+    }
+    if insecureDelegation(name, resp.Ns) {
+        return insecure, nil
+    }
+    return bogus, fmt.Errorf("%s is inside signed zone %s", name, parent)
+}
+
+// insecureDelegation reports whether the denial shows name as a delegation
+// without DS, or covered by an opt-out NSEC3 span
+func insecureDelegation(name string, ns []dns.RR) bool {
+    for _, rr := range ns {
+        switch d := rr.(type) {
+        case *dns.NSEC:
+            if strings.EqualFold(d.Hdr.Name, name) {
+                return hasType(d.TypeBitMap, dns.TypeNS) && !hasType(d.TypeBitMap, dns.TypeDS) &&
+                    !hasType(d.TypeBitMap, dns.TypeSOA)
+            }
+        case *dns.NSEC3:
+            if d.Match(name) {
+                return hasType(d.TypeBitMap, dns.TypeNS) && !hasType(d.TypeBitMap, dns.TypeDS)
+            }
+            if d.Cover(name) && d.Flags&1 == 1 {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+    for _, b := range bitmap {
+        if b == t {
+            return true
+        }
+    }
+    return false
+}
+
+// expiry caches validated data for its TTL, bounded to a sane window
+func expiry(set []dns.RR) time.Time {
+    ttl := time.Hour
+    for _, rr := range set {
+        if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+            ttl = t
+        }
+    }
+    if ttl < time.Minute {
+        ttl = time.Minute
+    }
+    return time.Now().Add(ttl)
+}
@@ -0,0 +1,502 @@
+package dns
+
+import (
+    "context"
+    "crypto"
+    "net"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// zoneKey is a DNSKEY with its private half
+type zoneKey struct {
+    key  *dns.DNSKEY
+    priv crypto.Signer
+}
+
+func newZoneKey(t *testing.T, zone string, flags uint16) *zoneKey {
+    t.Helper()
+    k := &dns.DNSKEY{
+        Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+        Flags:     flags,
+        Protocol:  3,
+        Algorithm: dns.ECDSAP256SHA256,
+    }
+    priv, err := k.Generate(256)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &zoneKey{key: k, priv: priv.(crypto.Signer)}
+}
+
+// sign returns set followed by its signature, made by zk on behalf of signer
+func (zk *zoneKey) sign(t *testing.T, signer string, set ...dns.RR) []dns.RR {
+    t.Helper()
+    hdr := set[0].Header()
+    sig := &dns.RRSIG{
+        Hdr:         dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+        TypeCovered: hdr.Rrtype,
+        Algorithm:   zk.key.Algorithm,
+        Labels:      uint8(dns.CountLabel(hdr.Name)),
+        OrigTtl:     hdr.Ttl,
+        Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+        Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+        KeyTag:      zk.key.KeyTag(),
+        SignerName:  signer,
+    }
+    if err := sig.Sign(zk.priv, set); err != nil {
+        t.Fatal(err)
+    }
+    return append(append([]dns.RR{}, set...), sig)
+}
+
+func ds(t *testing.T, zk *zoneKey) *dns.DS {
+    t.Helper()
+    d := zk.key.ToDS(dns.SHA256)
+    d.Hdr.Ttl = 3600
+    return d
+}
+
+func rr(t *testing.T, s string) dns.RR {
+    t.Helper()
+    r, err := dns.NewRR(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return r
+}
+
+// nsec is an NSEC record of the example. zone
+func nsec(name, next string, types ...uint16) dns.RR {
+    return &dns.NSEC{
+        Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+        NextDomain: next,
+        TypeBitMap: bitmap(append(types, dns.TypeRRSIG, dns.TypeNSEC)),
+    }
+}
+
+// bitmap sorts types as the wire format needs
+func bitmap(types []uint16) []uint16 {
+    sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+    return types
+}
+
+// nsec3Chain is the complete NSEC3 chain, unsalted and unhashed again,
+// of the example. names given with their types
+func nsec3Chain(names map[string][]uint16) []*dns.NSEC3 {
+    type entry struct {
+        hash  string
+        types []uint16
+    }
+    var chain []entry
+    for name, types := range names {
+        chain = append(chain, entry{dns.HashName(name, dns.SHA1, 0, ""), types})
+    }
+    sort.Slice(chain, func(i, j int) bool { return chain[i].hash < chain[j].hash })
+    var out []*dns.NSEC3
+    for i, e := range chain {
+        out = append(out, &dns.NSEC3{
+            Hdr:        dns.RR_Header{Name: strings.ToLower(e.hash) + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+            Hash:       dns.SHA1,
+            NextDomain: chain[(i+1)%len(chain)].hash,
+            HashLength: 20,
+            TypeBitMap: bitmap(append(e.types, dns.TypeRRSIG)),
+        })
+    }
+    return out
+}
+
+// upstream answers validator queries from a fixed table
+type upstream struct {
+    answers map[string][]dns.RR // "name type" -> answer section
+    denials map[string][]dns.RR // "name type" -> authority section
+}
+
+func (u *upstream) exchange(q *dns.Msg) *dns.Msg {
+    key := strings.ToLower(q.Question[0].Name) + " " + dns.TypeToString[q.Question[0].Qtype]
+    m := new(dns.Msg)
+    m.SetReply(q)
+    m.Answer = u.answers[key]
+    m.Ns = u.denials[key]
+    return m
+}
+
+// newHierarchy is a signed root with a signed example. (split KSK/ZSK), an
+// unsigned insecure. delegation, a loop. zone whose DS signs itself and an
+// odd. zone using an unknown algorithm
+func newHierarchy(t *testing.T) (*upstream, *zoneKey, *zoneKey, *zoneKey) {
+    root := newZoneKey(t, ".", 257)
+    ksk := newZoneKey(t, "example.", 257)
+    zsk := newZoneKey(t, "example.", 256)
+    loop := newZoneKey(t, "loop.", 257)
+
+    u := &upstream{answers: map[string][]dns.RR{}, denials: map[string][]dns.RR{}}
+    u.answers[". DNSKEY"] = root.sign(t, ".", root.key)
+    u.answers["example. DS"] = root.sign(t, ".", ds(t, ksk))
+    u.answers["example. DNSKEY"] = ksk.sign(t, "example.", ksk.key, zsk.key)
+    u.answers["loop. DS"] = loop.sign(t, "loop.", ds(t, loop))
+    u.answers["loop. DNSKEY"] = loop.sign(t, "loop.", loop.key)
+
+    // odd. has a signed DS with an algorithm nobody implements
+    odd := &dns.DS{
+        Hdr:        dns.RR_Header{Name: "odd.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600},
+        KeyTag:     1,
+        Algorithm:  dns.PRIVATEDNS,
+        DigestType: dns.SHA256,
+        Digest:     strings.Repeat("00", 32),
+    }
+    u.answers["odd. DS"] = root.sign(t, ".", odd)
+
+    // the root proves insecure. is delegated without a DS
+    soa := rr(t, ". 3600 IN SOA a.root. nstld. 1 1800 900 604800 86400")
+    nsec := &dns.NSEC{
+        Hdr:        dns.RR_Header{Name: "insecure.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+        NextDomain: "loop.",
+        TypeBitMap: []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC},
+    }
+    u.denials["insecure. DS"] = append(root.sign(t, ".", soa), root.sign(t, ".", nsec)...)
+    u.denials["www.insecure. DS"] = []dns.RR{rr(t, "insecure. 3600 IN SOA ns.insecure. h.insecure. 1 1800 900 604800 86400")}
+    return u, root, ksk, zsk
+}
+
+func TestValidate(t *testing.T) {
+    a := func(t *testing.T, name, ip string) dns.RR {
+        return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}
+    }
+
+    // denial signs the SOA of example. and the records given, as the
+    // authority section of a negative answer
+    denial := func(t *testing.T, zsk *zoneKey, rrs ...dns.RR) []dns.RR {
+        out := zsk.sign(t, "example.", rr(t, "example. 3600 IN SOA ns.example. h.example. 1 1800 900 604800 86400"))
+        for _, r := range rrs {
+            out = append(out, zsk.sign(t, "example.", r)...)
+        }
+        return out
+    }
+    chain := nsec3Chain(map[string][]uint16{
+        "example.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY},
+        "a.example.":   {dns.TypeA},
+        "www.example.": {dns.TypeA},
+    })
+    nsec3s := func() []dns.RR {
+        var rrs []dns.RR
+        for _, n := range chain {
+            rrs = append(rrs, n)
+        }
+        return rrs
+    }
+
+    tests := []struct {
+        name  string
+        qname string
+        qtype uint16 // A unless set
+        rcode int
+        // answer builds the response, strip rewrites the upstream first
+        answer    func(t *testing.T, root, ksk, zsk *zoneKey) []dns.RR
+        authority func(t *testing.T, zsk *zoneKey) []dns.RR
+        strip     func(u *upstream, ksk *zoneKey)
+        want      security
+    }{
+        {
+            name:  "secure chain",
+            qname: "www.example.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                return zsk.sign(t, "example.", a(t, "www.example.", "192.0.2.1"))
+            },
+            want: secure,
+        },
+        {
+            name:  "insecure delegation",
+            qname: "www.insecure.",
+            answer: func(t *testing.T, _, _, _ *zoneKey) []dns.RR {
+                return []dns.RR{a(t, "www.insecure.", "192.0.2.2")}
+            },
+            want: insecure,
+        },
+        {
+            name:  "tampered data",
+            qname: "www.example.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                rrs := zsk.sign(t, "example.", a(t, "www.example.", "192.0.2.1"))
+                rrs[0].(*dns.A).A = net.ParseIP("198.51.100.1")
+                return rrs
+            },
+            want: bogus,
+        },
+        {
+            name:  "unsigned data in a signed zone",
+            qname: "www.example.",
+            answer: func(t *testing.T, _, _, _ *zoneKey) []dns.RR {
+                return []dns.RR{a(t, "www.example.", "192.0.2.1")}
+            },
+            want: bogus,
+        },
+        {
+            name:  "stripped KSK",
+            qname: "www.example.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                return zsk.sign(t, "example.", a(t, "www.example.", "192.0.2.1"))
+            },
+            strip: func(u *upstream, ksk *zoneKey) {
+                var kept []dns.RR
+                for _, r := range u.answers["example. DNSKEY"] {
+                    if k, ok := r.(*dns.DNSKEY); ok && k.KeyTag() == ksk.key.KeyTag() {
+                        continue
+                    }
+                    kept = append(kept, r)
+                }
+                u.answers["example. DNSKEY"] = kept
+            },
+            want: bogus,
+        },
+        {
+            name:  "signer outside the owner's zone",
+            qname: "bank.test.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                return zsk.sign(t, "example.", a(t, "bank.test.", "192.0.2.3"))
+            },
+            want: bogus,
+        },
+        {
+            name:  "signer from an unsigned zone",
+            qname: "www.example.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                return zsk.sign(t, "insecure.", a(t, "www.example.", "192.0.2.1"))
+            },
+            want: bogus,
+        },
+        {
+            name:  "DS signed by its own zone",
+            qname: "www.loop.",
+            answer: func(t *testing.T, _, _, _ *zoneKey) []dns.RR {
+                lk := newZoneKey(t, "loop.", 257)
+                return lk.sign(t, "loop.", a(t, "www.loop.", "192.0.2.4"))
+            },
+            want: bogus,
+        },
+        {
+            name:  "unsupported DS algorithm",
+            qname: "www.odd.",
+            answer: func(t *testing.T, _, _, _ *zoneKey) []dns.RR {
+                return []dns.RR{a(t, "www.odd.", "192.0.2.5")}
+            },
+            want: insecure,
+        },
+        {
+            name:  "NXDOMAIN proven by NSEC",
+            qname: "b.example.",
+            rcode: dns.RcodeNameError,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk,
+                    nsec("a.example.", "www.example.", dns.TypeA),
+                    nsec("example.", "a.example.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY))
+            },
+            want: secure,
+        },
+        {
+            name:  "NXDOMAIN from a replayed NSEC",
+            qname: "zzz.example.",
+            rcode: dns.RcodeNameError,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk,
+                    nsec("a.example.", "www.example.", dns.TypeA),
+                    nsec("example.", "a.example.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY))
+            },
+            want: bogus,
+        },
+        {
+            name:  "NXDOMAIN without the wildcard denied",
+            qname: "b.example.",
+            rcode: dns.RcodeNameError,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec("a.example.", "www.example.", dns.TypeA))
+            },
+            want: bogus,
+        },
+        {
+            name:  "NODATA proven by NSEC",
+            qname: "www.example.",
+            qtype: dns.TypeAAAA,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec("www.example.", "example.", dns.TypeA))
+            },
+            want: secure,
+        },
+        {
+            name:  "NODATA from an NSEC listing the type",
+            qname: "www.example.",
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec("www.example.", "example.", dns.TypeA))
+            },
+            want: bogus,
+        },
+        {
+            name:  "NODATA with only the SOA",
+            qname: "www.example.",
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk)
+            },
+            want: bogus,
+        },
+        {
+            name:  "NXDOMAIN proven by NSEC3",
+            qname: "b.example.",
+            rcode: dns.RcodeNameError,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec3s()...)
+            },
+            want: secure,
+        },
+        {
+            name:  "NXDOMAIN for a name NSEC3 shows exists",
+            qname: "www.example.",
+            rcode: dns.RcodeNameError,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec3s()...)
+            },
+            want: bogus,
+        },
+        {
+            name:  "NODATA proven by NSEC3",
+            qname: "www.example.",
+            qtype: dns.TypeAAAA,
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec3s()...)
+            },
+            want: secure,
+        },
+        {
+            name:  "wildcard answer for a name NSEC shows exists",
+            qname: "www.example.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                rrs := zsk.sign(t, "example.", a(t, "*.example.", "192.0.2.9"))
+                for _, r := range rrs {
+                    r.Header().Name = "www.example."
+                }
+                return rrs
+            },
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec("a.example.", "www.example.", dns.TypeA))
+            },
+            want: bogus,
+        },
+        {
+            name:  "wildcard answer with its proof",
+            qname: "b.example.",
+            answer: func(t *testing.T, _, _, zsk *zoneKey) []dns.RR {
+                rrs := zsk.sign(t, "example.", a(t, "*.example.", "192.0.2.9"))
+                for _, r := range rrs {
+                    r.Header().Name = "b.example."
+                }
+                return rrs
+            },
+            authority: func(t *testing.T, zsk *zoneKey) []dns.RR {
+                return denial(t, zsk, nsec("a.example.", "www.example.", dns.TypeA))
+            },
+            want: secure,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            u, root, ksk, zsk := newHierarchy(t)
+            if tt.strip != nil {
+                tt.strip(u, ksk)
+            }
+
+            v, err := newValidator(u.exchange, []string{ds(t, root).String()})
+            if err != nil {
+                t.Fatal(err)
+            }
+            qtype := tt.qtype
+            if qtype == 0 {
+                qtype = dns.TypeA
+            }
+            m := new(dns.Msg)
+            m.SetQuestion(tt.qname, qtype)
+            m.Rcode = tt.rcode
+            if tt.answer != nil {
+                m.Answer = tt.answer(t, root, ksk, zsk)
+            }
+            if tt.authority != nil {
+                m.Ns = tt.authority(t, zsk)
+            }
+            if got := v.validate(m, tt.qname); got != tt.want {
+                t.Errorf("validate = %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+// recorder keeps the message written to it
+type recorder struct {
+    dns.ResponseWriter
+    msg *dns.Msg
+}
+
+func (r *recorder) WriteMsg(m *dns.Msg) error {
+    r.msg = m
+    return nil
+}
+
+func (r *recorder) RemoteAddr() net.Addr {
+    return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 100), Port: 5353}
+}
+
+// A rewritten answer carries the target's signatures under the client's
+// name, so validating it would fail every rewrite into a signed zone
+func TestValidateRewritten(t *testing.T) {
+    u, root, _, zsk := newHierarchy(t)
+    v, err := newValidator(u.exchange, []string{ds(t, root).String()})
+    if err != nil {
+        t.Fatal(err)
+    }
+    cfg := &config.Config{}
+    cfg.DNS.Rewrites = []config.RewriteRule{{From: "alias.test", To: "www.example."}}
+    p := &DNSProxy{cfg: cfg}
+    rewrite, err := rewriteStage(p)
+    if err != nil {
+        t.Fatal(err)
+    }
+    upstream := HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        m.Answer = zsk.sign(t, "example.", &dns.A{
+            Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+            A:   net.ParseIP("192.0.2.1"),
+        })
+        RequestFromContext(ctx).Outcome = OutcomeForwarded
+        w.WriteMsg(m)
+    })
+
+    r := new(dns.Msg)
+    r.SetQuestion("alias.test.", dns.TypeA)
+    req := &Request{Question: r.Question[0], Outcome: OutcomeFailed}
+    ctx := context.WithValue(context.Background(), requestKey{}, req)
+    rec := &recorder{}
+    rewrite(upstream).ServeDNS(ctx, &dnssecWriter{
+        ResponseWriter: rec,
+        ctx:            ctx,
+        proxy:          p,
+        validator:      v,
+        req:            r,
+    }, r)
+
+    if rec.msg == nil || rec.msg.Rcode != dns.RcodeSuccess {
+        t.Fatalf("got %v, want the rewritten answer", rec.msg)
+    }
+    if len(rec.msg.Answer) != 1 || rec.msg.Answer[0].Header().Name != "alias.test." {
+        t.Errorf("answer = %v, want one A for alias.test.", rec.msg.Answer)
+    }
+    if rec.msg.AuthenticatedData {
+        t.Errorf("rewritten answer marked authenticated")
+    }
+    if req.Outcome != OutcomeRewritten {
+        t.Errorf("outcome = %s, want %s", req.Outcome, OutcomeRewritten)
+    }
+}
@@ -0,0 +1,272 @@
+package dns
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "math/rand"
+    "net"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// faultInjector degrades answers for matching queries so QA can see how
+// applications cope with a misbehaving resolver.
+type faultInjector struct {
+    enabled atomic.Bool
+    rules   []*faultRule
+}
+
+type faultRule struct {
+    cfg     config.FaultRule
+    enabled atomic.Bool
+    clients []*net.IPNet
+    qtypes  map[uint16]bool
+    rcode   int
+}
+
+func newFaultInjector(cfg *config.Config) (*faultInjector, error) {
+    f := &faultInjector{}
+    f.enabled.Store(cfg.DNS.Faults.Enabled)
+
+    for i, rc := range cfg.DNS.Faults.Rules {
+        rule := &faultRule{cfg: rc, rcode: -1}
+        if rule.cfg.Name == "" {
+            rule.cfg.Name = fmt.Sprintf("rule-%d", i)
+        }
+        rule.enabled.Store(!rc.Disabled)
+
+        for _, c := range rc.Clients {
+            n, err := parseClientNet(c)
+            if err != nil {
+                return nil, fmt.Errorf("fault rule %s: %w", rule.cfg.Name, err)
+            }
+            rule.clients = append(rule.clients, n)
+        }
+
+        if len(rc.QTypes) > 0 {
+            rule.qtypes = make(map[uint16]bool)
+            for _, t := range rc.QTypes {
+                qtype, ok := dns.StringToType[strings.ToUpper(t)]
+                if !ok {
+                    return nil, fmt.Errorf("fault rule %s: unknown qtype %q", rule.cfg.Name, t)
+                }
+                rule.qtypes[qtype] = true
+            }
+        }
+
+        switch strings.ToUpper(rc.Rcode) {
+        case "":
+        case "SERVFAIL":
+            rule.rcode = dns.RcodeServerFailure
+        case "REFUSED":
+            rule.rcode = dns.RcodeRefused
+        case "NXDOMAIN":
+            rule.rcode = dns.RcodeNameError
+        default:
+            return nil, fmt.Errorf("fault rule %s: unsupported rcode %q", rule.cfg.Name, rc.Rcode)
+        }
+
+        f.rules = append(f.rules, rule)
+    }
+    return f, nil
+}
+
+// parseClientNet accepts either a bare IP or a CIDR.
+func parseClientNet(s string) (*net.IPNet, error) {
+    if strings.Contains(s, "/") {
+        _, n, err := net.ParseCIDR(s)
+        if err != nil {
+            return nil, fmt.Errorf("invalid client CIDR %q: %w", s, err)
+        }
+        return n, nil
+    }
+    ip := net.ParseIP(s)
+    if ip == nil {
+        return nil, fmt.Errorf("invalid client address %q", s)
+    }
+    bits := 128
+    if ip4 := ip.To4(); ip4 != nil {
+        ip, bits = ip4, 32
+    }
+    return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if ip != nil && n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// match returns the first active rule selecting this query, if any.
+func (f *faultInjector) match(client net.IP, q dns.Question) *faultRule {
+    if !f.enabled.Load() {
+        return nil
+    }
+    for _, rule := range f.rules {
+        if !rule.enabled.Load() {
+            continue
+        }
+        if len(rule.cfg.Domains) > 0 && !matchAny(rule.cfg.Domains, q.Name) {
+            continue
+        }
+        if len(rule.clients) > 0 && !containsIP(rule.clients, client) {
+            continue
+        }
+        if rule.qtypes != nil && !rule.qtypes[q.Qtype] {
+            continue
+        }
+        if rule.cfg.Probability > 0 && rand.Float64() >= rule.cfg.Probability {
+            continue
+        }
+        return rule
+    }
+    return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+    for _, pattern := range patterns {
+        if matchDomain(pattern, name) {
+            return true
+        }
+    }
+    return false
+}
+
+// inject applies the rule to the query. It returns true when the fault
+// fully handled the request, otherwise the returned writer must be used
+// to send the real answer so response-level faults can be applied.
+func (rule *faultRule) inject(w dns.ResponseWriter, r *dns.Msg, client net.IP) (dns.ResponseWriter, bool) {
+    q := r.Question[0]
+    name := rule.cfg.Name
+
+    if rule.cfg.Latency > 0 {
+        log.Printf("DNS fault %s: delaying %s %s from %s by %v",
+            name, q.Name, dns.TypeToString[q.Qtype], client, rule.cfg.Latency)
+        time.Sleep(rule.cfg.Latency)
+    }
+
+    if rule.cfg.Drop > 0 && rand.Float64() < rule.cfg.Drop {
+        log.Printf("DNS fault %s: dropping %s %s from %s",
+            name, q.Name, dns.TypeToString[q.Qtype], client)
+        return w, true
+    }
+
+    if rule.rcode >= 0 {
+        log.Printf("DNS fault %s: answering %s %s from %s with %s",
+            name, q.Name, dns.TypeToString[q.Qtype], client, dns.RcodeToString[rule.rcode])
+        m := new(dns.Msg)
+        m.SetRcode(r, rule.rcode)
+        w.WriteMsg(m)
+        return w, true
+    }
+
+    if rule.cfg.Malformed {
+        log.Printf("DNS fault %s: sending malformed reply for %s %s to %s",
+            name, q.Name, dns.TypeToString[q.Qtype], client)
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeServerFailure)
+        buf, err := m.Pack()
+        if err != nil {
+            return w, true
+        }
+        // claim answers that are not there so parsers choke
+        buf[6], buf[7] = 0xff, 0xff
+        w.Write(buf)
+        return w, true
+    }
+
+    if rule.cfg.Truncate || rule.cfg.IDMismatch {
+        return &faultWriter{ResponseWriter: w, rule: rule, client: client}, false
+    }
+    return w, false
+}
+
+// faultsStage runs fault rules ahead of the stages producing real answers
+func faultsStage(p *DNSProxy) (Middleware, error) {
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            req := RequestFromContext(ctx)
+            if rule := p.faults.match(req.Client, req.Question); rule != nil {
+                var handled bool
+                if w, handled = rule.inject(w, r, req.Client); handled {
+                    req.Outcome = OutcomeFault
+                    return
+                }
+            }
+            next.ServeDNS(ctx, w, r)
+        })
+    }, nil
+}
+
+// faultWriter mangles the real answer on its way to the client
+type faultWriter struct {
+    dns.ResponseWriter
+    rule   *faultRule
+    client net.IP
+}
+
+func (fw *faultWriter) WriteMsg(m *dns.Msg) error {
+    name := fw.rule.cfg.Name
+    if fw.rule.cfg.Truncate {
+        log.Printf("DNS fault %s: truncating answer for %s to %s", name, questionName(m), fw.client)
+        m.Truncated = true
+        m.Answer, m.Ns = nil, nil
+        opt := m.IsEdns0()
+        m.Extra = nil
+        if opt != nil {
+            m.Extra = []dns.RR{opt}
+        }
+    }
+    if fw.rule.cfg.IDMismatch {
+        log.Printf("DNS fault %s: mismatching ID for %s to %s", name, questionName(m), fw.client)
+        m.Id ^= uint16(1 + rand.Intn(0xfffe))
+    }
+    return fw.ResponseWriter.WriteMsg(m)
+}
+
+func questionName(m *dns.Msg) string {
+    if len(m.Question) == 0 {
+        return ""
+    }
+    return m.Question[0].Name
+}
+
+// SetFaultsEnabled toggles fault injection as a whole.
+func (p *DNSProxy) SetFaultsEnabled(enabled bool) {
+    p.faults.enabled.Store(enabled)
+    log.Printf("DNS fault injection set to %v", enabled)
+}
+
+// FaultsEnabled reports whether fault injection is active.
+func (p *DNSProxy) FaultsEnabled() bool {
+    return p.faults.enabled.Load()
+}
+
+// SetFaultRuleEnabled toggles a single fault rule by name.
+func (p *DNSProxy) SetFaultRuleEnabled(name string, enabled bool) error {
+    for _, rule := range p.faults.rules {
+        if rule.cfg.Name == name {
+            rule.enabled.Store(enabled)
+            log.Printf("DNS fault rule %s set to %v", name, enabled)
+            return nil
+        }
+    }
+    return fmt.Errorf("unknown fault rule %q", name)
+}
+
+// FaultRules returns the configured fault rule names and their state.
+func (p *DNSProxy) FaultRules() map[string]bool {
+    rules := make(map[string]bool, len(p.faults.rules))
+    for _, rule := range p.faults.rules {
+        rules[rule.cfg.Name] = rule.enabled.Load()
+    }
+    return rules
+}
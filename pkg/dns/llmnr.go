@@ -0,0 +1,79 @@
+package dns
+
+import (
+    "net"
+
+    "github.com/miekg/dns"
+)
+
+const llmnrPort = 5355
+
+var (
+    llmnrGroup4 = net.IPv4(224, 0, 0, 252)
+    llmnrGroup6 = net.ParseIP("ff02::1:3")
+)
+
+func (r *responders) startLLMNR() error {
+    conn4, err := r.listen("udp4", llmnrPort, llmnrGroup4)
+    if err != nil {
+        return err
+    }
+    r.serve("LLMNR", conn4, func(buf []byte, from *net.UDPAddr) {
+        r.handleLLMNR(conn4, buf, from)
+    })
+
+    if r.lan6 != nil {
+        conn6, err := r.listen("udp6", llmnrPort, llmnrGroup6)
+        if err != nil {
+            return err
+        }
+        r.serve("LLMNR", conn6, func(buf []byte, from *net.UDPAddr) {
+            r.handleLLMNR(conn6, buf, from)
+        })
+    }
+    return nil
+}
+
+// handleLLMNR answers an RFC 4795 query with a unicast reply
+func (r *responders) handleLLMNR(conn net.PacketConn, buf []byte, from *net.UDPAddr) {
+    req := new(dns.Msg)
+    if err := req.Unpack(buf); err != nil {
+        return
+    }
+    if req.Response || req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+        return
+    }
+
+    q := req.Question[0]
+    v4, v6, poisoned := r.resolve(from.IP, q.Name)
+    answers := r.answerRRs(q, dns.ClassINET, v4, v6)
+    logResponder("LLMNR", from.IP, q.Name, dns.TypeToString[q.Qtype], rrIPs(answers), poisoned)
+    if len(answers) == 0 {
+        // LLMNR responders stay silent for names they are not authoritative for
+        return
+    }
+
+    resp := new(dns.Msg)
+    resp.SetReply(req)
+    resp.RecursionDesired = false
+    resp.Answer = answers
+    out, err := resp.Pack()
+    if err != nil {
+        return
+    }
+    conn.WriteTo(out, from)
+}
+
+// rrIPs extracts the addresses from A/AAAA records for logging
+func rrIPs(rrs []dns.RR) []net.IP {
+    var ips []net.IP
+    for _, rr := range rrs {
+        switch v := rr.(type) {
+        case *dns.A:
+            ips = append(ips, v.A)
+        case *dns.AAAA:
+            ips = append(ips, v.AAAA)
+        }
+    }
+    return ips
+}
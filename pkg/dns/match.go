@@ -0,0 +1,37 @@
+package dns
+
+import (
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// matchDomain reports whether name falls under pattern.
+//
+// A plain pattern ("example.com") matches the name itself and everything
+// below it, "*.example.com" matches only names below it and "*" or "."
+// match everything.
+func matchDomain(pattern, name string) bool {
+    pattern = strings.ToLower(pattern)
+    name = dns.Fqdn(strings.ToLower(name))
+
+    switch pattern {
+    case "", "*", ".":
+        return true
+    }
+
+    if strings.HasPrefix(pattern, "*.") {
+        parent := dns.Fqdn(pattern[2:])
+        return name != parent && dns.IsSubDomain(parent, name)
+    }
+    return dns.IsSubDomain(dns.Fqdn(pattern), name)
+}
+
+// matchSpecificity ranks a pattern so the most specific rule can win.
+func matchSpecificity(pattern string) int {
+    switch pattern {
+    case "", "*", ".":
+        return 0
+    }
+    return dns.CountLabel(dns.Fqdn(strings.TrimPrefix(pattern, "*.")))*2 + 1
+}
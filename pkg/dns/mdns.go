@@ -0,0 +1,94 @@
+package dns
+
+import (
+    "net"
+
+    "github.com/miekg/dns"
+)
+
+const (
+    mdnsPort = 5353
+    // cacheFlush is the top bit of the class in mDNS answers (RFC 6762 10.2)
+    cacheFlush = 1 << 15
+    // unicastResponse is the QU bit carried in the question class
+    unicastResponse = 1 << 15
+)
+
+var (
+    mdnsGroup4 = net.IPv4(224, 0, 0, 251)
+    mdnsGroup6 = net.ParseIP("ff02::fb")
+)
+
+func (r *responders) startMDNS() error {
+    conn4, err := r.listen("udp4", mdnsPort, mdnsGroup4)
+    if err != nil {
+        return err
+    }
+    r.serve("mDNS", conn4, func(buf []byte, from *net.UDPAddr) {
+        r.handleMDNS(conn4, mdnsGroup4, buf, from)
+    })
+
+    if r.lan6 != nil {
+        conn6, err := r.listen("udp6", mdnsPort, mdnsGroup6)
+        if err != nil {
+            return err
+        }
+        r.serve("mDNS", conn6, func(buf []byte, from *net.UDPAddr) {
+            r.handleMDNS(conn6, mdnsGroup6, buf, from)
+        })
+    }
+    return nil
+}
+
+// handleMDNS answers an RFC 6762 query. Queries from port 5353 get a
+// multicast response unless they set the QU bit; legacy resolvers using
+// other ports get a conventional unicast reply.
+func (r *responders) handleMDNS(conn net.PacketConn, group net.IP, buf []byte, from *net.UDPAddr) {
+    req := new(dns.Msg)
+    if err := req.Unpack(buf); err != nil {
+        return
+    }
+    if req.Response || req.Opcode != dns.OpcodeQuery {
+        return
+    }
+
+    legacy := from.Port != mdnsPort
+    unicast := legacy
+    var answers []dns.RR
+    for _, q := range req.Question {
+        if q.Qclass&unicastResponse != 0 {
+            unicast = true
+        }
+        q.Qclass &^= unicastResponse
+        v4, v6, poisoned := r.resolve(from.IP, q.Name)
+        class := uint16(dns.ClassINET)
+        if !legacy {
+            class |= cacheFlush
+        }
+        rrs := r.answerRRs(q, class, v4, v6)
+        logResponder("mDNS", from.IP, q.Name, dns.TypeToString[q.Qtype], rrIPs(rrs), poisoned)
+        answers = append(answers, rrs...)
+    }
+    if len(answers) == 0 {
+        return
+    }
+
+    resp := new(dns.Msg)
+    resp.Response = true
+    resp.Authoritative = true
+    resp.Answer = answers
+    if legacy {
+        resp.Id = req.Id
+        resp.Question = req.Question
+    }
+    out, err := resp.Pack()
+    if err != nil {
+        return
+    }
+
+    to := from
+    if !unicast {
+        to = &net.UDPAddr{IP: group, Port: mdnsPort}
+    }
+    conn.WriteTo(out, to)
+}
@@ -0,0 +1,99 @@
+package dns
+
+import (
+    "encoding/binary"
+    "net"
+    "strings"
+)
+
+const (
+    nbnsPort   = 137
+    nbnsTypeNB = 0x0020
+    // NetBIOS suffixes we answer for: workstation and file server
+    nbnsWorkstation = 0x00
+    nbnsFileServer  = 0x20
+)
+
+func (r *responders) startNBNS() error {
+    conn, err := r.listen("udp4", nbnsPort, nil)
+    if err != nil {
+        return err
+    }
+    r.serve("NBT-NS", conn, func(buf []byte, from *net.UDPAddr) {
+        r.handleNBNS(conn, buf, from)
+    })
+    return nil
+}
+
+// handleNBNS answers an RFC 1002 name query with a positive response
+func (r *responders) handleNBNS(conn net.PacketConn, buf []byte, from *net.UDPAddr) {
+    // header plus a 34 byte encoded name and type/class
+    if len(buf) < 12+34+4 {
+        return
+    }
+    flags := binary.BigEndian.Uint16(buf[2:4])
+    opcode := (flags >> 11) & 0xf
+    if flags&0x8000 != 0 || opcode != 0 || binary.BigEndian.Uint16(buf[4:6]) != 1 {
+        return
+    }
+
+    name, suffix, end, ok := decodeNetBIOSName(buf, 12)
+    if !ok || end+4 > len(buf) {
+        return
+    }
+    if binary.BigEndian.Uint16(buf[end:end+2]) != nbnsTypeNB {
+        return
+    }
+    if suffix != nbnsWorkstation && suffix != nbnsFileServer {
+        return
+    }
+
+    v4, _, poisoned := r.resolve(from.IP, name)
+    logResponder("NBT-NS", from.IP, name, "NB", v4, poisoned)
+    if len(v4) == 0 {
+        return
+    }
+
+    encoded := buf[12:end]
+    resp := make([]byte, 0, 12+len(encoded)+16)
+    resp = append(resp, buf[0:2]...)            // transaction id
+    resp = append(resp, 0x85, 0x00)             // response, authoritative, recursion desired
+    resp = append(resp, 0, 0, 0, 1, 0, 0, 0, 0) // qd=0 an=1 ns=0 ar=0
+    resp = append(resp, encoded...)
+    resp = binary.BigEndian.AppendUint16(resp, nbnsTypeNB)
+    resp = binary.BigEndian.AppendUint16(resp, 1) // class IN
+    resp = binary.BigEndian.AppendUint32(resp, r.ttl)
+    resp = binary.BigEndian.AppendUint16(resp, 6) // rdlength
+    resp = append(resp, 0, 0)                     // NB flags: B-node, unique
+    resp = append(resp, v4[0].To4()...)
+    conn.WriteTo(resp, from)
+}
+
+// decodeNetBIOSName decodes the first-level encoded name at off, returning
+// the trimmed name, its suffix byte and the offset after the name.
+func decodeNetBIOSName(buf []byte, off int) (string, byte, int, bool) {
+    if buf[off] != 32 || off+34 > len(buf) {
+        return "", 0, 0, false
+    }
+    raw := make([]byte, 16)
+    for i := 0; i < 16; i++ {
+        hi, lo := buf[off+1+2*i]-'A', buf[off+2+2*i]-'A'
+        if hi > 15 || lo > 15 {
+            return "", 0, 0, false
+        }
+        raw[i] = hi<<4 | lo
+    }
+
+    // skip any scope labels up to the terminating zero
+    end := off + 33
+    for end < len(buf) && buf[end] != 0 {
+        end += int(buf[end]) + 1
+    }
+    if end >= len(buf) {
+        return "", 0, 0, false
+    }
+    end++
+
+    name := strings.TrimRight(string(raw[:15]), " ")
+    return strings.ToLower(name), raw[15], end, true
+}
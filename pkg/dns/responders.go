@@ -0,0 +1,283 @@
+package dns
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "strings"
+    "sync"
+    "syscall"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+    "golang.org/x/sys/unix"
+)
+
+// responders answers LLMNR, NBT-NS and mDNS lookups on the LAN from the
+// local record store, optionally poisoning names for target clients.
+type responders struct {
+    proxy  *DNSProxy
+    iface  *net.Interface
+    ttl    uint32
+    lan4   net.IP
+    lan6   net.IP
+    poison []*poisonRule
+    mu     sync.Mutex
+    conns  []net.PacketConn
+}
+
+type poisonRule struct {
+    names   []string
+    clients []*net.IPNet
+    ipv4    net.IP
+    ipv6    net.IP
+}
+
+func newResponders(p *DNSProxy) (*responders, error) {
+    rc := p.cfg.DNS.Responders
+    r := &responders{
+        proxy: p,
+        ttl:   rc.TTL,
+        lan4:  config.HostIP(p.cfg.Interfaces.LAN.IPv4),
+        lan6:  config.HostIP(p.cfg.Interfaces.LAN.IPv6),
+    }
+
+    for i, pc := range rc.Poison {
+        // a rule for everyone would answer every lookup on the LAN
+        if len(pc.Clients) == 0 {
+            return nil, fmt.Errorf("poison rule %d: no clients", i)
+        }
+        rule := &poisonRule{names: pc.Names, ipv4: r.lan4, ipv6: r.lan6}
+        for _, c := range pc.Clients {
+            n, err := parseClientNet(c)
+            if err != nil {
+                return nil, fmt.Errorf("poison rule %d: %w", i, err)
+            }
+            rule.clients = append(rule.clients, n)
+        }
+        if pc.IPv4 != "" {
+            if rule.ipv4 = net.ParseIP(pc.IPv4).To4(); rule.ipv4 == nil {
+                return nil, fmt.Errorf("poison rule %d: invalid ipv4 %q", i, pc.IPv4)
+            }
+        }
+        if pc.IPv6 != "" {
+            if rule.ipv6 = net.ParseIP(pc.IPv6); rule.ipv6 == nil {
+                return nil, fmt.Errorf("poison rule %d: invalid ipv6 %q", i, pc.IPv6)
+            }
+        }
+        r.poison = append(r.poison, rule)
+    }
+    return r, nil
+}
+
+func (r *responders) enabled() bool {
+    rc := r.proxy.cfg.DNS.Responders
+    return rc.LLMNR || rc.NBNS || rc.MDNS
+}
+
+func (r *responders) start() error {
+    iface, err := net.InterfaceByName(r.proxy.cfg.Interfaces.LAN.Iface)
+    if err != nil {
+        return fmt.Errorf("failed to get LAN interface: %w", err)
+    }
+    r.iface = iface
+
+    rc := r.proxy.cfg.DNS.Responders
+    if rc.LLMNR {
+        if err := r.startLLMNR(); err != nil {
+            r.stop()
+            return fmt.Errorf("LLMNR responder: %w", err)
+        }
+    }
+    if rc.MDNS {
+        if err := r.startMDNS(); err != nil {
+            r.stop()
+            return fmt.Errorf("mDNS responder: %w", err)
+        }
+    }
+    if rc.NBNS {
+        if err := r.startNBNS(); err != nil {
+            r.stop()
+            return fmt.Errorf("NBT-NS responder: %w", err)
+        }
+    }
+    return nil
+}
+
+func (r *responders) stop() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, c := range r.conns {
+        c.Close()
+    }
+    r.conns = nil
+}
+
+// listen opens a UDP socket bound to the LAN interface on port, joined to
+// group when one is given.
+func (r *responders) listen(network string, port int, group net.IP) (net.PacketConn, error) {
+    lc := net.ListenConfig{
+        Control: func(_, _ string, c syscall.RawConn) error {
+            var serr error
+            err := c.Control(func(fd uintptr) {
+                if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+                    return
+                }
+                if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); serr != nil {
+                    return
+                }
+                if network == "udp4" {
+                    if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1); serr != nil {
+                        return
+                    }
+                }
+                serr = unix.BindToDevice(int(fd), r.iface.Name)
+            })
+            if err != nil {
+                return err
+            }
+            return serr
+        },
+    }
+
+    addr := fmt.Sprintf("0.0.0.0:%d", port)
+    if network == "udp6" {
+        addr = fmt.Sprintf("[::]:%d", port)
+    }
+    conn, err := lc.ListenPacket(context.Background(), network, addr)
+    if err != nil {
+        return nil, err
+    }
+
+    if group != nil {
+        if network == "udp6" {
+            pc := ipv6.NewPacketConn(conn)
+            err = pc.JoinGroup(r.iface, &net.UDPAddr{IP: group})
+            if err == nil {
+                err = pc.SetMulticastInterface(r.iface)
+            }
+        } else {
+            pc := ipv4.NewPacketConn(conn)
+            err = pc.JoinGroup(r.iface, &net.UDPAddr{IP: group})
+            if err == nil {
+                err = pc.SetMulticastInterface(r.iface)
+            }
+            if err == nil {
+                err = pc.SetMulticastTTL(255)
+            }
+        }
+        if err != nil {
+            conn.Close()
+            return nil, fmt.Errorf("joining %s: %w", group, err)
+        }
+    }
+
+    r.mu.Lock()
+    r.conns = append(r.conns, conn)
+    r.mu.Unlock()
+    return conn, nil
+}
+
+// serve reads packets from conn until it is closed
+func (r *responders) serve(name string, conn net.PacketConn, handle func(buf []byte, from *net.UDPAddr)) {
+    p := r.proxy
+    p.wg.Add(1)
+    go func() {
+        defer p.wg.Done()
+        buf := make([]byte, 9000)
+        for {
+            n, addr, err := conn.ReadFrom(buf)
+            if err != nil {
+                if errors.Is(err, net.ErrClosed) {
+                    return
+                }
+                select {
+                case p.errChan <- fmt.Errorf("%s responder error: %w", name, err):
+                default:
+                }
+                return
+            }
+            from, ok := addr.(*net.UDPAddr)
+            if !ok {
+                continue
+            }
+            pkt := make([]byte, n)
+            copy(pkt, buf[:n])
+            handle(pkt, from)
+        }
+    }()
+}
+
+// resolve finds the addresses to answer name with for client, checking
+// the local store before the poisoning rules.
+func (r *responders) resolve(client net.IP, name string) (v4, v6 []net.IP, poisoned bool) {
+    if record := r.proxy.lookupLocal(name); record != nil {
+        for _, ip := range record.ips {
+            if ip4 := ip.To4(); ip4 != nil {
+                v4 = append(v4, ip4)
+            } else {
+                v6 = append(v6, ip)
+            }
+        }
+        return v4, v6, false
+    }
+
+    for _, rule := range r.poison {
+        if !containsIP(rule.clients, client) {
+            continue
+        }
+        if len(rule.names) > 0 && !matchAny(rule.names, name) {
+            continue
+        }
+        if rule.ipv4 != nil {
+            v4 = append(v4, rule.ipv4)
+        }
+        if rule.ipv6 != nil {
+            v6 = append(v6, rule.ipv6)
+        }
+        return v4, v6, true
+    }
+    return nil, nil, false
+}
+
+// answerRRs builds the A/AAAA records for a DNS-format question
+func (r *responders) answerRRs(q dns.Question, class uint16, v4, v6 []net.IP) []dns.RR {
+    var rrs []dns.RR
+    if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+        for _, ip := range v4 {
+            rrs = append(rrs, &dns.A{
+                Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: class, Ttl: r.ttl},
+                A:   ip,
+            })
+        }
+    }
+    if q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
+        for _, ip := range v6 {
+            rrs = append(rrs, &dns.AAAA{
+                Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: class, Ttl: r.ttl},
+                AAAA: ip,
+            })
+        }
+    }
+    return rrs
+}
+
+func logResponder(proto string, client net.IP, name string, qtype string, answers []net.IP, poisoned bool) {
+    if len(answers) == 0 {
+        log.Printf("%s query from %s: %s %s (no answer)", proto, client, name, qtype)
+        return
+    }
+    ips := make([]string, len(answers))
+    for i, ip := range answers {
+        ips[i] = ip.String()
+    }
+    tag := "local"
+    if poisoned {
+        tag = "poisoned"
+    }
+    log.Printf("%s query from %s: %s %s -> %s (%s)", proto, client, name, qtype, strings.Join(ips, ","), tag)
+}
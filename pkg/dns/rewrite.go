@@ -0,0 +1,95 @@
+package dns
+
+import (
+    "context"
+    "fmt"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// rewriteRule maps a query name onto the name actually resolved. A
+// "*.from" rule keeps the leading labels and swaps the suffix.
+type rewriteRule struct {
+    from   string
+    to     string
+    suffix bool
+}
+
+func (rule rewriteRule) target(name string) (string, bool) {
+    name = strings.ToLower(name)
+    if !rule.suffix {
+        return rule.to, name == rule.from
+    }
+    if name == rule.from || !dns.IsSubDomain(rule.from, name) {
+        return "", false
+    }
+    return strings.TrimSuffix(name, rule.from) + rule.to, true
+}
+
+// rewriteStage resolves configured names as other names, renaming the
+// answer back before it reaches the client
+func rewriteStage(p *DNSProxy) (Middleware, error) {
+    var rules []rewriteRule
+    for _, rc := range p.cfg.DNS.Rewrites {
+        if rc.From == "" || rc.To == "" {
+            return nil, fmt.Errorf("rewrite needs both from and to")
+        }
+        rule := rewriteRule{to: strings.ToLower(dns.Fqdn(rc.To))}
+        from := strings.ToLower(rc.From)
+        if strings.HasPrefix(from, "*.") {
+            rule.suffix = true
+            from = from[2:]
+        }
+        rule.from = dns.Fqdn(from)
+        rules = append(rules, rule)
+    }
+    if len(rules) == 0 {
+        return nil, nil
+    }
+
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            orig := r.Question[0]
+            for _, rule := range rules {
+                target, ok := rule.target(orig.Name)
+                if !ok {
+                    continue
+                }
+                rr := r.Copy()
+                rr.Question[0].Name = target
+                next.ServeDNS(ctx, &rewriteWriter{ResponseWriter: w, ctx: ctx, orig: orig, target: target}, rr)
+                return
+            }
+            next.ServeDNS(ctx, w, r)
+        })
+    }, nil
+}
+
+// rewriteWriter restores the name the client asked for. The renamed
+// records' signatures cover the target, so DNSSEC leaves them alone.
+type rewriteWriter struct {
+    dns.ResponseWriter
+    ctx    context.Context
+    orig   dns.Question
+    target string
+}
+
+func (rw *rewriteWriter) WriteMsg(m *dns.Msg) error {
+    // only real answers; failures and policy answers keep their outcome
+    if req := RequestFromContext(rw.ctx); req != nil {
+        switch req.Outcome {
+        case OutcomeForwarded, OutcomeCached, OutcomeLocal:
+            req.Outcome = OutcomeRewritten
+        }
+    }
+    if len(m.Question) > 0 {
+        m.Question[0] = rw.orig
+    }
+    for _, rr := range m.Answer {
+        if strings.EqualFold(rr.Header().Name, rw.target) {
+            rr.Header().Name = rw.orig.Name
+        }
+    }
+    return rw.ResponseWriter.WriteMsg(m)
+}
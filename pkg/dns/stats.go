@@ -0,0 +1,379 @@
+package dns
+
+import (
+    "context"
+    "net"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// Outcome classifies how a query was answered
+type Outcome string
+
+const (
+    OutcomeLocal     Outcome = "local"
+    OutcomeForwarded Outcome = "forwarded"
+    OutcomeReplayed  Outcome = "replayed"
+    OutcomeCached    Outcome = "cached"
+    OutcomeBlocked   Outcome = "blocked"
+    // OutcomeRewritten is an answer renamed from a rewrite rule's target
+    OutcomeRewritten Outcome = "rewritten"
+    OutcomeFault     Outcome = "fault"
+    OutcomeFailed    Outcome = "failed"
+)
+
+// latencyBounds are the upper edges of the upstream latency histogram;
+// anything slower lands in a final overflow bucket.
+var latencyBounds = []time.Duration{
+    5 * time.Millisecond,
+    10 * time.Millisecond,
+    25 * time.Millisecond,
+    50 * time.Millisecond,
+    100 * time.Millisecond,
+    250 * time.Millisecond,
+    500 * time.Millisecond,
+    time.Second,
+    2500 * time.Millisecond,
+}
+
+// DomainCount is a name and how often it was asked for
+type DomainCount struct {
+    Domain string
+    Count  uint64
+}
+
+// ClientCount is a client and how many queries it sent
+type ClientCount struct {
+    Client string
+    Count  uint64
+}
+
+// LatencyHistogram holds upstream response times. Counts has one entry per
+// bound plus a trailing overflow bucket.
+type LatencyHistogram struct {
+    Bounds   []time.Duration
+    Counts   []uint64
+    Total    uint64
+    Failures uint64
+    Sum      time.Duration
+}
+
+// Mean returns the average response time of successful exchanges
+func (h LatencyHistogram) Mean() time.Duration {
+    if h.Total == 0 {
+        return 0
+    }
+    return h.Sum / time.Duration(h.Total)
+}
+
+// StatsSummary aggregates all queries seen within a window
+type StatsSummary struct {
+    Window        time.Duration
+    Queries       uint64
+    NXDomain      uint64
+    Blocked       uint64
+    NXDomainRatio float64
+    Outcomes      map[Outcome]uint64
+    Upstreams     map[string]LatencyHistogram
+}
+
+type clientBucket struct {
+    queries  uint64
+    nxdomain uint64
+    domains  map[string]uint64
+}
+
+type statsBucket struct {
+    start    time.Time
+    queries  uint64
+    nxdomain uint64
+    blocked  uint64
+    outcomes map[Outcome]uint64
+    domains  map[string]uint64
+    clients  map[string]*clientBucket
+    latency  map[string]*LatencyHistogram
+}
+
+func (b *statsBucket) reset(start time.Time) {
+    *b = statsBucket{
+        start:    start,
+        outcomes: make(map[Outcome]uint64),
+        domains:  make(map[string]uint64),
+        clients:  make(map[string]*clientBucket),
+        latency:  make(map[string]*LatencyHistogram),
+    }
+}
+
+// queryStats keeps rolling, time-bucketed aggregates of DNS traffic
+type queryStats struct {
+    enabled bool
+    bucket  time.Duration
+    mu      sync.Mutex
+    buckets []statsBucket
+}
+
+func newQueryStats(cfg *config.Config) *queryStats {
+    sc := cfg.DNS.Stats
+    s := &queryStats{enabled: sc.Enabled, bucket: sc.Bucket}
+    if !s.enabled {
+        return s
+    }
+    if s.bucket <= 0 {
+        s.bucket = time.Minute
+    }
+    n := int(sc.Retention / s.bucket)
+    if n < 1 {
+        n = 1
+    }
+    s.buckets = make([]statsBucket, n)
+    return s
+}
+
+// current returns the bucket for now, recycling it if it is stale.
+// Callers must hold s.mu.
+func (s *queryStats) current(now time.Time) *statsBucket {
+    start := now.Truncate(s.bucket)
+    b := &s.buckets[int(start.UnixNano()/int64(s.bucket))%len(s.buckets)]
+    if !b.start.Equal(start) {
+        b.reset(start)
+    }
+    return b
+}
+
+// record accounts for one answered (or unanswered) query
+func (s *queryStats) record(client net.IP, qname string, outcome Outcome, rcode int) {
+    if !s.enabled {
+        return
+    }
+    qname = strings.ToLower(qname)
+    key := client.String()
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b := s.current(time.Now())
+    b.queries++
+    b.outcomes[outcome]++
+    b.domains[qname]++
+    if outcome == OutcomeBlocked {
+        b.blocked++
+    }
+
+    c, ok := b.clients[key]
+    if !ok {
+        c = &clientBucket{domains: make(map[string]uint64)}
+        b.clients[key] = c
+    }
+    c.queries++
+    c.domains[qname]++
+
+    if rcode == dns.RcodeNameError {
+        b.nxdomain++
+        c.nxdomain++
+    }
+}
+
+// observeUpstream records the outcome of one exchange with an upstream
+func (s *queryStats) observeUpstream(upstream string, rtt time.Duration, err error) {
+    if !s.enabled {
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    b := s.current(time.Now())
+    h, ok := b.latency[upstream]
+    if !ok {
+        h = &LatencyHistogram{Bounds: latencyBounds, Counts: make([]uint64, len(latencyBounds)+1)}
+        b.latency[upstream] = h
+    }
+    if err != nil {
+        h.Failures++
+        return
+    }
+    i := sort.Search(len(latencyBounds), func(i int) bool { return rtt <= latencyBounds[i] })
+    h.Counts[i]++
+    h.Total++
+    h.Sum += rtt
+}
+
+// each calls fn for every live bucket inside window. Callers must hold s.mu.
+func (s *queryStats) each(window time.Duration, fn func(b *statsBucket)) {
+    cutoff := time.Now().Add(-window).Truncate(s.bucket)
+    for i := range s.buckets {
+        b := &s.buckets[i]
+        if b.start.IsZero() || b.start.Before(cutoff) {
+            continue
+        }
+        fn(b)
+    }
+}
+
+func (s *queryStats) summary(window time.Duration) StatsSummary {
+    sum := StatsSummary{
+        Window:    window,
+        Outcomes:  make(map[Outcome]uint64),
+        Upstreams: make(map[string]LatencyHistogram),
+    }
+    if !s.enabled {
+        return sum
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.each(window, func(b *statsBucket) {
+        sum.Queries += b.queries
+        sum.NXDomain += b.nxdomain
+        sum.Blocked += b.blocked
+        for o, n := range b.outcomes {
+            sum.Outcomes[o] += n
+        }
+        for up, h := range b.latency {
+            agg, ok := sum.Upstreams[up]
+            if !ok {
+                agg = LatencyHistogram{Bounds: latencyBounds, Counts: make([]uint64, len(latencyBounds)+1)}
+            }
+            for i, n := range h.Counts {
+                agg.Counts[i] += n
+            }
+            agg.Total += h.Total
+            agg.Failures += h.Failures
+            agg.Sum += h.Sum
+            sum.Upstreams[up] = agg
+        }
+    })
+    if sum.Queries > 0 {
+        sum.NXDomainRatio = float64(sum.NXDomain) / float64(sum.Queries)
+    }
+    return sum
+}
+
+func (s *queryStats) topDomains(window time.Duration, n int, client string) []DomainCount {
+    if !s.enabled {
+        return nil
+    }
+    counts := make(map[string]uint64)
+
+    s.mu.Lock()
+    s.each(window, func(b *statsBucket) {
+        domains := b.domains
+        if client != "" {
+            c, ok := b.clients[client]
+            if !ok {
+                return
+            }
+            domains = c.domains
+        }
+        for d, cnt := range domains {
+            counts[d] += cnt
+        }
+    })
+    s.mu.Unlock()
+
+    out := make([]DomainCount, 0, len(counts))
+    for d, cnt := range counts {
+        out = append(out, DomainCount{Domain: d, Count: cnt})
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Count != out[j].Count {
+            return out[i].Count > out[j].Count
+        }
+        return out[i].Domain < out[j].Domain
+    })
+    if n > 0 && len(out) > n {
+        out = out[:n]
+    }
+    return out
+}
+
+func (s *queryStats) topClients(window time.Duration, n int) []ClientCount {
+    if !s.enabled {
+        return nil
+    }
+    counts := make(map[string]uint64)
+
+    s.mu.Lock()
+    s.each(window, func(b *statsBucket) {
+        for c, cb := range b.clients {
+            counts[c] += cb.queries
+        }
+    })
+    s.mu.Unlock()
+
+    out := make([]ClientCount, 0, len(counts))
+    for c, cnt := range counts {
+        out = append(out, ClientCount{Client: c, Count: cnt})
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Count != out[j].Count {
+            return out[i].Count > out[j].Count
+        }
+        return out[i].Client < out[j].Client
+    })
+    if n > 0 && len(out) > n {
+        out = out[:n]
+    }
+    return out
+}
+
+// statsWriter captures the rcode of the answer sent to the client
+type statsWriter struct {
+    dns.ResponseWriter
+    rcode   int
+    written bool
+}
+
+func (sw *statsWriter) WriteMsg(m *dns.Msg) error {
+    sw.rcode = m.Rcode
+    sw.written = true
+    return sw.ResponseWriter.WriteMsg(m)
+}
+
+func (sw *statsWriter) Write(b []byte) (int, error) {
+    sw.rcode = dns.RcodeFormatError
+    sw.written = true
+    return sw.ResponseWriter.Write(b)
+}
+
+// statsStage accounts for every query once the rest of the chain is done
+func statsStage(p *DNSProxy) (Middleware, error) {
+    if !p.stats.enabled {
+        return nil, nil
+    }
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            sw := &statsWriter{ResponseWriter: w}
+            next.ServeDNS(ctx, sw, r)
+            req := RequestFromContext(ctx)
+            p.stats.record(req.Client, req.Question.Name, req.Outcome, sw.rcode)
+        })
+    }, nil
+}
+
+// Stats summarises the queries seen within window
+func (p *DNSProxy) Stats(window time.Duration) StatsSummary {
+    return p.stats.summary(window)
+}
+
+// TopDomains returns the n most queried names within window, all of them
+// when n is zero
+func (p *DNSProxy) TopDomains(window time.Duration, n int) []DomainCount {
+    return p.stats.topDomains(window, n, "")
+}
+
+// TopClients returns the n busiest clients within window
+func (p *DNSProxy) TopClients(window time.Duration, n int) []ClientCount {
+    return p.stats.topClients(window, n)
+}
+
+// ClientDomains returns what client resolved within window, busiest first
+func (p *DNSProxy) ClientDomains(client net.IP, window time.Duration) []DomainCount {
+    return p.stats.topDomains(window, 0, client.String())
+}
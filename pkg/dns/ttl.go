@@ -0,0 +1,119 @@
+package dns
+
+import (
+    "context"
+    "sync/atomic"
+
+    "github.com/miekg/dns"
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// ttlPolicy clamps and overrides the TTLs handed to clients so hijack
+// changes propagate as fast as we want them to.
+type ttlPolicy struct {
+    local   uint32
+    min     uint32
+    max     uint32
+    lowTTL  uint32
+    lowMode atomic.Bool
+    rules   []config.TTLRule
+}
+
+func newTTLPolicy(cfg *config.Config) *ttlPolicy {
+    t := &ttlPolicy{
+        local:  cfg.DNS.TTL.Local,
+        min:    cfg.DNS.TTL.Min,
+        max:    cfg.DNS.TTL.Max,
+        lowTTL: cfg.DNS.TTL.LowTTL,
+        rules:  cfg.DNS.TTL.Rules,
+    }
+    t.lowMode.Store(cfg.DNS.TTL.LowTTLMode)
+    return t
+}
+
+// localTTL returns the TTL for a spoofed record, preferring the
+// per-domain override when one is set.
+func (t *ttlPolicy) localTTL(override uint32) uint32 {
+    if override != 0 {
+        return override
+    }
+    return t.local
+}
+
+// bounds returns the min/max pair that applies to name. The most specific
+// matching rule wins; zero values fall back to the global bounds.
+func (t *ttlPolicy) bounds(name string) (uint32, uint32) {
+    min, max := t.min, t.max
+    best := -1
+    for _, rule := range t.rules {
+        if !matchDomain(rule.Domain, name) {
+            continue
+        }
+        if rank := matchSpecificity(rule.Domain); rank > best {
+            best = rank
+            min, max = t.min, t.max
+            if rule.Min != 0 {
+                min = rule.Min
+            }
+            if rule.Max != 0 {
+                max = rule.Max
+            }
+        }
+    }
+    return min, max
+}
+
+// apply rewrites every record TTL in m according to the policy.
+func (t *ttlPolicy) apply(m *dns.Msg, qname string) {
+    if m == nil {
+        return
+    }
+
+    low := t.lowMode.Load()
+    min, max := t.bounds(qname)
+
+    for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+        for _, rr := range section {
+            hdr := rr.Header()
+            if hdr.Rrtype == dns.TypeOPT {
+                continue
+            }
+            if low {
+                hdr.Ttl = t.lowTTL
+                continue
+            }
+            hdr.Ttl = clampTTL(hdr.Ttl, min, max)
+        }
+    }
+}
+
+// clampTTL bounds ttl to [min, max], treating a zero bound as unset.
+func clampTTL(ttl, min, max uint32) uint32 {
+    if min != 0 && ttl < min {
+        ttl = min
+    }
+    if max != 0 && ttl > max {
+        ttl = max
+    }
+    return ttl
+}
+
+// ttlStage applies the TTL policy to whatever the later stages answer
+func ttlStage(p *DNSProxy) (Middleware, error) {
+    return func(next Handler) Handler {
+        return HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+            next.ServeDNS(ctx, &ttlWriter{ResponseWriter: w, policy: p.ttl}, r)
+        })
+    }, nil
+}
+
+// ttlWriter rewrites answer TTLs on their way to the client
+type ttlWriter struct {
+    dns.ResponseWriter
+    policy *ttlPolicy
+}
+
+func (tw *ttlWriter) WriteMsg(m *dns.Msg) error {
+    tw.policy.apply(m, questionName(m))
+    return tw.ResponseWriter.WriteMsg(m)
+}
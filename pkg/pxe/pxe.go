@@ -0,0 +1,219 @@
+package pxe
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// Service serves the netboot directory read-only over TFTP and HTTP on the
+// LAN addresses
+type Service struct {
+    cfg     *config.Config
+    ctx     context.Context
+    cancel  context.CancelFunc
+    wg      sync.WaitGroup
+    errChan chan error
+    root    string
+    conns   []*net.UDPConn
+    servers []*http.Server
+    // running TFTP transfers, in total and by client address
+    transfersMu sync.Mutex
+    active      int
+    transfers   map[string]int
+}
+
+func NewPXEService(cfg *config.Config) (*Service, error) {
+    root, err := filepath.Abs(cfg.PXE.Root)
+    if err != nil {
+        return nil, fmt.Errorf("invalid PXE root %q: %w", cfg.PXE.Root, err)
+    }
+    // resolved so files can be checked against it once their own links are
+    if root, err = filepath.EvalSymlinks(root); err != nil {
+        return nil, fmt.Errorf("PXE root: %w", err)
+    }
+    info, err := os.Stat(root)
+    if err != nil {
+        return nil, fmt.Errorf("PXE root: %w", err)
+    }
+    if !info.IsDir() {
+        return nil, fmt.Errorf("PXE root %s is not a directory", root)
+    }
+    for _, port := range []int{cfg.PXE.TFTPPort, cfg.PXE.HTTPPort} {
+        if port < 1 || port > 65535 {
+            return nil, fmt.Errorf("invalid PXE port %d", port)
+        }
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    return &Service{
+        cfg:       cfg,
+        ctx:       ctx,
+        cancel:    cancel,
+        errChan:   make(chan error, 1),
+        root:      root,
+        transfers: make(map[string]int),
+    }, nil
+}
+
+// URL returns where clients fetch file over HTTP from the LAN IPv4
+// address. Full URLs are returned as they are.
+func URL(cfg *config.Config, file string) string {
+    if strings.Contains(file, "://") {
+        return file
+    }
+    host := config.HostIP(cfg.Interfaces.LAN.IPv4).String()
+    if cfg.PXE.HTTPPort != 80 {
+        host = net.JoinHostPort(host, strconv.Itoa(cfg.PXE.HTTPPort))
+    }
+    return fmt.Sprintf("http://%s/%s", host, strings.TrimPrefix(file, "/"))
+}
+
+// TFTPURL6 returns file as a TFTP URL on the LAN IPv6 address, the form
+// DHCPv6 boot file URLs take
+func TFTPURL6(cfg *config.Config, file string) string {
+    host := "[" + config.HostIP(cfg.Interfaces.LAN.IPv6).String() + "]"
+    if cfg.PXE.TFTPPort != 69 {
+        host += ":" + strconv.Itoa(cfg.PXE.TFTPPort)
+    }
+    return fmt.Sprintf("tftp://%s/%s", host, strings.TrimPrefix(file, "/"))
+}
+
+func (s *Service) Start() error {
+    var ips []net.IP
+    if ip := config.HostIP(s.cfg.Interfaces.LAN.IPv4); ip != nil {
+        ips = append(ips, ip)
+    }
+    if ip := config.HostIP(s.cfg.Interfaces.LAN.IPv6); ip != nil {
+        ips = append(ips, ip)
+    }
+    if len(ips) == 0 {
+        return fmt.Errorf("no LAN address to serve PXE on")
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", s.serveHTTP)
+
+    for _, ip := range ips {
+        conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: s.cfg.PXE.TFTPPort})
+        if err != nil {
+            s.Stop()
+            return fmt.Errorf("failed to listen for TFTP on %s: %w", ip, err)
+        }
+        s.conns = append(s.conns, conn)
+        s.wg.Add(1)
+        go func() {
+            defer s.wg.Done()
+            s.serveTFTP(conn)
+        }()
+        log.Printf("TFTP server started on %s", conn.LocalAddr())
+
+        addr := net.JoinHostPort(ip.String(), strconv.Itoa(s.cfg.PXE.HTTPPort))
+        ln, err := net.Listen("tcp", addr)
+        if err != nil {
+            s.Stop()
+            return fmt.Errorf("failed to listen on %s: %w", addr, err)
+        }
+        server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+        s.servers = append(s.servers, server)
+        s.wg.Add(1)
+        go func() {
+            defer s.wg.Done()
+            if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                s.report(fmt.Errorf("HTTP boot server error: %w", err))
+            }
+        }()
+        log.Printf("HTTP boot server started on %s", addr)
+    }
+    log.Printf("Serving %s for netboot", s.root)
+    return nil
+}
+
+func (s *Service) report(err error) {
+    select {
+    case s.errChan <- err:
+    default:
+    }
+}
+
+// resolve maps a requested name onto a regular file under the root.
+// Leading slashes and DOS-style separators, both common in boot file
+// names, are accepted; nothing may escape the root, symlinks included.
+func (s *Service) resolve(name string) (string, error) {
+    name = strings.ReplaceAll(name, "\\", "/")
+    clean := path.Clean("/" + name)
+    if clean == "/" {
+        return "", os.ErrNotExist
+    }
+    full, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(clean)))
+    if err != nil {
+        return "", err
+    }
+    if !strings.HasPrefix(full, s.root+string(filepath.Separator)) {
+        return "", os.ErrNotExist
+    }
+    info, err := os.Stat(full)
+    if err != nil {
+        return "", err
+    }
+    if !info.Mode().IsRegular() {
+        return "", os.ErrNotExist
+    }
+    return full, nil
+}
+
+func (s *Service) serveHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "read-only", http.StatusMethodNotAllowed)
+        return
+    }
+    client, _, _ := net.SplitHostPort(r.RemoteAddr)
+    full, err := s.resolve(r.URL.Path)
+    if err != nil {
+        log.Printf("HTTP boot: %s asked for missing %s", client, r.URL.Path)
+        http.NotFound(w, r)
+        return
+    }
+    f, err := os.Open(full)
+    if err != nil {
+        http.Error(w, "unreadable", http.StatusInternalServerError)
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        http.Error(w, "unreadable", http.StatusInternalServerError)
+        return
+    }
+    log.Printf("HTTP boot: %s fetched %s (%s)", client, r.URL.Path, strings.TrimSpace(r.UserAgent()))
+    http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (s *Service) Stop() {
+    s.cancel()
+    for _, conn := range s.conns {
+        conn.Close()
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for _, server := range s.servers {
+        server.Shutdown(ctx)
+    }
+    s.wg.Wait()
+}
+
+func (s *Service) Errors() <-chan error {
+    return s.errChan
+}
@@ -0,0 +1,357 @@
+package pxe
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// TFTP opcodes, RFC 1350 and RFC 2347
+const (
+    opRRQ   = 1
+    opWRQ   = 2
+    opDATA  = 3
+    opACK   = 4
+    opERROR = 5
+    opOACK  = 6
+)
+
+// TFTP error codes
+const (
+    errUndefined  = 0
+    errNotFound   = 1
+    errAccess     = 2
+    errIllegalOp  = 4
+    errUnknownTID = 5
+)
+
+const (
+    defaultBlockSize = 512
+    // RFC 2348 bounds
+    minBlockSize = 8
+    maxBlockSize = 65464
+    // defaultTimeout is the retransmit interval unless the client asks
+    // for another (RFC 2349)
+    defaultTimeout = 2 * time.Second
+    // maxTimeout caps the interval a client may ask for, so a stalled
+    // transfer gives its port up within maxRetries * maxTimeout
+    maxTimeout     = 10
+    maxRetries     = 5
+    // at most maxTransfers run at once, maxPeerTransfers of them for one
+    // client address
+    maxTransfers     = 64
+    maxPeerTransfers = 4
+)
+
+// tftpRequest is a parsed read or write request
+type tftpRequest struct {
+    op       uint16
+    filename string
+    mode     string
+    // options as sent, names lower-cased
+    options  map[string]string
+}
+
+// parseRequest reads an RRQ or WRQ: opcode, file name, mode and option
+// pairs, each string NUL-terminated
+func parseRequest(b []byte) (*tftpRequest, error) {
+    if len(b) < 2 {
+        return nil, errors.New("short packet")
+    }
+    req := &tftpRequest{op: binary.BigEndian.Uint16(b), options: make(map[string]string)}
+    fields := bytes.Split(b[2:], []byte{0})
+    // a well-formed request ends in NUL, leaving an empty last field
+    if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+        return nil, errors.New("malformed request")
+    }
+    fields = fields[:len(fields)-1]
+    req.filename = string(fields[0])
+    req.mode = strings.ToLower(string(fields[1]))
+    opts := fields[2:]
+    for i := 0; i+1 < len(opts); i += 2 {
+        req.options[strings.ToLower(string(opts[i]))] = string(opts[i+1])
+    }
+    return req, nil
+}
+
+// serveTFTP answers requests on conn until it is closed, running each
+// transfer from its own port as RFC 1350 requires
+func (s *Service) serveTFTP(conn *net.UDPConn) {
+    local := conn.LocalAddr().(*net.UDPAddr).IP
+    buf := make([]byte, 1500)
+    for {
+        n, peer, err := conn.ReadFromUDP(buf)
+        if err != nil {
+            if s.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+                return
+            }
+            s.report(fmt.Errorf("TFTP read: %w", err))
+            return
+        }
+        req, err := parseRequest(buf[:n])
+        if err != nil {
+            log.Printf("TFTP: bad request from %s: %v", peer, err)
+            continue
+        }
+        switch req.op {
+        case opRRQ:
+        case opWRQ:
+            conn.WriteToUDP(errorPacket(errAccess, "read-only server"), peer)
+            continue
+        default:
+            conn.WriteToUDP(errorPacket(errIllegalOp, "expected a read request"), peer)
+            continue
+        }
+
+        if !s.acquire(peer.IP) {
+            log.Printf("TFTP: too many transfers, refusing %s from %s", req.filename, peer)
+            conn.WriteToUDP(errorPacket(errUndefined, "server busy"), peer)
+            continue
+        }
+        s.wg.Add(1)
+        go func() {
+            defer s.wg.Done()
+            defer s.release(peer.IP)
+            s.send(local, peer, req)
+        }()
+    }
+}
+
+// acquire reserves a transfer slot for ip, false when it or the server
+// already has as many running as allowed
+func (s *Service) acquire(ip net.IP) bool {
+    s.transfersMu.Lock()
+    defer s.transfersMu.Unlock()
+    key := ip.String()
+    if s.active >= maxTransfers || s.transfers[key] >= maxPeerTransfers {
+        return false
+    }
+    s.active++
+    s.transfers[key]++
+    return true
+}
+
+func (s *Service) release(ip net.IP) {
+    s.transfersMu.Lock()
+    defer s.transfersMu.Unlock()
+    key := ip.String()
+    s.active--
+    if s.transfers[key]--; s.transfers[key] == 0 {
+        delete(s.transfers, key)
+    }
+}
+
+// transfer is one read request in progress
+type transfer struct {
+    conn      *net.UDPConn
+    peer      *net.UDPAddr
+    blockSize int
+    timeout   time.Duration
+}
+
+// send serves a read request from a fresh port
+func (s *Service) send(local net.IP, peer *net.UDPAddr, req *tftpRequest) {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+    if err != nil {
+        log.Printf("TFTP: no port for %s: %v", peer, err)
+        return
+    }
+    defer conn.Close()
+    t := &transfer{conn: conn, peer: peer, blockSize: defaultBlockSize, timeout: defaultTimeout}
+
+    if req.mode != "octet" && req.mode != "netascii" {
+        t.fail(errIllegalOp, "unsupported mode "+req.mode)
+        return
+    }
+    full, err := s.resolve(req.filename)
+    if err != nil {
+        log.Printf("TFTP: %s asked for missing %s", peer.IP, req.filename)
+        t.fail(errNotFound, "file not found")
+        return
+    }
+    f, err := os.Open(full)
+    if err != nil {
+        t.fail(errAccess, "cannot open file")
+        return
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        t.fail(errUndefined, "cannot read file")
+        return
+    }
+
+    var r io.Reader = bufio.NewReader(f)
+    if req.mode == "netascii" {
+        r = &netascii{r: bufio.NewReader(f)}
+    }
+
+    // RFC 2347: acknowledge the options taken, then wait for ACK 0
+    if oack := t.negotiate(req, info.Size()); oack != nil {
+        if err := t.exchange(oack, 0); err != nil {
+            log.Printf("TFTP: %s %s: %v", peer.IP, req.filename, err)
+            return
+        }
+    }
+
+    sent := 0
+    pkt := make([]byte, 4+t.blockSize)
+    binary.BigEndian.PutUint16(pkt, opDATA)
+    // block numbers wrap past 65535, which large images need
+    for block := uint16(1); ; block++ {
+        if s.ctx.Err() != nil {
+            t.fail(errUndefined, "server shutting down")
+            return
+        }
+        n, err := io.ReadFull(r, pkt[4:])
+        if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            t.fail(errUndefined, "read error")
+            log.Printf("TFTP: reading %s: %v", full, err)
+            return
+        }
+        binary.BigEndian.PutUint16(pkt[2:], block)
+        if err := t.exchange(pkt[:4+n], block); err != nil {
+            log.Printf("TFTP: %s %s: %v", peer.IP, req.filename, err)
+            return
+        }
+        sent += n
+        if n < t.blockSize {
+            break
+        }
+    }
+    log.Printf("TFTP: %s fetched %s (%d bytes, %d-byte blocks)", peer.IP, req.filename, sent, t.blockSize)
+}
+
+// negotiate applies the blksize (RFC 2348), timeout and tsize (RFC 2349)
+// options and returns the OACK, or nil when no option was taken. Unknown
+// options and unusable values are left out, which RFC 2347 permits.
+func (t *transfer) negotiate(req *tftpRequest, size int64) []byte {
+    oack := []byte{0, opOACK}
+    taken := false
+    add := func(name, value string) {
+        oack = append(oack, name...)
+        oack = append(oack, 0)
+        oack = append(oack, value...)
+        oack = append(oack, 0)
+        taken = true
+    }
+    if v, ok := req.options["blksize"]; ok {
+        if n, err := strconv.Atoi(v); err == nil && n >= minBlockSize {
+            t.blockSize = min(n, maxBlockSize)
+            add("blksize", strconv.Itoa(t.blockSize))
+        }
+    }
+    if v, ok := req.options["timeout"]; ok {
+        if n, err := strconv.Atoi(v); err == nil && n >= 1 && n <= maxTimeout {
+            t.timeout = time.Duration(n) * time.Second
+            add("timeout", v)
+        }
+    }
+    // netascii changes the size in flight, so it is not offered then
+    if _, ok := req.options["tsize"]; ok && req.mode == "octet" {
+        add("tsize", strconv.FormatInt(size, 10))
+    }
+    if !taken {
+        return nil
+    }
+    return oack
+}
+
+// exchange sends pkt until the client acknowledges block, ignoring
+// duplicate ACKs of earlier blocks rather than answering each with a
+// retransmission
+func (t *transfer) exchange(pkt []byte, block uint16) error {
+    buf := make([]byte, 512)
+    for try := 0; try < maxRetries; try++ {
+        if _, err := t.conn.WriteToUDP(pkt, t.peer); err != nil {
+            return err
+        }
+        deadline := time.Now().Add(t.timeout)
+        for {
+            t.conn.SetReadDeadline(deadline)
+            n, from, err := t.conn.ReadFromUDP(buf)
+            var nerr net.Error
+            if errors.As(err, &nerr) && nerr.Timeout() {
+                break
+            }
+            if err != nil {
+                return err
+            }
+            if !from.IP.Equal(t.peer.IP) || from.Port != t.peer.Port {
+                t.conn.WriteToUDP(errorPacket(errUnknownTID, "unknown transfer ID"), from)
+                continue
+            }
+            if n < 4 {
+                continue
+            }
+            switch binary.BigEndian.Uint16(buf) {
+            case opACK:
+                if binary.BigEndian.Uint16(buf[2:]) == block {
+                    return nil
+                }
+            case opERROR:
+                msg, _, _ := bytes.Cut(buf[4:n], []byte{0})
+                return fmt.Errorf("client aborted: %s", msg)
+            }
+        }
+    }
+    return fmt.Errorf("no ACK for block %d after %d tries", block, maxRetries)
+}
+
+func (t *transfer) fail(code uint16, msg string) {
+    t.conn.WriteToUDP(errorPacket(code, msg), t.peer)
+}
+
+func errorPacket(code uint16, msg string) []byte {
+    pkt := make([]byte, 4, 5+len(msg))
+    binary.BigEndian.PutUint16(pkt, opERROR)
+    binary.BigEndian.PutUint16(pkt[2:], code)
+    pkt = append(pkt, msg...)
+    return append(pkt, 0)
+}
+
+// netascii converts a file to netascii on the fly: LF becomes CR LF and a
+// bare CR becomes CR NUL
+type netascii struct {
+    r       *bufio.Reader
+    pending byte
+    held    bool
+}
+
+func (n *netascii) Read(p []byte) (int, error) {
+    i := 0
+    for i < len(p) {
+        if n.held {
+            p[i] = n.pending
+            n.held = false
+            i++
+            continue
+        }
+        c, err := n.r.ReadByte()
+        if err != nil {
+            if i > 0 {
+                return i, nil
+            }
+            return 0, err
+        }
+        switch c {
+        case '\n':
+            p[i], n.pending, n.held = '\r', '\n', true
+        case '\r':
+            p[i], n.pending, n.held = '\r', 0, true
+        default:
+            p[i] = c
+        }
+        i++
+    }
+    return i, nil
+}
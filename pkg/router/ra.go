@@ -0,0 +1,320 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/rfc1035label"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+
+	"github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// RFC 4861 section 10 protocol constants
+const (
+	raMaxInitialInterval = 16 * time.Second
+	raMaxInitialAdverts  = 3
+	raMinDelayBetween    = 3 * time.Second
+	raMaxResponseDelay   = 500 * time.Millisecond
+	raMaxRouterLifetime  = 9000 * time.Second
+
+	// prefix lifetimes, the RFC 4861 defaults
+	raValidLifetime     = 30 * 24 * time.Hour
+	raPreferredLifetime = 7 * 24 * time.Hour
+
+	raCurHopLimit = 64
+)
+
+// neighbour discovery option types
+const (
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndOptMTU            = 5
+	ndOptRDNSS          = 25
+	ndOptDNSSL          = 31
+)
+
+var (
+	allNodes   = net.ParseIP("ff02::1")
+	allRouters = net.ParseIP("ff02::2")
+)
+
+// RADaemon sends IPv6 router advertisements for the LAN prefix, both
+// periodically and in answer to router solicitations
+type RADaemon struct {
+	cfg     *config.Config
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	errChan chan error
+
+	prefix   *net.IPNet
+	resolver net.IP
+	iface    *net.Interface
+	conn     *icmp.PacketConn
+	pc       *ipv6.PacketConn
+
+	mu            sync.Mutex
+	lastMulticast time.Time
+}
+
+func NewRADaemon(cfg *config.Config) (*RADaemon, error) {
+	resolver, prefix, err := net.ParseCIDR(cfg.Interfaces.LAN.IPv6)
+	if err != nil || resolver.To4() != nil {
+		return nil, fmt.Errorf("invalid LAN IPv6 %q", cfg.Interfaces.LAN.IPv6)
+	}
+	if ones, _ := prefix.Mask.Size(); cfg.RA.Autonomous && ones != 64 {
+		return nil, fmt.Errorf("SLAAC needs a /64 LAN prefix, not %s", prefix)
+	}
+	if cfg.RA.Interval < 4*time.Second || cfg.RA.Interval > 1800*time.Second {
+		return nil, fmt.Errorf("RA interval %v must be between 4s and 1800s", cfg.RA.Interval)
+	}
+	if cfg.RA.Lifetime != 0 && (cfg.RA.Lifetime < cfg.RA.Interval || cfg.RA.Lifetime > raMaxRouterLifetime) {
+		return nil, fmt.Errorf("RA lifetime %v must be 0 or between the interval and %v", cfg.RA.Lifetime, raMaxRouterLifetime)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RADaemon{
+		cfg:      cfg,
+		ctx:      ctx,
+		cancel:   cancel,
+		errChan:  make(chan error, 1),
+		prefix:   prefix,
+		resolver: resolver,
+	}, nil
+}
+
+func (d *RADaemon) Start() error {
+	iface, err := net.InterfaceByName(d.cfg.Interfaces.LAN.Iface)
+	if err != nil {
+		return fmt.Errorf("failed to get interface: %w", err)
+	}
+	d.iface = iface
+
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %w", err)
+	}
+	pc := conn.IPv6PacketConn()
+	if err := d.setupConn(pc); err != nil {
+		conn.Close()
+		return err
+	}
+	d.conn, d.pc = conn, pc
+
+	log.Printf("Advertising %s on %s (M=%v O=%v A=%v)", d.prefix, iface.Name,
+		d.cfg.RA.Managed, d.cfg.RA.Other, d.cfg.RA.Autonomous)
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.advertise()
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.solicitations()
+	}()
+	return nil
+}
+
+// setupConn makes pc fit for neighbour discovery: hop limit 255 both
+// ways, only solicitations delivered, and the all-routers group joined
+func (d *RADaemon) setupConn(pc *ipv6.PacketConn) error {
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := pc.SetICMPFilter(&filter); err != nil {
+		return fmt.Errorf("failed to set ICMPv6 filter: %w", err)
+	}
+	if err := pc.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagInterface, true); err != nil {
+		return fmt.Errorf("failed to enable control messages: %w", err)
+	}
+	if err := pc.SetMulticastInterface(d.iface); err != nil {
+		return fmt.Errorf("failed to set multicast interface: %w", err)
+	}
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return fmt.Errorf("failed to set multicast hop limit: %w", err)
+	}
+	if err := pc.SetHopLimit(255); err != nil {
+		return fmt.Errorf("failed to set hop limit: %w", err)
+	}
+	if err := pc.SetMulticastLoopback(false); err != nil {
+		return fmt.Errorf("failed to disable multicast loopback: %w", err)
+	}
+	if err := pc.JoinGroup(d.iface, &net.IPAddr{IP: allRouters}); err != nil {
+		return fmt.Errorf("failed to join all-routers group: %w", err)
+	}
+	return nil
+}
+
+// advertise multicasts unsolicited advertisements, the first few quickly
+// so new links converge, then at a random point in [interval/3, interval]
+func (d *RADaemon) advertise() {
+	for sent := 0; ; sent++ {
+		d.sendMulticast()
+
+		max := d.cfg.RA.Interval
+		min := max / 3
+		wait := min + time.Duration(rand.Int63n(int64(max-min)))
+		if sent < raMaxInitialAdverts && wait > raMaxInitialInterval {
+			wait = raMaxInitialInterval
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// solicitations answers router solicitations until the socket closes
+func (d *RADaemon) solicitations() {
+	buf := make([]byte, 1500)
+	for {
+		n, cm, src, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			if d.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case d.errChan <- fmt.Errorf("reading router solicitations: %w", err):
+			default:
+			}
+			return
+		}
+		// RFC 4861 6.1.1: hop limit 255, code 0, at least 8 octets
+		if cm == nil || cm.HopLimit != 255 || cm.IfIndex != d.iface.Index || n < 8 || buf[1] != 0 {
+			continue
+		}
+		if buf[0] != byte(ipv6.ICMPTypeRouterSolicitation) {
+			continue
+		}
+
+		// answering at once from every router on the link would collide
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(time.Duration(rand.Int63n(int64(raMaxResponseDelay)))):
+		}
+
+		addr, _ := src.(*net.IPAddr)
+		if addr == nil || addr.IP.IsUnspecified() {
+			d.sendMulticast()
+			continue
+		}
+		d.send(d.advertisement(d.cfg.RA.Lifetime, false), addr.IP)
+	}
+}
+
+// sendMulticast advertises to all nodes, at most once per
+// MIN_DELAY_BETWEEN_RAS
+func (d *RADaemon) sendMulticast() {
+	d.mu.Lock()
+	if time.Since(d.lastMulticast) < raMinDelayBetween {
+		d.mu.Unlock()
+		return
+	}
+	d.lastMulticast = time.Now()
+	d.mu.Unlock()
+	d.send(d.advertisement(d.cfg.RA.Lifetime, false), allNodes)
+}
+
+func (d *RADaemon) send(msg []byte, dst net.IP) {
+	cm := &ipv6.ControlMessage{HopLimit: 255, IfIndex: d.iface.Index}
+	if _, err := d.pc.WriteTo(msg, cm, &net.IPAddr{IP: dst, Zone: d.iface.Name}); err != nil {
+		log.Printf("Failed to send router advertisement to %s: %v", dst, err)
+	}
+}
+
+// advertisement builds an RA. A final one withdraws krouter as default
+// router and resolver while leaving clients their addresses.
+func (d *RADaemon) advertisement(lifetime time.Duration, final bool) []byte {
+	var flags byte
+	if d.cfg.RA.Managed {
+		flags |= 0x80
+	}
+	if d.cfg.RA.Other {
+		flags |= 0x40
+	}
+	body := []byte{raCurHopLimit, flags, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(body[2:], uint16(lifetime/time.Second))
+
+	body = append(body, ndOption(ndOptSourceLinkAddr, d.iface.HardwareAddr)...)
+	if d.cfg.RA.MTU > 0 {
+		mtu := make([]byte, 6)
+		binary.BigEndian.PutUint32(mtu[2:], uint32(d.cfg.RA.MTU))
+		body = append(body, ndOption(ndOptMTU, mtu)...)
+	}
+
+	// prefix information: on-link, and autonomous when SLAAC is allowed
+	ones, _ := d.prefix.Mask.Size()
+	pi := make([]byte, 30)
+	pi[0] = byte(ones)
+	pi[1] = 0x80
+	if d.cfg.RA.Autonomous {
+		pi[1] |= 0x40
+	}
+	binary.BigEndian.PutUint32(pi[2:], uint32(raValidLifetime/time.Second))
+	binary.BigEndian.PutUint32(pi[6:], uint32(raPreferredLifetime/time.Second))
+	copy(pi[14:], d.prefix.IP.To16())
+	body = append(body, ndOption(ndOptPrefixInfo, pi)...)
+
+	// RFC 8106 suggests DNS lifetimes of at least three intervals
+	dnsLifetime := uint32(3 * d.cfg.RA.Interval / time.Second)
+	if final {
+		dnsLifetime = 0
+	}
+	rdnss := make([]byte, 6, 6+net.IPv6len)
+	binary.BigEndian.PutUint32(rdnss[2:], dnsLifetime)
+	rdnss = append(rdnss, d.resolver.To16()...)
+	body = append(body, ndOption(ndOptRDNSS, rdnss)...)
+
+	if len(d.cfg.RA.DNSSL) > 0 {
+		dnssl := make([]byte, 6)
+		binary.BigEndian.PutUint32(dnssl[2:], dnsLifetime)
+		labels := &rfc1035label.Labels{Labels: d.cfg.RA.DNSSL}
+		dnssl = append(dnssl, labels.ToBytes()...)
+		body = append(body, ndOption(ndOptDNSSL, dnssl)...)
+	}
+
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeRouterAdvertisement,
+		Body: &icmp.RawBody{Data: body},
+	}
+	// the kernel fills in the ICMPv6 checksum on raw sockets
+	b, _ := msg.Marshal(nil)
+	return b
+}
+
+// ndOption frames data as a neighbour discovery option, zero padded to a
+// multiple of 8 octets
+func ndOption(typ byte, data []byte) []byte {
+	n := (len(data) + 2 + 7) / 8
+	opt := make([]byte, n*8)
+	opt[0], opt[1] = typ, byte(n)
+	copy(opt[2:], data)
+	return opt
+}
+
+// Stop withdraws krouter as default router before closing the socket
+func (d *RADaemon) Stop() {
+	d.cancel()
+	if d.conn == nil {
+		return
+	}
+	d.send(d.advertisement(0, true), allNodes)
+	d.conn.Close()
+	d.wg.Wait()
+}
+
+func (d *RADaemon) Errors() <-chan error {
+	return d.errChan
+}
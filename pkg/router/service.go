@@ -8,9 +8,14 @@ import (
         "sync/atomic"
         "time"
 
+        "go.uber.org/zap/zapcore"
+
         "github.com/ryanvillarreal/krouter/pkg/config"
         "github.com/ryanvillarreal/krouter/pkg/dhcp"
         "github.com/ryanvillarreal/krouter/pkg/dns"
+        "github.com/ryanvillarreal/krouter/pkg/pxe"
+        "github.com/ryanvillarreal/krouter/pkg/utils"
+        "github.com/ryanvillarreal/krouter/pkg/wpad"
 )
 
 type Status struct {
@@ -27,22 +32,61 @@ type Service struct {
         // info objs
         status  Status
         ticker  *time.Ticker
+        logger  *utils.Logger
+        // DHCP packet debug, and the log level to restore when it ends
+        dhcpDebug bool
+        logLevel  zapcore.Level
         // key objs
         ifManager *InterfaceManager
         dhcp      *dhcp.Service
         dns       *dns.DNSProxy
+        wpad      *wpad.Service
+        pxe       *pxe.Service
+        ra        *RADaemon
 }
 
 func New(cfg *config.Config) (*Service, error) {
+        logger, err := utils.NewLogger(cfg.Logging)
+        if err != nil {
+                return nil, fmt.Errorf("failed to create logger: %w", err)
+        }
+
+        dnsProxy, err := dns.NewDNSProxy(cfg)
+        if err != nil {
+                return nil, fmt.Errorf("failed to create DNS proxy: %w", err)
+        }
+
         ctx, cancel := context.WithCancel(context.Background())
         s := &Service{
                 cfg:    cfg,
                 ctx:    ctx,
                 cancel: cancel,
                 ticker: time.NewTicker(5 * time.Second),
+                logger: logger,
                 ifManager: NewInterfaceManager(cfg),
-                dhcp:   dhcp.NewDHCPService(cfg),
-                dns:    dns.NewDNSProxy(cfg),
+                dhcp:   dhcp.NewDHCPService(cfg, logger),
+                dns:    dnsProxy,
+        }
+
+        if cfg.WPAD.Enabled {
+                if s.wpad, err = wpad.NewWPADService(cfg); err != nil {
+                        cancel()
+                        return nil, fmt.Errorf("failed to create WPAD service: %w", err)
+                }
+        }
+
+        if cfg.PXE.Enabled {
+                if s.pxe, err = pxe.NewPXEService(cfg); err != nil {
+                        cancel()
+                        return nil, fmt.Errorf("failed to create PXE service: %w", err)
+                }
+        }
+
+        if cfg.RA.Enabled && cfg.Interfaces.LAN.IPv6 != "" {
+                if s.ra, err = NewRADaemon(cfg); err != nil {
+                        cancel()
+                        return nil, fmt.Errorf("failed to create RA daemon: %w", err)
+                }
         }
 
         s.status.healthy.Store(true)
@@ -69,6 +113,43 @@ func (s *Service) Start() error {
                 return fmt.Errorf("failed to start DNS service: %w", err)
         }
 
+        // Start WPAD service
+        if s.wpad != nil {
+                if err := s.wpad.Start(); err != nil {
+                        s.dns.Stop()
+                        s.dhcp.Stop()
+                        return fmt.Errorf("failed to start WPAD service: %w", err)
+                }
+        }
+
+        // Start PXE boot server
+        if s.pxe != nil {
+                if err := s.pxe.Start(); err != nil {
+                        if s.wpad != nil {
+                                s.wpad.Stop()
+                        }
+                        s.dns.Stop()
+                        s.dhcp.Stop()
+                        return fmt.Errorf("failed to start PXE service: %w", err)
+                }
+        }
+
+        // Start router advertisements last, once DHCPv6 and DNS can
+        // answer the clients they bring
+        if s.ra != nil {
+                if err := s.ra.Start(); err != nil {
+                        if s.pxe != nil {
+                                s.pxe.Stop()
+                        }
+                        if s.wpad != nil {
+                                s.wpad.Stop()
+                        }
+                        s.dns.Stop()
+                        s.dhcp.Stop()
+                        return fmt.Errorf("failed to start RA daemon: %w", err)
+                }
+        }
+
         s.wg.Add(1)
         go func() {
                 defer s.wg.Done()
@@ -90,14 +171,58 @@ func (s *Service) monitorServices() {
                 case err := <-s.dns.Errors():
                         log.Printf("DNS service error: %v", err)
                         s.status.healthy.Store(false)
+                case err := <-s.wpadErrors():
+                        log.Printf("WPAD service error: %v", err)
+                        s.status.healthy.Store(false)
+                case err := <-s.pxeErrors():
+                        log.Printf("PXE service error: %v", err)
+                        s.status.healthy.Store(false)
+                case err := <-s.raErrors():
+                        log.Printf("RA daemon error: %v", err)
+                        s.status.healthy.Store(false)
                 case <-s.ctx.Done():
                         return
                 }
         }
 }
 
+// wpadErrors returns the WPAD error channel, or nil (never ready) when
+// WPAD is disabled
+func (s *Service) wpadErrors() <-chan error {
+        if s.wpad == nil {
+                return nil
+        }
+        return s.wpad.Errors()
+}
+
+// pxeErrors returns the PXE error channel, or nil when netboot is off
+func (s *Service) pxeErrors() <-chan error {
+        if s.pxe == nil {
+                return nil
+        }
+        return s.pxe.Errors()
+}
+
+// raErrors returns the RA daemon error channel, or nil when router
+// advertisements are off
+func (s *Service) raErrors() <-chan error {
+        if s.ra == nil {
+                return nil
+        }
+        return s.ra.Errors()
+}
+
 func (s *Service) Stop() {
         s.ticker.Stop()
+        if s.ra != nil {
+                s.ra.Stop()
+        }
+        if s.pxe != nil {
+                s.pxe.Stop()
+        }
+        if s.wpad != nil {
+                s.wpad.Stop()
+        }
         s.dns.Stop()
         s.dhcp.Stop()
         s.cancel()
@@ -105,6 +230,42 @@ func (s *Service) Stop() {
         log.Println("Router service stopped")
 }
 
+// ReloadDHCP applies cfg's DHCP settings to the running DHCP service and
+// resolves the new reservations' hostnames
+func (s *Service) ReloadDHCP(cfg *config.Config) error {
+        if err := s.dhcp.Reload(cfg); err != nil {
+                return err
+        }
+        s.dns.SetReservations(cfg.DHCP.Reservations)
+        return nil
+}
+
+// SetDHCPDebug turns per-packet DHCP logging on or off, lowering the log
+// level to debug while it is on
+func (s *Service) SetDHCPDebug(on bool) error {
+        if on == s.dhcpDebug {
+                return nil
+        }
+        if err := s.dhcp.SetPacketDebug(on); err != nil {
+                return err
+        }
+        if on {
+                s.logLevel = s.logger.Level()
+                if s.logLevel > zapcore.DebugLevel {
+                        s.logger.SetLevel(zapcore.DebugLevel)
+                }
+        } else {
+                s.logger.SetLevel(s.logLevel)
+        }
+        s.dhcpDebug = on
+        return nil
+}
+
+// DHCPDebug reports whether per-packet DHCP logging is on
+func (s *Service) DHCPDebug() bool {
+        return s.dhcpDebug
+}
+
 func (s *Service) IsHealthy() bool {
         return s.status.healthy.Load()
 }
@@ -115,6 +276,10 @@ func (s *Service) performHealthCheck() {
         log.Printf("Health Check - Status: %v, Last Check: %s",
           healthy,
           s.status.lastCheck.Format(time.RFC3339))
+        for _, r := range s.dhcp.RogueServers() {
+                log.Printf("Health Check - rogue DHCPv%d server %s (%s), last seen %s",
+                        r.Family, r.MAC, r.IP, r.LastSeen.Format(time.RFC3339))
+        }
 }
 
 func (s *Service) run() {
@@ -12,6 +12,8 @@ import (
 type Logger struct {
 	*zap.Logger
 	*zap.SugaredLogger
+	// level is shared by every output so it can be changed at runtime
+	level zap.AtomicLevel
 }
 
 // Config holds the logger configuration
@@ -51,10 +53,11 @@ func DefaultConfig() Config {
 // NewLogger creates a new logger instance with the given configuration
 func NewLogger(config Config) (*Logger, error) {
 	// Parse log level
-	level, err := zapcore.ParseLevel(config.LogLevel)
+	parsed, err := zapcore.ParseLevel(config.LogLevel)
 	if err != nil {
 		return nil, err
 	}
+	level := zap.NewAtomicLevelAt(parsed)
 
 	// Create encoder config
 	encoderConfig := zapcore.EncoderConfig{
@@ -110,19 +113,32 @@ func NewLogger(config Config) (*Logger, error) {
 	core := zapcore.NewTee(cores...)
 
 	// Create logger
-	logger := zap.New(
-		core,
+	options := []zap.Option{
 		zap.AddCaller(),
 		zap.AddStacktrace(zapcore.ErrorLevel),
-		zap.Development(config.Development),
-	)
+	}
+	if config.Development {
+		options = append(options, zap.Development())
+	}
+	logger := zap.New(core, options...)
 
 	return &Logger{
 		Logger:        logger,
 		SugaredLogger: logger.Sugar(),
+		level:         level,
 	}, nil
 }
 
+// Level returns the minimum level currently logged
+func (l *Logger) Level() zapcore.Level {
+	return l.level.Level()
+}
+
+// SetLevel changes the minimum level logged by every output
+func (l *Logger) SetLevel(level zapcore.Level) {
+	l.level.SetLevel(level)
+}
+
 // Helper function to check if a slice contains a string
 func contains(slice []string, str string) bool {
 	for _, s := range slice {
@@ -0,0 +1,196 @@
+package wpad
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "text/template"
+    "time"
+
+    "github.com/ryanvillarreal/krouter/pkg/config"
+)
+
+// defaultPAC sends everything through the proxy except bypassed hosts,
+// bypassed networks and plain host names.
+const defaultPAC = `function FindProxyForURL(url, host) {
+    if (isPlainHostName(host)) return "DIRECT";
+{{- range .Hosts}}
+    if (shExpMatch(host, "{{.}}")) return "DIRECT";
+{{- end}}
+{{- range .Networks}}
+    if (isInNet(dnsResolve(host), "{{.Net}}", "{{.Mask}}")) return "DIRECT";
+{{- end}}
+    return "PROXY {{.Proxy}}; DIRECT";
+}
+`
+
+// PACData is handed to the PAC template
+type PACData struct {
+    Proxy    string
+    Hosts    []string
+    Networks []PACNetwork
+}
+
+// PACNetwork is a bypassed network in isInNet form
+type PACNetwork struct {
+    Net  string
+    Mask string
+}
+
+type Service struct {
+    cfg     *config.Config
+    ctx     context.Context
+    cancel  context.CancelFunc
+    wg      sync.WaitGroup
+    errChan chan error
+    pac     []byte
+    servers []*http.Server
+}
+
+func NewWPADService(cfg *config.Config) (*Service, error) {
+    // DHCP option 252 and most clients only reach the PAC over IPv4
+    if _, err := URL(cfg); err != nil {
+        return nil, err
+    }
+    pac, err := renderPAC(cfg)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    return &Service{
+        cfg:     cfg,
+        ctx:     ctx,
+        cancel:  cancel,
+        errChan: make(chan error, 1),
+        pac:     pac,
+    }, nil
+}
+
+// URL returns the address clients fetch the PAC file from, which needs a
+// LAN IPv4 address
+func URL(cfg *config.Config) (string, error) {
+    ip := config.HostIP(cfg.Interfaces.LAN.IPv4).To4()
+    if ip == nil {
+        return "", fmt.Errorf("WPAD needs a LAN IPv4 address")
+    }
+    host := ip.String()
+    if cfg.WPAD.Port != 0 && cfg.WPAD.Port != 80 {
+        host = net.JoinHostPort(host, strconv.Itoa(cfg.WPAD.Port))
+    }
+    return fmt.Sprintf("http://%s/wpad.dat", host), nil
+}
+
+func renderPAC(cfg *config.Config) ([]byte, error) {
+    text := defaultPAC
+    if cfg.WPAD.Template != "" {
+        raw, err := os.ReadFile(cfg.WPAD.Template)
+        if err != nil {
+            return nil, fmt.Errorf("reading PAC template: %w", err)
+        }
+        text = string(raw)
+    }
+    tmpl, err := template.New("pac").Parse(text)
+    if err != nil {
+        return nil, fmt.Errorf("parsing PAC template: %w", err)
+    }
+
+    data := PACData{Proxy: cfg.WPAD.Proxy}
+    if data.Proxy == "" {
+        ip := config.HostIP(cfg.Interfaces.LAN.IPv4)
+        if ip == nil {
+            return nil, fmt.Errorf("no proxy configured and no LAN IPv4 to default to")
+        }
+        data.Proxy = net.JoinHostPort(ip.String(), "8080")
+    }
+    for _, b := range cfg.WPAD.Bypass {
+        if _, n, err := net.ParseCIDR(b); err == nil {
+            if n.IP.To4() == nil {
+                // isInNet only understands IPv4
+                continue
+            }
+            data.Networks = append(data.Networks, PACNetwork{
+                Net:  n.IP.String(),
+                Mask: net.IP(n.Mask).String(),
+            })
+            continue
+        }
+        data.Hosts = append(data.Hosts, b)
+    }
+
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, data); err != nil {
+        return nil, fmt.Errorf("rendering PAC template: %w", err)
+    }
+    return buf.Bytes(), nil
+}
+
+func (s *Service) Start() error {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/wpad.dat", s.servePAC)
+    mux.HandleFunc("/proxy.pac", s.servePAC)
+
+    port := strconv.Itoa(s.cfg.WPAD.Port)
+    var addrs []string
+    if ip := config.HostIP(s.cfg.Interfaces.LAN.IPv4); ip != nil {
+        addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+    }
+    if ip := config.HostIP(s.cfg.Interfaces.LAN.IPv6); ip != nil {
+        addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+    }
+    if len(addrs) == 0 {
+        return fmt.Errorf("no LAN address to serve WPAD on")
+    }
+
+    for _, addr := range addrs {
+        ln, err := net.Listen("tcp", addr)
+        if err != nil {
+            s.Stop()
+            return fmt.Errorf("failed to listen on %s: %w", addr, err)
+        }
+        server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+        s.servers = append(s.servers, server)
+
+        s.wg.Add(1)
+        go func() {
+            defer s.wg.Done()
+            if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                select {
+                case s.errChan <- fmt.Errorf("WPAD server error: %w", err):
+                default:
+                }
+            }
+        }()
+        log.Printf("WPAD server started on %s", addr)
+    }
+    return nil
+}
+
+func (s *Service) servePAC(w http.ResponseWriter, r *http.Request) {
+    client, _, _ := net.SplitHostPort(r.RemoteAddr)
+    log.Printf("WPAD: %s fetched %s (%s)", client, r.URL.Path, strings.TrimSpace(r.UserAgent()))
+    w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+    w.Write(s.pac)
+}
+
+func (s *Service) Stop() {
+    s.cancel()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for _, server := range s.servers {
+        server.Shutdown(ctx)
+    }
+    s.wg.Wait()
+}
+
+func (s *Service) Errors() <-chan error {
+    return s.errChan
+}